@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+// defaultBodyMemory is how much of a request body is held in memory before
+// the rest is spilled to a temporary file.
+const defaultBodyMemory = 1 << 20
+
+// defaultBodySpill caps a buffered body that has no size limit, so spilling it
+// cannot fill the disk.
+const defaultBodySpill = 100 << 20
+
+// errBodyTooLarge reports a body over its size limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+type bodyKey struct{}
+
+// requestBody is a request body read once by the handler and shared by every
+// stage of the Director. Up to request_body.memory bytes are kept in memory;
+// larger bodies are spilled to a temporary file and only loaded when a
+// sanitizer needs their content. A streamed body is not buffered at all.
+type requestBody struct {
+	mem      []byte
+	file     *os.File // spilled body; mem holds nothing until loaded
+	size     int64
+	streamed bool
+}
+
+// bodyFrom returns the body buffered for a request, or nil.
+func bodyFrom(req *http.Request) *requestBody {
+	b, _ := req.Context().Value(bodyKey{}).(*requestBody)
+	return b
+}
+
+// bodyLimit returns the size limit for a request body: the route's
+// max_body_bytes, else the first request_body.limits entry matching the
+// Content-Type, else server.maxBodyBytes. 0 means no limit.
+func bodyLimit(k *koanf.Koanf, route *koanf.Koanf, ct string) int64 {
+	if route != nil && route.Exists("max_body_bytes") {
+		return route.Int64("max_body_bytes")
+	}
+	if i, ok := matchBodyType(k.Slices("request_body.limits"), ct); ok {
+		return k.Slices("request_body.limits")[i].Int64("max_bytes")
+	}
+	return k.Int64("server.maxBodyBytes")
+}
+
+// matchBodyType returns the index of the first entry whose content_type
+// matches ct: a media type (application/json), a wildcard subtype (image/*) or
+// a structured syntax suffix (+json).
+func matchBodyType(entries []*koanf.Koanf, ct string) (int, bool) {
+	media := mediaType(ct)
+	for i, e := range entries {
+		if mediaTypeMatches(e.String("content_type"), media) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func mediaTypeMatches(pattern, media string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	switch {
+	case pattern == "*/*":
+		return true
+	case strings.HasPrefix(pattern, "+"):
+		return strings.HasSuffix(media, pattern)
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(media, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == media
+}
+
+// isStreamedType reports whether request_body.stream lists the Content-Type.
+// Such bodies are forwarded as they arrive, without buffering or sanitizing.
+func isStreamedType(k *koanf.Koanf, ct string) bool {
+	for _, pattern := range k.Strings("request_body.stream") {
+		if mediaTypeMatches(pattern, mediaType(ct)) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferRequestBody reads r.Body once, enforcing the body size limit, and
+// replaces it with a reader over the buffer. A buffered body without a limit
+// is held to request_body.max_spill. Streamed types are only wrapped in the
+// limit. It returns errBodyTooLarge when the limit is exceeded; the caller
+// answers with 413.
+func bufferRequestBody(w http.ResponseWriter, r *http.Request, k *koanf.Koanf, route *koanf.Koanf) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	ct := r.Header.Get("Content-Type")
+	limit := bodyLimit(k, route, ct)
+	streamed := isStreamedType(k, ct)
+	if limit <= 0 && !streamed {
+		limit = defaultBodySpill
+		if k.Exists("request_body.max_spill") {
+			limit = k.Int64("request_body.max_spill")
+		}
+	}
+	if limit > 0 && r.ContentLength > limit {
+		return nil, errBodyTooLarge
+	}
+	if streamed {
+		if limit > 0 {
+			// A chunked body over the limit aborts the upstream request.
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		return &requestBody{streamed: true}, nil
+	}
+
+	memory := int64(defaultBodyMemory)
+	if k.Exists("request_body.memory") {
+		memory = k.Int64("request_body.memory")
+	}
+	src := io.Reader(r.Body)
+	if limit > 0 {
+		src = &maxBytesReader{r: r.Body, n: limit}
+	}
+	defer r.Body.Close()
+
+	b := &requestBody{}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(src, memory+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= memory {
+		b.mem, b.size = buf.Bytes(), n
+	} else {
+		f, err := ioutil.TempFile(k.String("request_body.temp_dir"), "httpsanitizer-body-")
+		if err != nil {
+			return nil, err
+		}
+		b.file = f
+		if _, err = f.Write(buf.Bytes()); err == nil {
+			var rest int64
+			rest, err = io.Copy(f, src)
+			b.size = n + rest
+		}
+		if err != nil {
+			b.close()
+			return nil, err
+		}
+	}
+	r.Body = b.reader()
+	r.ContentLength = b.size
+	return b, nil
+}
+
+// maxBytesReader reads from r and fails with errBodyTooLarge once more than n
+// bytes arrive, so callers can tell an oversized body from a failed read.
+type maxBytesReader struct {
+	r io.Reader
+	n int64 // bytes still allowed
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	if int64(n) > m.n {
+		n, m.n = int(m.n), 0
+		return n, errBodyTooLarge
+	}
+	m.n -= int64(n)
+	return n, err
+}
+
+// reader returns a fresh reader over the buffered body.
+func (b *requestBody) reader() io.ReadCloser {
+	if b.file != nil && b.mem == nil {
+		return ioutil.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+	return ioutil.NopCloser(bytes.NewReader(b.mem))
+}
+
+// bytes returns the body content, loading a spilled body into memory.
+func (b *requestBody) bytes() ([]byte, error) {
+	if b.file != nil && b.mem == nil {
+		mem, err := ioutil.ReadAll(io.NewSectionReader(b.file, 0, b.size))
+		if err != nil {
+			return nil, err
+		}
+		b.mem = mem
+	}
+	return b.mem, nil
+}
+
+// close removes a spilled body's temporary file.
+func (b *requestBody) close() {
+	if b == nil || b.file == nil {
+		return
+	}
+	b.file.Close()
+	if err := os.Remove(b.file.Name()); err != nil {
+		log.Printf("request_body: %v", err)
+	}
+	b.file = nil
+}
+
+// readBody returns the content of a request body for a sanitizer or validator.
+// Stages that only inspect the body leave req.Body alone; stages that rewrite
+// it call setBody.
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	if b := bodyFrom(req); b != nil && !b.streamed {
+		return b.bytes()
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// setBody replaces the request body, e.g. with its sanitized form. A nil
+// body discards it.
+func setBody(req *http.Request, body []byte) {
+	if b := bodyFrom(req); b != nil && !b.streamed {
+		b.close()
+		b.mem, b.size = body, int64(len(body))
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+}
+
+// isStreamedBody reports whether a request body is forwarded as it arrives;
+// body sanitizers and validators skip it.
+func isStreamedBody(req *http.Request) bool {
+	b := bodyFrom(req)
+	return b != nil && b.streamed
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimit(t *testing.T) {
+	c := testConfig(t, `
+server:
+  maxBodyBytes: 1000
+request_body:
+  limits:
+    - content_type: application/json
+      max_bytes: 100
+    - content_type: image/*
+      max_bytes: 5000
+    - content_type: +xml
+      max_bytes: 200
+routes:
+  - path: /upload
+    max_body_bytes: 0
+`)
+	tests := []struct {
+		path, ct string
+		want     int64
+	}{
+		{"/", "application/json; charset=utf-8", 100},
+		{"/", "IMAGE/png", 5000},
+		{"/", "application/soap+xml", 200},
+		{"/", "text/plain", 1000},
+		{"/", "", 1000},
+		{"/upload", "application/json", 0},
+	}
+	for _, tt := range tests {
+		if got := bodyLimit(c, matchRoute(c, tt.path), tt.ct); got != tt.want {
+			t.Errorf("%s %q: limit %d, want %d", tt.path, tt.ct, got, tt.want)
+		}
+	}
+}
+
+func TestBufferRequestBody(t *testing.T) {
+	dir := t.TempDir()
+	c := testConfig(t, `
+server:
+  maxBodyBytes: 64
+request_body:
+  memory: 16
+  temp_dir: `+dir+`
+  stream: [application/octet-stream]
+`)
+	tests := []struct {
+		name, ct, body string
+		chunked        bool
+		spilled        bool
+		streamed       bool
+		tooLarge       bool
+	}{
+		{"in memory", "text/plain", strings.Repeat("a", 16), false, false, false, false},
+		{"spilled", "text/plain", strings.Repeat("b", 40), false, true, false, false},
+		{"too large", "text/plain", strings.Repeat("c", 65), false, false, false, true},
+		{"too large chunked", "text/plain", strings.Repeat("d", 65), true, false, false, true},
+		{"streamed", "application/octet-stream", strings.Repeat("e", 40), false, false, true, false},
+		{"streamed too large", "application/octet-stream", strings.Repeat("f", 65), false, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.ct)
+			if tt.chunked {
+				r.ContentLength = -1
+			}
+			b, err := bufferRequestBody(httptest.NewRecorder(), r, c, nil)
+			if tt.tooLarge {
+				if !errors.Is(err, errBodyTooLarge) {
+					t.Fatalf("error %v, want errBodyTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error %v", err)
+			}
+			defer b.close()
+			if b.streamed != tt.streamed || (b.file != nil) != tt.spilled {
+				t.Fatalf("streamed %v spilled %v", b.streamed, b.file != nil)
+			}
+			got, _ := ioutil.ReadAll(r.Body)
+			if string(got) != tt.body {
+				t.Errorf("body %q, want %q", got, tt.body)
+			}
+			if tt.streamed {
+				return
+			}
+			if got, _ := b.bytes(); string(got) != tt.body {
+				t.Errorf("bytes %q, want %q", got, tt.body)
+			}
+			name := ""
+			if b.file != nil {
+				name = b.file.Name()
+			}
+			b.close()
+			if name != "" {
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("temporary file %s left behind", name)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferRequestBodySpillCap(t *testing.T) {
+	c := testConfig(t, `
+server:
+  maxBodyBytes: 0
+request_body:
+  memory: 16
+  max_spill: 32
+  temp_dir: `+t.TempDir()+`
+  stream: [application/octet-stream]
+`)
+	tests := []struct {
+		name, ct, body string
+		tooLarge       bool
+	}{
+		{"spilled", "text/plain", strings.Repeat("a", 32), false},
+		{"over max_spill", "text/plain", strings.Repeat("b", 33), true},
+		{"streamed", "application/octet-stream", strings.Repeat("c", 33), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.ct)
+			r.ContentLength = -1
+			b, err := bufferRequestBody(httptest.NewRecorder(), r, c, nil)
+			if got := errors.Is(err, errBodyTooLarge); got != tt.tooLarge {
+				t.Fatalf("error %v, want too large %v", err, tt.tooLarge)
+			}
+			b.close()
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/knadh/koanf"
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultCanonicalRounds is how many decoding passes canonicalize makes when
+// rounds is not set.
+const defaultCanonicalRounds = 3
+
+// canonicalize returns the canonical form of a value the rule at p applies to,
+// as configured by the canonicalize section of k: up to rounds passes of
+// percent, HTML entity and JavaScript escape decoding (canonicalize.decode,
+// default all three) and Unicode NFKC normalization, until the value stops
+// changing. Detectors and
+// filters then run on the result, so %253Cscript, &#x3C;script, <script
+// and ＜script all reach strip_html as <script.
+//
+// A value that is not valid UTF-8 once decoded, including overlong encodings
+// such as %C0%BC, is handled by canonicalize.invalid_utf8: reject (default)
+// rejects the request, sanitize blanks the value and replace substitutes
+// U+FFFD. ok is false when the value was blanked or rejected. Rules of type
+// json and rules with canonicalize: false are left alone; the values inside an
+// embedded JSON document are canonicalized one by one.
+func canonicalize(k, rk *koanf.Koanf, p, field, value, location string, flag *blockFlag, al *auditLog) (string, bool) {
+	if !k.Exists("canonicalize") || p == "" || value == "" {
+		return value, true
+	}
+	if rk.Exists(p+".canonicalize") && !rk.Bool(p+".canonicalize") || rk.String(p+".type") == "json" {
+		return value, true
+	}
+	rounds := defaultCanonicalRounds
+	if k.Exists("canonicalize.rounds") {
+		rounds = k.Int("canonicalize.rounds")
+	}
+	layers := map[string]bool{"url": true, "html": true, "js": true}
+	if k.Exists("canonicalize.decode") {
+		layers = make(map[string]bool)
+		for _, l := range k.Strings("canonicalize.decode") {
+			layers[l] = true
+		}
+	}
+	nfkc := k.String("canonicalize.unicode") != "none"
+
+	v := value
+	for i := 0; i < rounds; i++ {
+		prev := v
+		if layers["url"] {
+			v = percentDecode(v)
+		}
+		if layers["html"] && strings.IndexByte(v, '&') >= 0 {
+			v = html.UnescapeString(v)
+		}
+		if layers["js"] {
+			v = jsUnescape(v)
+		}
+		if nfkc && utf8.ValidString(v) {
+			v = norm.NFKC.String(v)
+		}
+		if v == prev {
+			break
+		}
+	}
+
+	if !utf8.ValidString(v) {
+		reason := fmt.Sprintf("%s field %q is not valid UTF-8 after decoding", location, field)
+		log.Printf("canonicalize: %s", reason)
+		if al != nil {
+			al.add("canonicalize", field, location)
+		}
+		switch k.String("canonicalize.invalid_utf8") {
+		case "replace":
+			return strings.ToValidUTF8(v, "\uFFFD"), true
+		case "sanitize":
+			if flag != nil {
+				flag.trigger(reason)
+			}
+		default:
+			if flag != nil {
+				flag.reject(reason)
+			}
+		}
+		return "", false
+	}
+	return v, true
+}
+
+// canonicalForward picks the value forwarded upstream once the rule has run
+// on the canonical form. Under canonicalize.forward: original (default) a
+// value the detectors and filters left unchanged is forwarded as received,
+// so legitimate data such as a literal "50%25" survives; a changed one is
+// forwarded in its sanitized canonical form. forward: canonical always
+// forwards the canonical form, so the upstream cannot decode a layer the
+// proxy did not see.
+func canonicalForward(k *koanf.Koanf, raw, canonical, sanitized string) string {
+	if sanitized == canonical && k.String("canonicalize.forward") != "canonical" {
+		return raw
+	}
+	return sanitized
+}
+
+// jsUnescape decodes JavaScript \xXX, \uXXXX and \u{X...} escapes and leaves
+// any other backslash as it is.
+func jsUnescape(s string) string {
+	if !strings.Contains(s, `\x`) && !strings.Contains(s, `\u`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			if r, n := jsEscape(s[i+1:]); n > 0 {
+				b.WriteRune(r)
+				i += n
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// jsEscape decodes the escape at the start of s (after the backslash) and
+// returns the rune and the number of bytes it spans, or 0 if s does not start
+// with a hex escape.
+func jsEscape(s string) (rune, int) {
+	hex := func(h string) (rune, bool) {
+		var r rune
+		for i := 0; i < len(h); i++ {
+			if !isHexDigit(h[i]) {
+				return 0, false
+			}
+			r = r<<4 | rune(unhex(h[i]))
+		}
+		return r, h != ""
+	}
+	switch {
+	case strings.HasPrefix(s, "x") && len(s) >= 3:
+		if r, ok := hex(s[1:3]); ok {
+			return r, 3
+		}
+	case strings.HasPrefix(s, "u{"):
+		if end := strings.IndexByte(s, '}'); end > 2 && end <= 8 {
+			if r, ok := hex(s[2:end]); ok && utf8.ValidRune(r) {
+				return r, end + 1
+			}
+		}
+	case strings.HasPrefix(s, "u") && len(s) >= 5:
+		if r, ok := hex(s[1:5]); ok && utf8.ValidRune(r) {
+			return r, 5
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	const rule = `
+form_params:
+  q:
+    type: text
+  token:
+    type: text
+    canonicalize: false
+`
+	tests := []struct {
+		name, cfg, field, value, want string
+		ok, rejected                  bool
+	}{
+		{"percent", "canonicalize: {}", "q", "%3Cscript%3E", "<script>", true, false},
+		{"double percent", "canonicalize: {}", "q", "%253Cscript%253E", "<script>", true, false},
+		{"html entities", "canonicalize: {}", "q", "&#x3C;script&gt;", "<script>", true, false},
+		{"js escapes", "canonicalize: {}", "q", `\x3cscript>\u{2F}`, "<script>/", true, false},
+		{"mixed layers", "canonicalize: {}", "q", "%26lt%3Bscript%26%23x3e%3B", "<script>", true, false},
+		{"full width", "canonicalize: {}", "q", "＜ｓｃｒｉｐｔ＞", "<script>", true, false},
+		{"ligature", "canonicalize: {}", "q", "ﬁle", "file", true, false},
+		{"no nfkc", "canonicalize:\n  unicode: none", "q", "＜", "＜", true, false},
+		{"one round", "canonicalize:\n  rounds: 1", "q", "%253C", "%3C", true, false},
+		{"url only", "canonicalize:\n  decode: [url]", "q", "%3C&lt;", "<&lt;", true, false},
+		{"overlong", "canonicalize: {}", "q", "%C0%BC", "", false, true},
+		{"overlong sanitize", "canonicalize:\n  invalid_utf8: sanitize", "q", "%C0%BC", "", false, false},
+		{"overlong replace", "canonicalize:\n  invalid_utf8: replace", "q", "a%C0", "a�", true, false},
+		{"rule opt out", "canonicalize: {}", "token", "%3C", "%3C", true, false},
+		{"disabled", "", "q", "%3C", "%3C", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, tt.cfg+rule)
+			flag, al := &blockFlag{}, &auditLog{}
+			got, ok := canonicalize(c, c, "form_params."+tt.field, tt.field, tt.value, "query", flag, al)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("got %q %v, want %q %v", got, ok, tt.want, tt.ok)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v, want %v", flag.triggered, tt.rejected)
+			}
+			if !tt.ok && (len(al.events) != 1 || al.events[0].Rule != "canonicalize") {
+				t.Errorf("audit events %+v, want canonicalize", al.events)
+			}
+		})
+	}
+}
+
+func TestCanonicalForward(t *testing.T) {
+	const rule = `
+form_params:
+  q:
+    type: text
+    strip_html: true
+`
+	tests := []struct {
+		forward, query, want string
+	}{
+		{"original", "q=50%2525", "q=50%2525"},
+		{"original", "q=%253Cb%253Ex", "q=x"},
+		{"canonical", "q=50%2525", "q=50%25"},
+	}
+	for _, tt := range tests {
+		c := testConfig(t, "canonicalize:\n  forward: "+tt.forward+"\n"+rule)
+		r, flag, _ := testRequest(t, c, "GET", "/?"+tt.query, "", "")
+		sanitizingGET(r, c, flag)
+		if r.URL.RawQuery != tt.want {
+			got, _ := url.QueryUnescape(r.URL.RawQuery)
+			t.Errorf("forward %q, %s: got %s (%s), want %s", tt.forward, tt.query, r.URL.RawQuery, got, tt.want)
+		}
+	}
+}
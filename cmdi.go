@@ -0,0 +1,164 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// shellCommands are programs an injected command typically runs. They are
+// rarely English words, so one after a command separator is a strong signal.
+var shellCommands = map[string]bool{
+	"bash": true, "sh": true, "zsh": true, "ksh": true, "csh": true, "dash": true,
+	"busybox": true, "whoami": true, "uname": true, "wget": true, "curl": true,
+	"nc": true, "ncat": true, "netcat": true, "telnet": true, "socat": true,
+	"ls": true, "rm": true, "chmod": true, "chown": true, "nslookup": true,
+	"python": true, "python3": true, "perl": true, "ruby": true, "php": true,
+	"node": true, "base64": true, "xxd": true, "ifconfig": true, "ipconfig": true,
+	"netstat": true, "systeminfo": true, "certutil": true, "bitsadmin": true,
+	"powershell": true, "cmd": true, "pwsh": true, "wmic": true, "tftp": true,
+	"mkfifo": true, "crontab": true, "passwd": true, "useradd": true, "dig": true,
+	"env": true, "printenv": true, "nohup": true, "xargs": true, "awk": true,
+}
+
+// shellWords are commands that are also common words ("cat", "sleep"). After a
+// separator they only count when followed by what looks like an argument.
+var shellWords = map[string]bool{
+	"cat": true, "echo": true, "sleep": true, "id": true, "ping": true, "type": true,
+	"dir": true, "find": true, "more": true, "head": true, "tail": true, "kill": true,
+	"net": true, "set": true, "touch": true, "cp": true, "mv": true, "tar": true,
+	"sort": true, "grep": true, "exec": true, "eval": true, "source": true, "less": true,
+	"host": true, "who": true, "ps": true, "uptime": true, "hostname": true, "sed": true,
+}
+
+// cmdiPatterns are the pattern IDs detectCmdi reports and their confidence.
+var cmdiPatterns = map[string]int{
+	"cmdi-chain":        85, // ; | & && || or newline, then a command
+	"cmdi-chain-word":   75, // the same with a command that is also a word, given an argument
+	"cmdi-substitution": 90, // $(...)
+	"cmdi-backtick":     85, // `command ...`
+	"cmdi-ifs":          95, // ${IFS} or $IFS used as a space
+	"cmdi-devtcp":       95, // /dev/tcp/ or /dev/udp/ reverse shells
+	"cmdi-shell-path":   70, // /bin/sh, cmd.exe, %COMSPEC%
+	"cmdi-redirect":     50, // > /path, 2>&1
+}
+
+// detectCmdi reports shell command injection: a value that, pasted into a
+// shell command line (bare or inside quotes), ends the intended command and
+// runs another. A separator only counts when a command from shellCommands, or
+// a shellWords entry with an argument, follows it; substitutions, ${IFS} and
+// /dev/tcp count on their own.
+func detectCmdi(value string) (detection, bool) {
+	lower := strings.ToLower(value)
+	found := make(map[string]bool)
+
+	if strings.Contains(lower, "${ifs}") || strings.Contains(lower, "$ifs") {
+		found["cmdi-ifs"] = true
+	}
+	if strings.Contains(lower, "/dev/tcp/") || strings.Contains(lower, "/dev/udp/") {
+		found["cmdi-devtcp"] = true
+	}
+	for _, s := range []string{"/bin/sh", "/bin/bash", "/usr/bin/", "cmd.exe", "cmd /c", "%comspec%", "powershell.exe"} {
+		if strings.Contains(lower, s) {
+			found["cmdi-shell-path"] = true
+		}
+	}
+	if strings.Contains(lower, "2>&1") || strings.Contains(lower, ">/") || strings.Contains(lower, "> /") {
+		found["cmdi-redirect"] = true
+	}
+	if i := strings.Index(lower, "$("); i >= 0 && strings.IndexByte(lower[i:], ')') > 2 {
+		if w, _ := shellWordAt(lower, i+2); w != "" {
+			found["cmdi-substitution"] = true
+		}
+	}
+	for i := strings.IndexByte(lower, '`'); i >= 0; {
+		end := strings.IndexByte(lower[i+1:], '`')
+		if end < 0 {
+			break
+		}
+		if w, arg := shellWordAt(lower[:i+1+end], i+1); shellCommands[w] || shellWords[w] && arg {
+			found["cmdi-backtick"] = true
+		}
+		next := strings.IndexByte(lower[i+2+end:], '`')
+		if next < 0 {
+			break
+		}
+		i += 2 + end + next
+	}
+	for i := 0; i < len(lower); i++ {
+		switch lower[i] {
+		case ';', '|', '&', '\n', '\r':
+		default:
+			continue
+		}
+		j := i + 1
+		for j < len(lower) && (lower[j] == '|' || lower[j] == '&') {
+			j++
+		}
+		w, arg := shellWordAt(lower, j)
+		switch {
+		case shellCommands[w]:
+			found["cmdi-chain"] = true
+		case shellWords[w] && arg:
+			found["cmdi-chain-word"] = true
+		}
+		i = j - 1
+	}
+
+	return patternDetection(found, cmdiPatterns)
+}
+
+// shellWordAt returns the command word starting at s[i], after whitespace,
+// quotes, ${IFS} and a directory prefix (/usr/bin/id), and whether it is
+// followed by an argument: an option, a path, a number, a variable or the end
+// of the value.
+func shellWordAt(s string, i int) (string, bool) {
+skip:
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\'' || s[i] == '"' || s[i] == '(' || s[i] == '{':
+			i++
+		case strings.HasPrefix(s[i:], "${ifs}"):
+			i += len("${ifs}")
+		default:
+			break skip
+		}
+	}
+	start := i
+	for i < len(s) && (isASCIILetters(s[i:i+1]) || s[i] == '/' || s[i] == '.' || (i > start && s[i] >= '0' && s[i] <= '9')) {
+		i++
+	}
+	w := s[start:i]
+	if slash := strings.LastIndexByte(w, '/'); slash >= 0 {
+		w = w[slash+1:]
+	}
+	w = strings.TrimSuffix(w, ".exe")
+	if w == "" {
+		return "", false
+	}
+	rest := strings.TrimLeft(s[i:], " \t")
+	if strings.HasPrefix(s[i:], "${ifs}") || strings.HasPrefix(s[i:], "$ifs") {
+		rest = strings.TrimPrefix(strings.TrimPrefix(s[i:], "${ifs}"), "$ifs")
+	}
+	arg := rest == "" || i == len(s) || strings.IndexByte("-/.~$0123456789<>|;&`)'\"%", rest[0]) >= 0
+	return w, arg
+}
+
+// patternDetection turns the pattern IDs a detector found into a detection:
+// the fingerprint lists them, highest confidence first (ties by ID), and the
+// confidence is the highest of theirs. It reports false when found is empty.
+func patternDetection(found map[string]bool, confidence map[string]int) (detection, bool) {
+	if len(found) == 0 {
+		return detection{}, false
+	}
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		if confidence[ids[a]] != confidence[ids[b]] {
+			return confidence[ids[a]] > confidence[ids[b]]
+		}
+		return ids[a] < ids[b]
+	})
+	return detection{fingerprint: strings.Join(ids, ","), confidence: confidence[ids[0]]}, true
+}
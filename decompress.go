@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/knadh/koanf"
+)
+
+// Defaults for decompress_requests.
+const (
+	defaultDecompressMaxSize  = 10 << 20
+	defaultDecompressMaxRatio = 100
+)
+
+// decompressDecoders maps a content coding to a reader constructor.
+var decompressDecoders = map[string]func([]byte) (io.Reader, error){
+	"gzip":   gzipReader,
+	"x-gzip": gzipReader,
+	"br": func(b []byte) (io.Reader, error) {
+		return brotli.NewReader(bytes.NewReader(b)), nil
+	},
+	"deflate": func(b []byte) (io.Reader, error) {
+		// RFC 9110 deflate is zlib-wrapped, but some clients send a raw
+		// DEFLATE stream.
+		if r, err := zlib.NewReader(bytes.NewReader(b)); err == nil {
+			return r, nil
+		}
+		return flate.NewReader(bytes.NewReader(b)), nil
+	},
+}
+
+func gzipReader(b []byte) (io.Reader, error) {
+	return gzip.NewReader(bytes.NewReader(b))
+}
+
+// decompressingBody decodes a request body sent with Content-Encoding so the
+// sanitizers see the payload, and forwards the result uncompressed. Enabled by
+// the decompress_requests section. Every coding listed in the header must be
+// one of decompress_requests.encodings (default gzip, deflate and br); bodies
+// whose decoded size exceeds max_size, or max_ratio times their encoded size,
+// are rejected as compression bombs, as are corrupt streams.
+func decompressingBody(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
+	if !k.Exists("decompress_requests") || req.Body == nil {
+		return
+	}
+	var codings []string
+	for _, c := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+			codings = append(codings, c)
+		}
+	}
+	if len(codings) == 0 {
+		return
+	}
+
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	fail := func(field, reason string) {
+		log.Printf("decompress_requests: %s %s: %s", req.Method, req.URL.Path, reason)
+		if al != nil {
+			al.add("decompress_requests", field, "body")
+		}
+		if flag != nil {
+			flag.reject(reason)
+		}
+		setBody(req, nil)
+	}
+
+	allowed := map[string]bool{"gzip": true, "x-gzip": true, "deflate": true, "br": true}
+	if k.Exists("decompress_requests.encodings") {
+		allowed = make(map[string]bool)
+		for _, c := range k.Strings("decompress_requests.encodings") {
+			allowed[strings.ToLower(c)] = true
+		}
+		if allowed["gzip"] {
+			allowed["x-gzip"] = true
+		}
+	}
+	maxSize := int64(defaultDecompressMaxSize)
+	if k.Exists("decompress_requests.max_size") {
+		maxSize = k.Int64("decompress_requests.max_size")
+	}
+	maxRatio := int64(defaultDecompressMaxRatio)
+	if k.Exists("decompress_requests.max_ratio") {
+		maxRatio = k.Int64("decompress_requests.max_ratio")
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		fail("body", fmt.Sprintf("read error: %v", err))
+		return
+	}
+	encodedSize := int64(len(body))
+
+	// Codings are listed in the order they were applied; undo them in reverse.
+	for i := len(codings) - 1; i >= 0; i-- {
+		c := codings[i]
+		decoder, ok := decompressDecoders[c]
+		if !ok || !allowed[c] {
+			fail(c, fmt.Sprintf("Content-Encoding %q is not accepted", c))
+			return
+		}
+		r, err := decoder(body)
+		if err != nil {
+			fail("invalid", fmt.Sprintf("%s body cannot be decoded: %v", c, err))
+			return
+		}
+		limit, field := maxSize, "max_size"
+		if maxRatio > 0 && (maxSize <= 0 || encodedSize*maxRatio < maxSize) {
+			limit, field = encodedSize*maxRatio, "max_ratio"
+		}
+		if limit > 0 {
+			r = io.LimitReader(r, limit+1)
+		}
+		decoded, err := ioutil.ReadAll(r)
+		if err != nil {
+			fail("invalid", fmt.Sprintf("%s body cannot be decoded: %v", c, err))
+			return
+		}
+		if limit > 0 && int64(len(decoded)) > limit {
+			fail(field, fmt.Sprintf("decoded body exceeds decompress_requests %s", field))
+			return
+		}
+		body = decoded
+	}
+
+	// The body is forwarded as decoded; digests of the encoded body no longer
+	// apply to it.
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-MD5")
+	req.Header.Del("Digest")
+	req.Header.Del("Content-Digest")
+	setBody(req, body)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compress encodes s with the writer returned by newWriter.
+func compress(t *testing.T, s string, newWriter func(io.Writer) io.WriteCloser) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := newWriter(&b)
+	if _, err := io.WriteString(w, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestDecompressingBody(t *testing.T) {
+	gz := func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }
+	zl := func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }
+	raw := func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw }
+	br := func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) }
+	const body = "text=hello+world"
+	bomb := strings.Repeat("a", 1<<20)
+	tests := []struct {
+		name, cfg, encoding, body, want string
+		field                           string // audit field of the rejection, "" for none
+	}{
+		{"gzip", "", "gzip", compress(t, body, gz), body, ""},
+		{"x-gzip", "", "x-gzip", compress(t, body, gz), body, ""},
+		{"zlib deflate", "", "deflate", compress(t, body, zl), body, ""},
+		{"raw deflate", "", "deflate", compress(t, body, raw), body, ""},
+		{"stacked", "", "deflate, gzip", compress(t, compress(t, body, zl), gz), body, ""},
+		{"identity", "", "identity", body, body, ""},
+		{"br", "", "br", compress(t, body, br), body, ""},
+		{"br not in encodings", "  encodings: [gzip]\n", "br", compress(t, body, br), "", "br"},
+		{"corrupt br", "", "br", "not br", "", "invalid"},
+		{"br bomb", "", "br", compress(t, bomb, br), "", "max_ratio"},
+		{"unknown coding", "", "compress", body, "", "compress"},
+		{"not in encodings", "  encodings: [gzip]\n", "deflate", compress(t, body, zl), "", "deflate"},
+		{"corrupt", "", "gzip", "not gzip", "", "invalid"},
+		{"truncated", "", "gzip", compress(t, body, gz)[:12], "", "invalid"},
+		{"ratio bomb", "", "gzip", compress(t, bomb, gz), "", "max_ratio"},
+		{"size bomb", "  max_size: 1000\n  max_ratio: 0\n", "gzip", compress(t, bomb, gz), "", "max_size"},
+		{"within ratio", "  max_ratio: 0\n", "gzip", compress(t, bomb, gz), bomb, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, "decompress_requests:\n  enabled: true\n"+tt.cfg)
+			r, flag, al := testRequest(t, c, "POST", "/", "application/x-www-form-urlencoded", tt.body)
+			r.Header.Set("Content-Encoding", tt.encoding)
+			r.Header.Set("Digest", "sha-256=x")
+			decompressingBody(r, c, flag)
+			if got, _ := readBody(r); string(got) != tt.want {
+				t.Errorf("body %.40q, want %.40q", got, tt.want)
+			}
+			if flag.triggered != (tt.field != "") {
+				t.Errorf("rejected %v (%s)", flag.triggered, flag.reason)
+			}
+			if tt.field == "" {
+				if tt.encoding != "identity" && (r.Header.Get("Content-Encoding") != "" || r.Header.Get("Digest") != "") {
+					t.Errorf("encoding headers kept: %v", r.Header)
+				}
+				return
+			}
+			if len(al.events) != 1 || al.events[0].Field != tt.field {
+				t.Errorf("audit events %+v, want %s", al.events, tt.field)
+			}
+		})
+	}
+}
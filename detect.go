@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/knadh/koanf"
+)
+
+// defaultMinConfidence is the confidence a detector finding needs to count
+// when the rule sets no min_confidence.
+const defaultMinConfidence = 60
+
+// detection is a detector finding: the token fingerprint that matched and how
+// sure the detector is, from 0 to 100.
+type detection struct {
+	fingerprint string
+	confidence  int
+}
+
+// detectors are the injection detectors a parameter rule can enable, by
+// filter key. They run before the rule's type and filters, on the value as
+// canonicalized (see canonicalize). detect gets the rule for detector options;
+// encode, when set, makes a finding safe without blanking it, for the encode
+// action.
+var detectors = []struct {
+	key    string
+	detect func(rk *koanf.Koanf, p, value string) (detection, bool)
+	encode func(string) string
+}{
+	{"detect_sqli", func(_ *koanf.Koanf, _, v string) (detection, bool) { return detectSQLi(v) }, nil},
+	{"detect_xss", detectXSS, encodeHTML},
+	{"detect_cmdi", func(_ *koanf.Koanf, _, v string) (detection, bool) { return detectCmdi(v) }, nil},
+	{"detect_ssti", func(_ *koanf.Koanf, _, v string) (detection, bool) { return detectSSTI(v) }, nil},
+	{"detect_ldapi", func(_ *koanf.Koanf, _, v string) (detection, bool) { return detectLDAPi(v) }, nil},
+	{"detect_xpathi", func(_ *koanf.Koanf, _, v string) (detection, bool) { return detectXPathi(v) }, nil},
+	{"detect_crlf", func(_ *koanf.Koanf, _, v string) (detection, bool) { return detectCRLF(v) }, nil},
+}
+
+// applyDetectors runs the detectors the rule at p enables on a value found in
+// location. A finding at or above the rule's min_confidence is logged and
+// recorded with its fingerprint, then handled by the key's action:
+//
+//   - sanitize (or true) blanks the value, like an invalid email
+//   - encode rewrites the value with the detector's encoder and keeps it;
+//     detectors without one blank it as with sanitize
+//   - block rejects the request regardless of block_on_detect
+//   - log forwards the value unchanged
+func applyDetectors(rk *koanf.Koanf, p, field, value, location string, flag *blockFlag, al *auditLog) string {
+	if p == "" || value == "" {
+		return value
+	}
+	min := defaultMinConfidence
+	if rk.Exists(p + ".min_confidence") {
+		min = rk.Int(p + ".min_confidence")
+	}
+	for _, d := range detectors {
+		key := p + "." + d.key
+		if !rk.Exists(key) {
+			continue
+		}
+		action := rk.String(key)
+		if action == "false" {
+			continue
+		}
+		det, ok := d.detect(rk, p, value)
+		if !ok || det.confidence < min {
+			continue
+		}
+		log.Printf("%s: %s %q matched fingerprint %s (confidence %d)", d.key, location, field, det.fingerprint, det.confidence)
+		if al != nil {
+			al.addDetection(d.key, field, location, det)
+		}
+		reason := fmt.Sprintf("%s field %q matched %s fingerprint %s", location, field, d.key, det.fingerprint)
+		switch action {
+		case "log":
+		case "encode":
+			if d.encode != nil {
+				value = d.encode(value)
+				continue
+			}
+			if flag != nil {
+				flag.trigger(reason)
+			}
+			return ""
+		case "block":
+			if flag != nil {
+				flag.reject(reason)
+			}
+		default:
+			if flag != nil {
+				flag.trigger(reason)
+			}
+			return ""
+		}
+	}
+	return value
+}
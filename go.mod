@@ -3,7 +3,9 @@ module git.internal/kainkalju/httpsanitizer
 go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/asaskevich/govalidator v0.0.0-20210307081110-f21760c49a8d
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/knadh/koanf v0.15.0
+	golang.org/x/text v0.16.0
 )
@@ -0,0 +1,919 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/knadh/koanf"
+)
+
+// gqlToken is one lexical token of a GraphQL document. Strings keep their
+// source span so a sanitized literal can be spliced back in place.
+type gqlToken struct {
+	kind       byte // 'p' punctuator, 'n' name, 'i' int, 'f' float, 's' string, 0 end of input
+	val        string
+	start, end int
+}
+
+// lexGraphQL splits a GraphQL document into tokens. Whitespace, commas and
+// comments are dropped; string values are decoded.
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case strings.HasPrefix(src[i:], "\uFEFF"):
+			i += 3
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, gqlToken{'p', "...", i, i + 3})
+			i += 3
+		case strings.IndexByte("!$&()/:=@[]{}|", c) >= 0:
+			toks = append(toks, gqlToken{'p', string(c), i, i + 1})
+			i++
+		case c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i] >= 'A' && src[i] <= 'Z') || (src[i] >= 'a' && src[i] <= 'z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			toks = append(toks, gqlToken{'n', src[start:i], start, i})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			kind := byte('i')
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				((src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E'))) {
+				if src[i] == '.' || src[i] == 'e' || src[i] == 'E' {
+					kind = 'f'
+				}
+				i++
+			}
+			toks = append(toks, gqlToken{kind, src[start:i], start, i})
+		case strings.HasPrefix(src[i:], `"""`):
+			start := i
+			end := strings.Index(strings.ReplaceAll(src[i+3:], `\"""`, "\x00\x00\x00\x00"), `"""`)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated block string at %d", start)
+			}
+			i += 3 + end + 3
+			toks = append(toks, gqlToken{'s', strings.ReplaceAll(src[start+3:i-3], `\"""`, `"""`), start, i})
+		case c == '"':
+			start := i
+			val, n, err := decodeGraphQLString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at %d", err, start)
+			}
+			i += n
+			toks = append(toks, gqlToken{'s', val, start, i})
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("unexpected character %q at %d", r, i)
+		}
+	}
+	return append(toks, gqlToken{start: len(src), end: len(src)}), nil
+}
+
+// decodeGraphQLString decodes the quoted string at the start of s and returns
+// its value and length in bytes. GraphQL escapes are a subset of JSON's.
+func decodeGraphQLString(s string) (string, int, error) {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '\n', '\r':
+			return "", 0, fmt.Errorf("unterminated string")
+		case '"':
+			var v string
+			if err := json.Unmarshal([]byte(s[:i+1]), &v); err != nil {
+				return "", 0, fmt.Errorf("invalid string")
+			}
+			return v, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// gqlDocument is the part of a parsed executable document the inspection
+// needs: operations and fragments with their selection trees, and every string
+// literal in an argument, named by its argument path.
+type gqlDocument struct {
+	ops       []*gqlOperation
+	fragments map[string][]*gqlSelection
+	strings   []gqlStringLiteral
+}
+
+type gqlOperation struct {
+	kind string // query, mutation or subscription
+	name string
+	sel  []*gqlSelection
+}
+
+// gqlSelection is a field (name set), a fragment spread (spread set) or an
+// inline fragment (neither set).
+type gqlSelection struct {
+	name   string
+	alias  string
+	spread string
+	args   map[string]*gqlValue
+	sel    []*gqlSelection
+}
+
+type gqlValue struct {
+	kind byte // 'v' variable, 'i' int, or 0 for anything else
+	val  string
+}
+
+type gqlStringLiteral struct {
+	path jsonPath // argument name, then object fields and list indexes
+	tok  gqlToken
+}
+
+type gqlParser struct {
+	toks []gqlToken
+	pos  int
+	doc  *gqlDocument
+}
+
+// parseGraphQL parses an executable GraphQL document.
+func parseGraphQL(src string) (*gqlDocument, error) {
+	toks, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks, doc: &gqlDocument{fragments: make(map[string][]*gqlSelection)}}
+	for p.peek().kind != 0 {
+		if err := p.definition(); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.doc.ops) == 0 {
+		return nil, fmt.Errorf("document contains no operation")
+	}
+	return p.doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken { return p.toks[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) is(val string) bool {
+	t := p.peek()
+	return (t.kind == 'p' || t.kind == 'n') && t.val == val
+}
+
+func (p *gqlParser) expect(val string) error {
+	if t := p.next(); (t.kind != 'p' && t.kind != 'n') || t.val != val {
+		return fmt.Errorf("expected %q at %d", val, t.start)
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != 'n' {
+		return "", fmt.Errorf("expected name at %d", t.start)
+	}
+	return t.val, nil
+}
+
+func (p *gqlParser) definition() error {
+	if p.is("{") {
+		sel, err := p.selectionSet()
+		p.doc.ops = append(p.doc.ops, &gqlOperation{kind: "query", sel: sel})
+		return err
+	}
+	kind, err := p.name()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case "query", "mutation", "subscription":
+		op := &gqlOperation{kind: kind}
+		if p.peek().kind == 'n' {
+			op.name = p.next().val
+		}
+		if p.is("(") {
+			if err := p.variableDefinitions(); err != nil {
+				return err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+		if op.sel, err = p.selectionSet(); err != nil {
+			return err
+		}
+		p.doc.ops = append(p.doc.ops, op)
+	case "fragment":
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect("on"); err != nil {
+			return err
+		}
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+		sel, err := p.selectionSet()
+		if err != nil {
+			return err
+		}
+		p.doc.fragments[name] = sel
+	default:
+		return fmt.Errorf("unexpected %q", kind)
+	}
+	return nil
+}
+
+func (p *gqlParser) variableDefinitions() error {
+	p.next() // (
+	for !p.is(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if p.is("=") {
+			p.next()
+			if _, err := p.value(jsonPath{name}); err != nil {
+				return err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return err
+		}
+	}
+	p.next()
+	return nil
+}
+
+func (p *gqlParser) typeRef() error {
+	if p.is("[") {
+		p.next()
+		if err := p.typeRef(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.is("!") {
+		p.next()
+	}
+	return nil
+}
+
+func (p *gqlParser) directives() error {
+	for p.is("@") {
+		p.next()
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if p.is("(") {
+			if _, err := p.arguments(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *gqlParser) arguments() (map[string]*gqlValue, error) {
+	p.next() // (
+	args := make(map[string]*gqlValue)
+	for !p.is(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(jsonPath{name}); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+// value parses a value and records its string literals under path.
+func (p *gqlParser) value(path jsonPath) (*gqlValue, error) {
+	t := p.next()
+	switch {
+	case t.kind == 'p' && t.val == "$":
+		name, err := p.name()
+		return &gqlValue{kind: 'v', val: name}, err
+	case t.kind == 's':
+		p.doc.strings = append(p.doc.strings, gqlStringLiteral{path, t})
+		return &gqlValue{}, nil
+	case t.kind == 'i':
+		return &gqlValue{kind: 'i', val: t.val}, nil
+	case t.kind == 'f' || t.kind == 'n':
+		return &gqlValue{}, nil
+	case t.kind == 'p' && t.val == "[":
+		for i := 0; !p.is("]"); i++ {
+			if p.peek().kind == 0 {
+				return nil, fmt.Errorf("unterminated list")
+			}
+			if _, err := p.value(path.index(i)); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return &gqlValue{}, nil
+	case t.kind == 'p' && t.val == "{":
+		for !p.is("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if _, err := p.value(path.key(name)); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return &gqlValue{}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.val, t.start)
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.is("}") {
+		if p.peek().kind == 0 {
+			return nil, fmt.Errorf("unterminated selection set")
+		}
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	p.next()
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return sels, nil
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{}
+	var err error
+	if p.is("...") {
+		p.next()
+		if p.peek().kind == 'n' && p.peek().val != "on" {
+			sel.spread = p.next().val
+			return sel, p.directives()
+		}
+		if p.is("on") {
+			p.next()
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.directives(); err != nil {
+			return nil, err
+		}
+		sel.sel, err = p.selectionSet()
+		return sel, err
+	}
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if p.is(":") {
+		p.next()
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.is("(") {
+		if sel.args, err = p.arguments(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.directives(); err != nil {
+		return nil, err
+	}
+	if p.is("{") {
+		sel.sel, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+// gqlMaxSelections bounds the selections depth visits in one request. Each
+// fragment is walked once, so this is about the size of the document; it stops
+// documents built to make the walk itself expensive.
+const gqlMaxSelections = 10000
+
+// errGraphQLSelections is returned by depth when a request has more than
+// gqlMaxSelections selections.
+var errGraphQLSelections = fmt.Errorf("more than %d selections", gqlMaxSelections)
+
+// gqlWalker computes depth, cost and counts over selection trees, expanding
+// fragment spreads and refusing fragment cycles. The depth and cost of each
+// fragment are computed once and reused for every spread of it, so nested
+// spreads do not multiply the work.
+type gqlWalker struct {
+	doc       *gqlDocument
+	variables map[string]interface{}
+	listArgs  []string
+	visiting  map[string]bool
+	depths    map[string]int
+	costs     map[string]int
+	visited   int // selections visited by depth
+}
+
+func newGQLWalker(doc *gqlDocument, variables map[string]interface{}, listArgs []string) *gqlWalker {
+	return &gqlWalker{
+		doc:       doc,
+		variables: variables,
+		listArgs:  listArgs,
+		visiting:  make(map[string]bool),
+		depths:    make(map[string]int),
+		costs:     make(map[string]int),
+	}
+}
+
+// depth returns the field nesting of sels; fragments add no level of their own.
+func (w *gqlWalker) depth(sels []*gqlSelection) (int, error) {
+	max := 0
+	for _, s := range sels {
+		if w.visited++; w.visited > gqlMaxSelections {
+			return 0, errGraphQLSelections
+		}
+		var d int
+		var err error
+		switch {
+		case s.spread != "":
+			d, err = w.fragment(s.spread, w.depths, w.depth)
+		case s.name == "":
+			d, err = w.depth(s.sel)
+		default:
+			d, err = w.depth(s.sel)
+			d++
+		}
+		if err != nil {
+			return 0, err
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max, nil
+}
+
+// cost estimates the work of resolving sels: one per field, with the cost of a
+// field's selections multiplied by its page size argument (first, last, limit).
+func (w *gqlWalker) cost(sels []*gqlSelection) (int, error) {
+	total := 0
+	for _, s := range sels {
+		var c int
+		var err error
+		switch {
+		case s.spread != "":
+			c, err = w.fragment(s.spread, w.costs, w.cost)
+		case s.name == "":
+			c, err = w.cost(s.sel)
+		default:
+			c, err = w.cost(s.sel)
+			c = 1 + w.multiplier(s)*c
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += c
+		if total > 1<<30 {
+			total = 1 << 30
+		}
+	}
+	return total, nil
+}
+
+func (w *gqlWalker) multiplier(s *gqlSelection) int {
+	for _, name := range w.listArgs {
+		v, ok := s.args[name]
+		if !ok {
+			continue
+		}
+		raw := v.val
+		if v.kind == 'v' {
+			raw = fmt.Sprint(w.variables[v.val])
+		}
+		if n, err := strconv.Atoi(raw); err == nil && n > 1 {
+			if n > 1<<20 {
+				n = 1 << 20
+			}
+			return n
+		}
+	}
+	return 1
+}
+
+// fragment returns f of the named fragment's selections, from memo if it was
+// computed before.
+func (w *gqlWalker) fragment(name string, memo map[string]int, f func([]*gqlSelection) (int, error)) (int, error) {
+	if n, ok := memo[name]; ok {
+		return n, nil
+	}
+	sels, ok := w.doc.fragments[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown fragment %q", name)
+	}
+	if w.visiting[name] {
+		return 0, fmt.Errorf("fragment %q spreads itself", name)
+	}
+	w.visiting[name] = true
+	defer delete(w.visiting, name)
+	n, err := f(sels)
+	if err == nil {
+		memo[name] = n
+	}
+	return n, err
+}
+
+// fields calls f for every field in the document, fragments included.
+func (doc *gqlDocument) fields(f func(*gqlSelection)) {
+	var walk func([]*gqlSelection)
+	walk = func(sels []*gqlSelection) {
+		for _, s := range sels {
+			if s.name != "" {
+				f(s)
+			}
+			walk(s.sel)
+		}
+	}
+	for _, op := range doc.ops {
+		walk(op.sel)
+	}
+	for _, sels := range doc.fragments {
+		walk(sels)
+	}
+}
+
+// graphqlParams are the GraphQL-over-HTTP request parameters. On a graphql
+// route they are handled by the GraphQL inspection instead of form_params.
+var graphqlParams = map[string]bool{"query": true, "variables": true, "operationName": true, "extensions": true}
+
+// graphqlConfig returns the graphql section of the matched route, or nil.
+func graphqlConfig(pol *requestPolicy) *koanf.Koanf {
+	if pol.route == nil || !pol.route.Exists("graphql") {
+		return nil
+	}
+	return pol.route.Cut("graphql")
+}
+
+// graphqlInspector checks the operations of one request against a route's
+// graphql section and sanitizes their literal arguments and variables.
+type graphqlInspector struct {
+	k        *koanf.Koanf
+	cfg      *koanf.Koanf
+	pol      *requestPolicy
+	flag     *blockFlag
+	al       *auditLog
+	method   string
+	location string // "body" or "query"
+}
+
+func newGraphQLInspector(req *http.Request, k *koanf.Koanf, flag *blockFlag, location string) *graphqlInspector {
+	pol := policyFrom(req)
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	return &graphqlInspector{k: k, cfg: graphqlConfig(pol), pol: pol, flag: flag, al: al, method: req.Method, location: location}
+}
+
+// violation records a graphql policy violation. In mode reject (default) the
+// request is rejected; in mode audit it is only recorded.
+func (g *graphqlInspector) violation(field, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("graphql: %s", msg)
+	if g.al != nil {
+		g.al.add("graphql", field, g.location)
+	}
+	if g.cfg.String("mode") != "audit" && g.flag != nil {
+		g.flag.reject("GraphQL " + msg)
+	}
+}
+
+// graphqlAllowlists caches allowed_hashes_file contents by file name.
+var graphqlAllowlists sync.Map
+
+// allowed reports whether a persisted operation hash is allowlisted, and
+// whether an allowlist is configured at all.
+func (g *graphqlInspector) allowed(hash string) (bool, bool) {
+	configured := false
+	if g.cfg.Exists("allowed_hashes") {
+		configured = true
+		for _, h := range g.cfg.Strings("allowed_hashes") {
+			if strings.EqualFold(h, hash) {
+				return true, true
+			}
+		}
+	}
+	if name := g.cfg.String("allowed_hashes_file"); name != "" {
+		configured = true
+		v, err := loadWatchedFile(&graphqlAllowlists, name, "graphql", func(b []byte) (interface{}, error) {
+			set := make(map[string]bool)
+			for _, line := range strings.Split(string(b), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					set[strings.ToLower(line)] = true
+				}
+			}
+			return set, nil
+		})
+		if err != nil {
+			log.Printf("graphql: cannot load %s: %v", name, err)
+		} else if v.(map[string]bool)[strings.ToLower(hash)] {
+			return true, true
+		}
+	}
+	return false, configured
+}
+
+// inspect checks one GraphQL request and returns its query with sanitized
+// string literals. query may be empty for a persisted query sent by hash only.
+func (g *graphqlInspector) inspect(query, hash string, variables map[string]interface{}) string {
+	if query != "" {
+		sum := sha256.Sum256([]byte(query))
+		computed := hex.EncodeToString(sum[:])
+		if hash != "" && !strings.EqualFold(hash, computed) {
+			g.violation("persisted_query", "persisted query hash does not match the query")
+			return query
+		}
+		hash = computed
+	}
+	if ok, configured := g.allowed(hash); configured && !ok {
+		g.violation("persisted_query", "operation %s is not in the allowlist", hash)
+		return query
+	}
+	if query == "" {
+		return query
+	}
+
+	doc, err := parseGraphQL(query)
+	if err != nil {
+		g.violation("query", "invalid document: %v", err)
+		return query
+	}
+	listArgs := []string{"first", "last", "limit"}
+	if g.cfg.Exists("list_args") {
+		listArgs = g.cfg.Strings("list_args")
+	}
+	w := newGQLWalker(doc, variables, listArgs)
+	for _, op := range doc.ops {
+		if op.kind == "mutation" && g.method == http.MethodGet {
+			g.violation("mutation", "mutation sent with GET")
+		}
+		// depth also resolves every fragment spread, so it reports unknown
+		// and cyclic fragments before cost runs into them.
+		d, err := w.depth(op.sel)
+		if err == errGraphQLSelections {
+			// Rejected in any mode: the document is too large to inspect.
+			log.Printf("graphql: document has %v", err)
+			if g.al != nil {
+				g.al.add("graphql", "max_selections", g.location)
+			}
+			if g.flag != nil {
+				g.flag.reject("GraphQL document has " + err.Error())
+			}
+			return query
+		}
+		if err != nil {
+			g.violation("query", "invalid document: %v", err)
+			continue
+		}
+		if max := g.cfg.Int("max_depth"); max > 0 && d > max {
+			g.violation("max_depth", "operation depth %d exceeds max_depth %d", d, max)
+		}
+		if max := g.cfg.Int("max_cost"); max > 0 {
+			if c, _ := w.cost(op.sel); c > max {
+				g.violation("max_cost", "estimated cost %d exceeds max_cost %d", c, max)
+			}
+		}
+	}
+	aliases := 0
+	introspection := false
+	doc.fields(func(s *gqlSelection) {
+		if s.alias != "" {
+			aliases++
+		}
+		if s.name == "__schema" || s.name == "__type" {
+			introspection = true
+		}
+	})
+	if max := g.cfg.Int("max_aliases"); max > 0 && aliases > max {
+		g.violation("max_aliases", "%d aliases exceed max_aliases %d", aliases, max)
+	}
+	if introspection && g.cfg.Exists("introspection") && !g.cfg.Bool("introspection") {
+		g.violation("introspection", "introspection query")
+	}
+
+	// Sanitize string literals in arguments, named like form_params
+	// (input[email]), splicing changed ones back into the document.
+	sort.Slice(doc.strings, func(i, j int) bool { return doc.strings[i].tok.start < doc.strings[j].tok.start })
+	var out strings.Builder
+	last := 0
+	for _, lit := range doc.strings {
+		v := g.apply(lit.path, lit.path.paramName(), lit.tok.val)
+		if v == lit.tok.val {
+			continue
+		}
+		out.WriteString(query[last:lit.tok.start])
+		out.Write(encodeJSONString(v))
+		last = lit.tok.end
+	}
+	if last == 0 {
+		return query
+	}
+	out.WriteString(query[last:])
+	return out.String()
+}
+
+// apply sanitizes one string with the form_params rule for path, which is an
+// argument path (input[email]) or a path inside the variables object
+// (variables.input.email is looked up as input[email] too).
+func (g *graphqlInspector) apply(path jsonPath, field, value string) string {
+	name := path.paramName()
+	g.pol.see(name)
+	rk, p, _ := paramRule(g.k, g.pol, name)
+	return applyFieldRule(g.k, rk, p, field, value, g.location, g.flag, g.al)
+}
+
+// sanitizeGraphQLBody inspects a GraphQL-over-HTTP JSON body (a single request
+// object or a batch array) and returns it with the query documents and
+// variables sanitized. Other members (operationName, extensions) are forwarded
+// as they are, and strict_params does not apply to the envelope.
+func sanitizeGraphQLBody(req *http.Request, k *koanf.Koanf, body []byte, flag *blockFlag) []byte {
+	g := newGraphQLInspector(req, k, flag, "body")
+	v, _ := decodeJSONNumbers(body)
+	var envelopes []interface{}
+	batch := false
+	switch t := v.(type) {
+	case []interface{}:
+		envelopes, batch = t, true
+		if max := g.cfg.Int("max_batch"); max > 0 && len(t) > max {
+			g.violation("max_batch", "batch of %d operations exceeds max_batch %d", len(t), max)
+		}
+	default:
+		envelopes = []interface{}{t}
+	}
+
+	queries := make([]string, len(envelopes))
+	for i, e := range envelopes {
+		obj, _ := e.(map[string]interface{})
+		query, _ := obj["query"].(string)
+		variables, _ := obj["variables"].(map[string]interface{})
+		queries[i] = g.inspect(query, persistedQueryHash(obj["extensions"]), variables)
+	}
+
+	w := newJSONRewriter(k, g.pol, body, flag, g.al)
+	w.strict = false
+	w.sanitize = func(path jsonPath, s string) string {
+		i := 0
+		rel := path
+		if batch {
+			if len(rel) == 0 {
+				return s
+			}
+			i, _ = rel[0].(int)
+			rel = rel[1:]
+		}
+		switch {
+		case len(rel) == 1 && rel[0] == "query":
+			return queries[i]
+		case len(rel) >= 2 && rel[0] == "variables":
+			return g.apply(rel[1:], path.String(), s)
+		}
+		return s
+	}
+	out, _ := w.rewrite()
+	return out
+}
+
+// persistedQueryHash returns extensions.persistedQuery.sha256Hash (Apollo
+// automatic persisted queries), or "".
+func persistedQueryHash(ext interface{}) string {
+	if s, ok := ext.(string); ok {
+		// GET requests carry extensions as a JSON string.
+		var v interface{}
+		if json.Unmarshal([]byte(s), &v) != nil {
+			return ""
+		}
+		ext = v
+	}
+	e, _ := ext.(map[string]interface{})
+	pq, _ := e["persistedQuery"].(map[string]interface{})
+	hash, _ := pq["sha256Hash"].(string)
+	return hash
+}
+
+// sanitizingGraphQL handles GraphQL requests on a graphql route that are not
+// JSON bodies: GET requests with query/variables parameters and POST bodies of
+// type application/graphql. JSON bodies are handled by sanitizingJSONBody.
+func sanitizingGraphQL(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
+	if graphqlConfig(policyFrom(req)) == nil {
+		return
+	}
+	if req.Method == http.MethodGet {
+		g := newGraphQLInspector(req, k, flag, "query")
+		pairs := parseFormPairs(req.URL.RawQuery)
+		values := make(map[string]*formPair)
+		for _, fp := range pairs {
+			if fp.blank || fp.drop || !graphqlParams[fp.name] {
+				continue
+			}
+			if values[fp.name] != nil {
+				// Only one occurrence could be inspected; the upstream may
+				// read another.
+				log.Printf("graphql: %s parameter repeated", fp.name)
+				if g.al != nil {
+					g.al.add("graphql", fp.name, "query")
+				}
+				if flag != nil {
+					flag.reject(fmt.Sprintf("GraphQL %s parameter repeated", fp.name))
+				}
+				return
+			}
+			values[fp.name] = fp
+		}
+		if values["query"] == nil && values["extensions"] == nil {
+			return
+		}
+		var variables map[string]interface{}
+		if fp := values["variables"]; fp != nil {
+			if v, err := decodeJSONNumbers([]byte(fp.value)); err == nil {
+				variables, _ = v.(map[string]interface{})
+				w := newJSONRewriter(k, g.pol, []byte(fp.value), flag, g.al)
+				w.strict = false
+				w.sanitize = func(path jsonPath, s string) string {
+					return g.apply(path, append(jsonPath{"variables"}, path...).String(), s)
+				}
+				if out, changed := w.rewrite(); changed {
+					fp.value, fp.nameKept = string(out), true
+				}
+			}
+		}
+		var query, ext string
+		if fp := values["query"]; fp != nil {
+			query = fp.value
+		}
+		if fp := values["extensions"]; fp != nil {
+			ext = fp.value
+		}
+		if q := g.inspect(query, persistedQueryHash(ext), variables); q != query {
+			values["query"].value, values["query"].nameKept = q, true
+		}
+		req.URL.RawQuery = encodeFormPairs(pairs)
+		return
+	}
+
+	ct := strings.TrimSpace(req.Header.Get("Content-Type"))
+	if !strings.HasPrefix(ct, "application/graphql") || strings.HasPrefix(ct, "application/graphql-response") || req.Body == nil {
+		return
+	}
+	body, _ := readBody(req)
+	query := newGraphQLInspector(req, k, flag, "body").inspect(string(body), "", nil)
+	policyFrom(req).bodyParsed = true
+	setBody(req, []byte(query))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLWalker(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		variables   map[string]interface{}
+		depth, cost int
+		err         string
+	}{
+		{"flat", `{ a b c }`, nil, 1, 3, ""},
+		{"nested", `{ a { b { c } } }`, nil, 3, 3, ""},
+		{"page size", `{ users(first: 10) { name email } }`, nil, 2, 21, ""},
+		{"page size variable", `query($n: Int) { users(first: $n) { name } }`, map[string]interface{}{"n": 50}, 2, 51, ""},
+		{"fragment", `{ user { ...F } } fragment F on User { name friends { name } }`, nil, 3, 4, ""},
+		{"inline fragment", `{ node { ... on User { name } } }`, nil, 2, 2, ""},
+		{"fragment spread twice", `{ a { ...F } b { ...F } } fragment F on T { x { y } }`, nil, 3, 6, ""},
+		{"unknown fragment", `{ ...Missing }`, nil, 0, 0, `unknown fragment "Missing"`},
+		{"self spread", `{ ...A } fragment A on T { a { ...A } }`, nil, 0, 0, `fragment "A" spreads itself`},
+		{"mutual spread", `{ ...A } fragment A on T { ...B } fragment B on T { ...A }`, nil, 0, 0, `spreads itself`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parseGraphQL(tt.query)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			w := newGQLWalker(doc, tt.variables, []string{"first", "last", "limit"})
+			d, err := w.depth(doc.ops[0].sel)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("depth error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("depth: %v", err)
+			}
+			c, _ := w.cost(doc.ops[0].sel)
+			if d != tt.depth || c != tt.cost {
+				t.Errorf("depth %d cost %d, want %d and %d", d, c, tt.depth, tt.cost)
+			}
+		})
+	}
+}
+
+// fragmentBomb returns a document of n fragments, each spreading the previous
+// one twice, so that expanding every spread visits 2^n fields.
+func fragmentBomb(n int) string {
+	var b strings.Builder
+	b.WriteString("query { ...F" + fmt.Sprint(n) + " }\nfragment F0 on T { a }\n")
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "fragment F%d on T { ...F%d ...F%d }\n", i, i-1, i-1)
+	}
+	return b.String()
+}
+
+func TestGraphQLFragmentBomb(t *testing.T) {
+	for _, n := range []int{26, 64} {
+		doc, err := parseGraphQL(fragmentBomb(n))
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		w := newGQLWalker(doc, nil, nil)
+		d, err := w.depth(doc.ops[0].sel)
+		if err != nil || d != 1 {
+			t.Fatalf("n=%d: depth %d, %v; want 1", n, d, err)
+		}
+		want := 1 << 30 // cost saturates
+		if n < 30 {
+			want = 1 << n
+		}
+		if c, _ := w.cost(doc.ops[0].sel); c != want {
+			t.Errorf("n=%d: cost %d, want %d", n, c, want)
+		}
+	}
+}
+
+// inspectGraphQL runs the graphql section cfg of a route over query and
+// returns the block flag and audit log.
+func inspectGraphQL(t *testing.T, cfg, method, query string) (*blockFlag, *auditLog) {
+	t.Helper()
+	route := testConfig(t, cfg)
+	g := &graphqlInspector{
+		k:        testConfig(t, ""),
+		cfg:      route.Cut("graphql"),
+		pol:      &requestPolicy{route: route},
+		flag:     &blockFlag{},
+		al:       &auditLog{},
+		method:   method,
+		location: "body",
+	}
+	g.inspect(query, "", nil)
+	return g.flag, g.al
+}
+
+func TestGraphQLInspect(t *testing.T) {
+	const limits = `
+graphql:
+  max_depth: 3
+  max_aliases: 2
+  max_cost: 100
+  introspection: false
+`
+	tests := []struct {
+		name, cfg, method, query string
+		field                    string // audit field of the violation, "" for none
+		rejected                 bool
+	}{
+		{"within limits", limits, "POST", `{ user(id: 1) { name friends { name } } }`, "", false},
+		{"too deep", limits, "POST", `{ a { b { c { d } } } }`, "max_depth", true},
+		{"too many aliases", limits, "POST", `{ x: a y: a z: a }`, "max_aliases", true},
+		{"too costly", limits, "POST", `{ users(first: 100) { name } }`, "max_cost", true},
+		{"introspection", limits, "POST", `{ __schema { types { name } } }`, "introspection", true},
+		{"mutation over GET", limits, "GET", `mutation { logout }`, "mutation", true},
+		{"mutation over POST", limits, "POST", `mutation { logout }`, "", false},
+		{"does not parse", limits, "POST", `{ a `, "query", true},
+		{"cyclic fragment", limits, "POST", `{ ...A } fragment A on T { ...A }`, "query", true},
+		{"audit mode", limits + "  mode: audit\n", "POST", `{ a { b { c { d } } } }`, "max_depth", false},
+		{"fragment bomb", limits, "POST", fragmentBomb(40), "max_cost", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flag, al := inspectGraphQL(t, tt.cfg, tt.method, tt.query)
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+			if tt.field == "" {
+				if len(al.events) != 0 {
+					t.Errorf("audit events %+v, want none", al.events)
+				}
+				return
+			}
+			if len(al.events) == 0 || al.events[0].Field != tt.field {
+				t.Errorf("audit events %+v, want %s", al.events, tt.field)
+			}
+		})
+	}
+}
+
+func TestGraphQLMaxSelections(t *testing.T) {
+	query := "{" + strings.Repeat(" a", gqlMaxSelections+1) + " }"
+	// The selection cap applies even in audit mode.
+	flag, al := inspectGraphQL(t, "graphql:\n  mode: audit\n", "POST", query)
+	if !flag.triggered || !strings.Contains(flag.reason, "selections") {
+		t.Errorf("not rejected (%q)", flag.reason)
+	}
+	if len(al.events) != 1 || al.events[0].Field != "max_selections" {
+		t.Errorf("audit events %+v, want max_selections", al.events)
+	}
+
+	query = "{" + strings.Repeat(" a", gqlMaxSelections) + " }"
+	if flag, _ := inspectGraphQL(t, "graphql:\n  mode: audit\n", "POST", query); flag.triggered {
+		t.Errorf("%d selections rejected: %s", gqlMaxSelections, flag.reason)
+	}
+}
+
+func TestGraphQLPipeline(t *testing.T) {
+	// form_params without sanitize_json_body: the graphql route still
+	// sanitizes and forwards JSON and application/graphql bodies.
+	c := testConfig(t, `
+form_params:
+  _defaults_:
+    type: text
+    strip_html: true
+routes:
+  - path: /graphql
+    graphql:
+      introspection: false
+      max_depth: 2
+`)
+	tests := []struct {
+		name, method, target, ct, body, wantBody, wantQuery string
+		rejected                                            bool
+	}{
+		{"json body", "POST", "/graphql", "application/json", `{"query": "{ a }"}`, `{"query": "{ a }"}`, "", false},
+		{"json body sanitized", "POST", "/graphql", "application/json",
+			`{"query": "{ a(s: \"<b>x</b>\") }"}`, `{"query": "{ a(s: \"x\") }"}`, "", false},
+		{"graphql body", "POST", "/graphql", "application/graphql", `{ a }`, `{ a }`, "", false},
+		{"json body elsewhere", "POST", "/", "application/json", `{"query": "{ a }"}`, "", "", false},
+		{"get", "GET", "/graphql?query=%7B+a+%7D", "", "", "", "query=%7B+a+%7D", false},
+		{"repeated query", "GET", "/graphql?query=%7B__schema%7Btypes%7Bname%7D%7D%7D&query=%7Ba%7D", "", "", "", "", true},
+		{"repeated variables", "GET", "/graphql?query=%7Ba%7D&variables=%7B%7D&variables=%7B%7D", "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, flag, _ := testRequest(t, c, tt.method, tt.target, tt.ct, tt.body)
+			sanitizingGraphQL(r, c, flag)
+			if tt.method == "POST" {
+				sanitizingJSONBody(r, c, flag)
+				sanitizingPOST(r, c, flag)
+				if got, _ := readBody(r); string(got) != tt.wantBody {
+					t.Errorf("body %q, want %q", got, tt.wantBody)
+				}
+			} else if !tt.rejected && r.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query %s, want %s", r.URL.RawQuery, tt.wantQuery)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+		})
+	}
+}
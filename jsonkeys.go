@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// checkKey applies json_key_policy to an object key found under parent and
+// returns the key to forward and whether to keep the member:
+//
+//   - deny_operators (default true) refuses keys starting with "$" ($ne,
+//     $where, $gt), which MongoDB-style backends read as query operators
+//   - deny_prototype (default true) refuses __proto__, and prototype inside a
+//     constructor object, which pollute JavaScript object prototypes
+//   - deny lists further key patterns: globs, or regular expressions written
+//     as "/pattern/"
+//   - the sanitize_form_names filters, which apply to parameter names, rewrite
+//     the key as they would a form field name
+func (w *jsonRewriter) checkKey(parent jsonPath, key string) (string, bool) {
+	const p = "json_key_policy"
+	if !w.k.Exists(p) {
+		return key, true
+	}
+	field := parent.key(key).String()
+	if !w.k.Exists(p+".deny_operators") || w.k.Bool(p+".deny_operators") {
+		if strings.HasPrefix(key, "$") {
+			return key, w.keyViolation(field, fmt.Sprintf("JSON key %s is a query operator", field))
+		}
+	}
+	if !w.k.Exists(p+".deny_prototype") || w.k.Bool(p+".deny_prototype") {
+		parentKey := ""
+		if len(parent) > 0 {
+			parentKey, _ = parent[len(parent)-1].(string)
+		}
+		if key == "__proto__" || key == "prototype" && parentKey == "constructor" {
+			return key, w.keyViolation(field, fmt.Sprintf("JSON key %s reaches an object prototype", field))
+		}
+	}
+	for _, pattern := range w.k.Strings(p + ".deny") {
+		if matchKeyPattern(pattern, key) {
+			return key, w.keyViolation(field, fmt.Sprintf("JSON key %s matches denied pattern %q", field, pattern))
+		}
+	}
+	if !w.k.Exists("sanitize_form_names") {
+		return key, true
+	}
+	if filtered := validateFormName(w.k, "sanitize_form_names", key); filtered != key {
+		if filtered == "" {
+			return key, w.keyViolation(field, fmt.Sprintf("JSON key %s is empty after filtering", field))
+		}
+		log.Printf("json_key_policy: renaming JSON key %s to %q", field, filtered)
+		if w.flag != nil {
+			w.flag.trigger(fmt.Sprintf("JSON key %s violated json_key_policy", field))
+		}
+		if w.al != nil {
+			w.al.add("json_key_policy", field, w.location)
+		}
+		return filtered, true
+	}
+	return key, true
+}
+
+// checkScalar applies json_key_policy.expect_scalars to an object or array
+// found at path: when the rule for path has a scalar type (anything but json),
+// a container in its place is refused, so neither {"password": {"$ne": null}}
+// nor {"password": ["a", "b"]} can stand in for a string. It reports whether
+// to keep the member.
+func (w *jsonRewriter) checkScalar(at jsonPath) bool {
+	if !w.k.Bool("json_key_policy.expect_scalars") {
+		return true
+	}
+	rk, p, known := jsonRule(w.k, w.pol, at)
+	if !known || rk.String(p+".type") == "json" {
+		return true
+	}
+	return w.keyViolation(at.String(), fmt.Sprintf("JSON field %s is an object or array where its rule expects a scalar", at))
+}
+
+// keyViolation records a json_key_policy violation and applies the section's
+// mode: drop (default) removes the member and counts as a sanitizer hit,
+// reject rejects the request regardless of block_on_detect, and audit only
+// records it. It reports whether to keep the member.
+func (w *jsonRewriter) keyViolation(field, reason string) bool {
+	log.Printf("json_key_policy: %s", reason)
+	if w.al != nil {
+		w.al.add("json_key_policy", field, w.location)
+	}
+	switch w.k.String("json_key_policy.mode") {
+	case "audit":
+		return true
+	case "reject":
+		if w.flag != nil {
+			w.flag.reject(reason)
+		}
+	default:
+		if w.flag != nil {
+			w.flag.trigger(reason)
+		}
+	}
+	return false
+}
+
+// matchKeyPattern matches a JSON key against a deny pattern: a regular
+// expression written as "/pattern/", otherwise a glob.
+func matchKeyPattern(pattern, key string) bool {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := cachedRegexp(pattern[1 : len(pattern)-1])
+		if err != nil {
+			log.Printf("json_key_policy: invalid regex pattern %q: %v", pattern, err)
+			return false
+		}
+		return re.MatchString(key)
+	}
+	ok, err := path.Match(pattern, key)
+	return err == nil && ok
+}
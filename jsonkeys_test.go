@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONKeyPolicy(t *testing.T) {
+	const base = `
+sanitize_form_names:
+  strip_chars: "'"
+form_params:
+  password:
+    type: text
+  profile:
+    type: json
+json_key_policy:
+  deny: ["_*", "/^\\./"]
+  expect_scalars: true
+`
+	tests := []struct {
+		name, mode, src, want string
+		events                []string
+		rejected              bool
+	}{
+		{"clean", "", `{"user": "bob", "password": "x"}`, `{"user": "bob", "password": "x"}`, nil, false},
+		{"operator", "", `{"user": "bob", "filter": {"$ne": null}}`, `{"user": "bob", "filter": {}}`,
+			[]string{"json_key_policy:$.filter.$ne"}, false},
+		{"operator for a scalar", "", `{"user": "bob", "password": {"$ne": null}}`, `{"user": "bob"}`,
+			[]string{"json_key_policy:$.password"}, false},
+		{"object for a scalar", "", `{"user": "bob", "password": {"a": 1}}`, `{"user": "bob"}`,
+			[]string{"json_key_policy:$.password"}, false},
+		{"array for a scalar", "", `{"user": "bob", "password": ["a", "b"]}`, `{"user": "bob"}`,
+			[]string{"json_key_policy:$.password"}, false},
+		{"object for json", "", `{"profile": {"a": 1}}`, `{"profile": {"a": 1}}`, nil, false},
+		{"proto", "", `{"__proto__": {"isAdmin": true}, "a": 1}`, `{ "a": 1}`,
+			[]string{"json_key_policy:$.__proto__"}, false},
+		{"constructor prototype", "", `{"constructor": {"prototype": {"x": 1}, "name": "y"}}`, `{"constructor": { "name": "y"}}`,
+			[]string{"json_key_policy:$.constructor.prototype"}, false},
+		{"constructor alone", "", `{"constructor": "x"}`, `{"constructor": "x"}`, nil, false},
+		{"glob", "", `{"_id": 1, "id": 2}`, `{ "id": 2}`, []string{"json_key_policy:$._id"}, false},
+		{"regex", "", `{".hidden": 1}`, `{}`, []string{"json_key_policy:$['.hidden']"}, false},
+		{"renamed by sanitize_form_names", "", `{"na'me": "x"}`, `{"name": "x"}`, []string{`json_key_policy:$['na\'me']`}, false},
+		{"filtered to nothing", "", `{"''": "x", "a": 1}`, `{ "a": 1}`, []string{`json_key_policy:$['\'\'']`}, false},
+		{"reject", "reject", `{"$where": "1"}`, `{}`, []string{"json_key_policy:$.$where"}, true},
+		{"audit", "audit", `{"$where": "1"}`, `{"$where": "1"}`, []string{"json_key_policy:$.$where"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			if tt.mode != "" {
+				cfg += "  mode: " + tt.mode + "\n"
+			}
+			c := testConfig(t, cfg)
+			flag, al := &blockFlag{}, &auditLog{}
+			out, _ := rewriteJSON(c, &requestPolicy{}, []byte(tt.src), flag, al)
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v, want %v", flag.triggered, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestJSONKeysWithoutPolicy(t *testing.T) {
+	c := testConfig(t, "sanitize_form_names:\n  strip_chars: \"'\"\n")
+	src := `{"$ne": 1, "__proto__": {}, "na'me": "x"}`
+	if out, changed := rewriteJSON(c, &requestPolicy{}, []byte(src), &blockFlag{}, &auditLog{}); changed {
+		t.Errorf("rewritten without json_key_policy: %s", out)
+	}
+}
+
+func TestMatchKeyPattern(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"_*", "_id", true},
+		{"_*", "id", false},
+		{"/^\\./", ".x", true},
+		{"/^\\./", "x.", false},
+		{"/[/", "[", false},
+		{"a?c", "abc", true},
+	}
+	for _, tt := range tests {
+		if got := matchKeyPattern(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("%s %s: got %v", tt.pattern, tt.key, got)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/knadh/koanf"
+)
+
+// jsonLimits holds the json_limits settings. Zero values mean "no limit".
+type jsonLimits struct {
+	maxDepth            int
+	maxKeysPerObject    int
+	maxArrayLen         int
+	maxStringLen        int
+	rejectDuplicateKeys bool
+}
+
+func loadJSONLimits(k *koanf.Koanf) (jsonLimits, bool) {
+	if !k.Exists("json_limits") {
+		return jsonLimits{}, false
+	}
+	return jsonLimits{
+		maxDepth:            k.Int("json_limits.max_depth"),
+		maxKeysPerObject:    k.Int("json_limits.max_keys_per_object"),
+		maxArrayLen:         k.Int("json_limits.max_array_len"),
+		maxStringLen:        k.Int("json_limits.max_string_len"),
+		rejectDuplicateKeys: k.Bool("json_limits.reject_duplicate_keys"),
+	}, true
+}
+
+// jsonLimitError is a json_limits violation, as opposed to a syntax error
+// reported by the decoder.
+type jsonLimitError struct {
+	limit string // the json_limits key that was exceeded
+	msg   string
+}
+
+func (e *jsonLimitError) Error() string { return e.msg }
+
+func limitError(limit, format string, args ...interface{}) error {
+	return &jsonLimitError{limit: limit, msg: fmt.Sprintf(format, args...)}
+}
+
+// jsonFrame tracks one open object or array during the limits walk.
+type jsonFrame struct {
+	object    bool
+	count     int
+	expectKey bool
+	keys      map[string]bool
+}
+
+// checkJSONLimits walks body token by token with a streaming json.Decoder and
+// returns a *jsonLimitError describing the first json_limits violation, before
+// anything is materialized in memory. Syntax errors are returned as they are.
+func checkJSONLimits(body []byte, lim jsonLimits) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var stack []*jsonFrame
+
+	// value is called for every complete value (scalar or container start) and
+	// counts it against the enclosing container.
+	value := func() error {
+		if len(stack) == 0 {
+			return nil
+		}
+		top := stack[len(stack)-1]
+		if top.object {
+			top.expectKey = true
+			return nil
+		}
+		top.count++
+		if lim.maxArrayLen > 0 && top.count > lim.maxArrayLen {
+			return limitError("max_array_len", "array longer than max_array_len %d", lim.maxArrayLen)
+		}
+		return nil
+	}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			// Token reports a document cut off between tokens as a clean EOF.
+			if len(stack) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				if err := value(); err != nil {
+					return err
+				}
+				if lim.maxDepth > 0 && len(stack)+1 > lim.maxDepth {
+					return limitError("max_depth", "nesting deeper than max_depth %d", lim.maxDepth)
+				}
+				f := &jsonFrame{object: t == '{', expectKey: t == '{'}
+				if f.object && lim.rejectDuplicateKeys {
+					f.keys = make(map[string]bool)
+				}
+				stack = append(stack, f)
+			case '}', ']':
+				stack = stack[:len(stack)-1]
+			}
+		case string:
+			if lim.maxStringLen > 0 && len(t) > lim.maxStringLen {
+				return limitError("max_string_len", "string longer than max_string_len %d", lim.maxStringLen)
+			}
+			if len(stack) > 0 && stack[len(stack)-1].object && stack[len(stack)-1].expectKey {
+				top := stack[len(stack)-1]
+				top.expectKey = false
+				top.count++
+				if lim.maxKeysPerObject > 0 && top.count > lim.maxKeysPerObject {
+					return limitError("max_keys_per_object", "object with more than max_keys_per_object %d keys", lim.maxKeysPerObject)
+				}
+				if top.keys != nil {
+					if top.keys[t] {
+						return limitError("reject_duplicate_keys", "duplicate key %q", t)
+					}
+					top.keys[t] = true
+				}
+				continue
+			}
+			if err := value(); err != nil {
+				return err
+			}
+		default:
+			// json.Number, bool, nil
+			if err := value(); err != nil {
+				return err
+			}
+		}
+	}
+}
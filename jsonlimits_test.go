@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckJSONLimits(t *testing.T) {
+	lim := jsonLimits{
+		maxDepth:            3,
+		maxKeysPerObject:    3,
+		maxArrayLen:         3,
+		maxStringLen:        8,
+		rejectDuplicateKeys: true,
+	}
+	tests := []struct {
+		name, body, limit string // limit is the violated key, "" for none
+	}{
+		{"within limits", `{"a": [1, 2, {"b": "12345678"}], "c": null}`, ""},
+		{"too deep", `{"a": [[[1]]]}`, "max_depth"},
+		{"deep scalars", `[[[1, "x", true]]]`, ""},
+		{"too many keys", `{"a": 1, "b": 2, "c": 3, "d": 4}`, "max_keys_per_object"},
+		{"keys in nested objects", `{"a": {"x": 1, "y": 2}, "b": {"x": 1, "y": 2}}`, ""},
+		{"array too long", `[1, 2, 3, 4]`, "max_array_len"},
+		{"objects in array", `[{}, {}, {}, {}]`, "max_array_len"},
+		{"string too long", `{"a": "123456789"}`, "max_string_len"},
+		{"key too long", `{"123456789": 1}`, "max_string_len"},
+		{"duplicate key", `{"a": 1, "a": 2}`, "reject_duplicate_keys"},
+		{"same key in siblings", `[{"a": 1}, {"a": 2}]`, ""},
+		{"key equal to a value", `{"a": "b", "b": "a"}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkJSONLimits([]byte(tt.body), lim)
+			got := ""
+			if le, ok := err.(*jsonLimitError); ok {
+				got = le.limit
+			} else if err != nil {
+				t.Fatalf("syntax error %v", err)
+			}
+			if got != tt.limit {
+				t.Errorf("violated %q (%v), want %q", got, err, tt.limit)
+			}
+		})
+	}
+
+	if err := checkJSONLimits([]byte(`{"a": `), lim); err == nil {
+		t.Errorf("truncated document accepted")
+	} else if _, ok := err.(*jsonLimitError); ok {
+		t.Errorf("truncated document reported as a limit: %v", err)
+	}
+	if err := checkJSONLimits([]byte(strings.Repeat("[", 100000)), lim); err == nil {
+		t.Errorf("deep document accepted")
+	}
+}
+
+func TestJSONLimitsBody(t *testing.T) {
+	c := testConfig(t, `
+sanitize_json_body: true
+json_limits:
+  reject_duplicate_keys: true
+`)
+	tests := []struct {
+		body, want string
+		audit      []string
+	}{
+		{`{"role": "user"}`, `{"role": "user"}`, nil},
+		{`{"role": "user", "role": "admin"}`, "", []string{"json_limits:reject_duplicate_keys"}},
+		{`{"role": `, "", nil},
+	}
+	for _, tt := range tests {
+		r, flag, al := testRequest(t, c, "POST", "/", "application/json", tt.body)
+		sanitizingJSONBody(r, c, flag)
+		if got, _ := readBody(r); string(got) != tt.want {
+			t.Errorf("%s: body %s, want %s", tt.body, got, tt.want)
+		}
+		if got := auditFields(al); strings.Join(got, " ") != strings.Join(tt.audit, " ") {
+			t.Errorf("%s: audit %v, want %v", tt.body, got, tt.audit)
+		}
+	}
+}
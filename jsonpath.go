@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/knadh/koanf"
+)
+
+// jsonPath is the location of a value inside a decoded JSON document. Each
+// element is either an object key (string) or an array index (int).
+type jsonPath []interface{}
+
+func (jp jsonPath) key(name string) jsonPath {
+	out := make(jsonPath, len(jp), len(jp)+1)
+	copy(out, jp)
+	return append(out, name)
+}
+
+func (jp jsonPath) index(i int) jsonPath {
+	out := make(jsonPath, len(jp), len(jp)+1)
+	copy(out, jp)
+	return append(out, i)
+}
+
+var jsonIdent = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$-]*$`)
+
+// String renders the path in JSONPath notation, e.g. $.items[0].sku.
+// Keys that are not plain identifiers use the bracket form $['a b'].
+func (jp jsonPath) String() string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, seg := range jp {
+		switch s := seg.(type) {
+		case int:
+			b.WriteString("[" + strconv.Itoa(s) + "]")
+		case string:
+			if jsonIdent.MatchString(s) {
+				b.WriteString("." + s)
+			} else {
+				b.WriteString("['" + strings.ReplaceAll(s, "'", `\'`) + "']")
+			}
+		}
+	}
+	return b.String()
+}
+
+// paramName renders the path in the bracket notation used for form_params
+// lookup: $.items[0].sku → "items[0][sku]".
+func (jp jsonPath) paramName() string {
+	var b strings.Builder
+	for i, seg := range jp {
+		var s string
+		switch v := seg.(type) {
+		case int:
+			s = strconv.Itoa(v)
+		case string:
+			s = v
+		}
+		if i == 0 {
+			b.WriteString(s)
+		} else {
+			b.WriteString("[" + s + "]")
+		}
+	}
+	return b.String()
+}
+
+// jsonPathStep is one step of a compiled JSONPath expression.
+type jsonPathStep struct {
+	name    string // object key; "" for index and wildcard steps
+	index   int    // array index when isIndex
+	isIndex bool
+	wild    bool // [*] or .*
+	descend bool // ..name: the step may match at any depth
+}
+
+func (st jsonPathStep) matches(seg interface{}) bool {
+	if st.wild {
+		return true
+	}
+	switch s := seg.(type) {
+	case int:
+		return st.isIndex && st.index == s
+	case string:
+		return !st.isIndex && st.name == s
+	}
+	return false
+}
+
+// jsonPathCache holds compiled json_rules expressions keyed by source text.
+var jsonPathCache sync.Map
+
+// compileJSONPath parses the supported JSONPath subset: $ root, .key and
+// ['key'] children, [N] indexes, [*] / .* wildcards and ..key recursive descent.
+func compileJSONPath(expr string) ([]jsonPathStep, error) {
+	if steps, ok := jsonPathCache.Load(expr); ok {
+		return steps.([]jsonPathStep), nil
+	}
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("must start with $")
+	}
+	var steps []jsonPathStep
+	rest := expr[1:]
+	descend := false
+	for rest != "" {
+		st := jsonPathStep{descend: descend}
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			// Recursive descent applies to the step that follows: $..name, $..[*]
+			descend = true
+			rest = rest[2:]
+			if !strings.HasPrefix(rest, "[") {
+				rest = st.parseName(rest)
+				st.descend = true
+				break
+			}
+			continue
+		case strings.HasPrefix(rest, "."):
+			rest = st.parseName(rest[1:])
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			inner := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case inner == "*":
+				st.wild = true
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				st.name = strings.ReplaceAll(inner[1:len(inner)-1], `\'`, "'")
+			default:
+				n, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %q", inner)
+				}
+				st.index, st.isIndex = n, true
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest)
+		}
+		if st.name == "" && !st.wild && !st.isIndex {
+			return nil, fmt.Errorf("empty step")
+		}
+		descend = false
+		steps = append(steps, st)
+	}
+	jsonPathCache.Store(expr, steps)
+	return steps, nil
+}
+
+// parseName reads a dotted key (or *) and returns the remaining expression.
+func (st *jsonPathStep) parseName(rest string) string {
+	end := strings.IndexAny(rest, ".[")
+	if end < 0 {
+		end = len(rest)
+	}
+	if rest[:end] == "*" {
+		st.wild = true
+	} else {
+		st.name = rest[:end]
+	}
+	return rest[end:]
+}
+
+// matchJSONPath reports whether the compiled steps select exactly path.
+func matchJSONPath(steps []jsonPathStep, path jsonPath) bool {
+	if len(steps) == 0 {
+		return len(path) == 0
+	}
+	st := steps[0]
+	if !st.descend {
+		return len(path) > 0 && st.matches(path[0]) && matchJSONPath(steps[1:], path[1:])
+	}
+	for i := range path {
+		if st.matches(path[i]) && matchJSONPath(steps[1:], path[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonRule resolves the rule for a JSON value. json_rules entries take
+// precedence over form_params: the matched route's list is consulted before the
+// global one, and within a list the first matching entry wins. Otherwise the
+// value falls back to the form_params lookup by bracket name (see paramRule).
+func jsonRule(k *koanf.Koanf, pol *requestPolicy, path jsonPath) (*koanf.Koanf, string, bool) {
+	for _, src := range pol.ruleSources(k) {
+		for _, entry := range src.Slices("json_rules") {
+			expr := entry.String("path")
+			steps, err := compileJSONPath(expr)
+			if err != nil {
+				log.Printf("json_rules: invalid path %q: %v", expr, err)
+				continue
+			}
+			if matchJSONPath(steps, path) {
+				rk := koanf.New(".")
+				rk.MergeAt(entry, "json_rule")
+				return rk, "json_rule", true
+			}
+		}
+	}
+	return paramRule(k, pol, path.paramName())
+}
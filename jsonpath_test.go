@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestJSONPathString(t *testing.T) {
+	tests := []struct {
+		path       jsonPath
+		str, param string
+	}{
+		{nil, "$", ""},
+		{jsonPath{"user", "email"}, "$.user.email", "user[email]"},
+		{jsonPath{"items", 0, "sku"}, "$.items[0].sku", "items[0][sku]"},
+		{jsonPath{"a b", "it's"}, `$['a b']['it\'s']`, "a b[it's]"},
+		{jsonPath{0}, "$[0]", "0"},
+	}
+	for _, tt := range tests {
+		if got := tt.path.String(); got != tt.str {
+			t.Errorf("String() = %s, want %s", got, tt.str)
+		}
+		if got := tt.path.paramName(); got != tt.param {
+			t.Errorf("paramName() = %s, want %s", got, tt.param)
+		}
+	}
+}
+
+func TestMatchJSONPath(t *testing.T) {
+	tests := []struct {
+		expr  string
+		path  jsonPath
+		match bool
+	}{
+		{"$", nil, true},
+		{"$.a", jsonPath{"a"}, true},
+		{"$.a", jsonPath{"a", "b"}, false},
+		{"$.a.b", jsonPath{"a", "b"}, true},
+		{"$['a b']", jsonPath{"a b"}, true},
+		{`$["a"]`, jsonPath{"a"}, true},
+		{`$['it\'s']`, jsonPath{"it's"}, true},
+		{"$.items[0].sku", jsonPath{"items", 0, "sku"}, true},
+		{"$.items[1].sku", jsonPath{"items", 0, "sku"}, false},
+		{"$.items[*].sku", jsonPath{"items", 7, "sku"}, true},
+		{"$.items.*", jsonPath{"items", "x"}, true},
+		{"$.items[0]", jsonPath{"items", "0"}, false},
+		{"$..sku", jsonPath{"sku"}, true},
+		{"$..sku", jsonPath{"a", 1, "sku"}, true},
+		{"$..sku", jsonPath{"sku", "x"}, false},
+		{"$.a..c", jsonPath{"a", "b", "c"}, true},
+		{"$.a..c", jsonPath{"x", "b", "c"}, false},
+		{"$..[0]", jsonPath{"a", 0}, true},
+	}
+	for _, tt := range tests {
+		steps, err := compileJSONPath(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := matchJSONPath(steps, tt.path); got != tt.match {
+			t.Errorf("%s on %s: %v, want %v", tt.expr, tt.path, got, tt.match)
+		}
+	}
+	for _, expr := range []string{"a.b", "$.a[", "$.a[x]", "$.", "$a"} {
+		if _, err := compileJSONPath(expr); err == nil {
+			t.Errorf("%s: compiled, want error", expr)
+		}
+	}
+}
+
+func TestJSONRule(t *testing.T) {
+	c := testConfig(t, `
+json_rules:
+  - path: $.user.email
+    type: email
+  - path: $..email
+    type: text
+form_params:
+  "user[email]":
+    type: numeric
+  phone:
+    type: numeric
+routes:
+  - path: /admin
+    json_rules:
+      - path: $.user.email
+        type: url
+`)
+	tests := []struct {
+		target string
+		path   jsonPath
+		typ    string
+	}{
+		{"/", jsonPath{"user", "email"}, "email"},
+		{"/", jsonPath{"contact", "email"}, "text"},
+		{"/", jsonPath{"user", "phone"}, "numeric"},
+		{"/admin", jsonPath{"user", "email"}, "url"},
+	}
+	for _, tt := range tests {
+		r, _, _ := testRequest(t, c, "POST", tt.target, "", "")
+		rk, p, known := jsonRule(c, policyFrom(r), tt.path)
+		if got := rk.String(p + ".type"); got != tt.typ || !known {
+			t.Errorf("%s %s: type %s %v, want %s", tt.target, tt.path, got, known, tt.typ)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+
+	"github.com/knadh/koanf"
+)
+
+// jsonRewriter re-emits a JSON document while sanitizing its string values.
+// Everything no rule touched — key order, number literals, whitespace, escape
+// sequences — is copied from the source bytes unchanged; only strings whose
+// value changed are re-encoded, and members dropped under strict_params are
+// cut out together with their separator. src must be valid JSON.
+type jsonRewriter struct {
+	k       *koanf.Koanf
+	pol     *requestPolicy
+	flag    *blockFlag
+	al      *auditLog
+	src     []byte
+	pos     int
+	out     bytes.Buffer
+	changed bool
+	strict  bool // drop values without a rule (strict_params)
+	// root is the path of the document itself: nil for a body, the field's
+	// path for a document embedded in a string (a type: json rule).
+	root     jsonPath
+	location string // audit location of violations; "body" by default
+	// sanitize returns the new value of the string at path. It defaults to
+	// the json_rules/form_params lookup; GraphQL envelopes replace it.
+	sanitize func(path jsonPath, s string) string
+}
+
+func newJSONRewriter(k *koanf.Koanf, pol *requestPolicy, src []byte, flag *blockFlag, al *auditLog) *jsonRewriter {
+	w := &jsonRewriter{k: k, pol: pol, flag: flag, al: al, src: src, strict: strictParams(k, pol.route), location: "body"}
+	w.sanitize = func(path jsonPath, s string) string {
+		rk, p, _ := jsonRule(k, pol, path)
+		if p != "" && rk.String(p+".type") == "json" {
+			s = sanitizeEmbeddedJSON(k, pol, path, s, w.location, flag, al)
+		}
+		return applyFieldRule(k, rk, p, path.String(), s, w.location, flag, al)
+	}
+	return w
+}
+
+// sanitizeEmbeddedJSON sanitizes a JSON document carried in a string value
+// whose rule has type: json, a form field or a JSON string holding serialized
+// JSON. Its values are looked up under the field's path, so in a field named
+// payload the document {"user": {"email": ...}} has payload[user][email]. A
+// value that is not valid JSON is returned as is; applyRule blanks it.
+func sanitizeEmbeddedJSON(k *koanf.Koanf, pol *requestPolicy, path jsonPath, value string, location string, flag *blockFlag, al *auditLog) string {
+	if !json.Valid([]byte(value)) {
+		return value
+	}
+	w := newJSONRewriter(k, pol, []byte(value), flag, al)
+	w.root = path
+	w.location = location
+	out, _ := w.rewrite()
+	return string(out)
+}
+
+// rewriteJSON sanitizes a valid JSON document and reports whether anything
+// changed. When nothing did, the returned bytes are src itself.
+func rewriteJSON(k *koanf.Koanf, pol *requestPolicy, src []byte, flag *blockFlag, al *auditLog) ([]byte, bool) {
+	return newJSONRewriter(k, pol, src, flag, al).rewrite()
+}
+
+func (w *jsonRewriter) rewrite() ([]byte, bool) {
+	w.out.Grow(len(w.src))
+	w.copyWS()
+	w.value(w.root)
+	w.copyWS()
+	if !w.changed {
+		return w.src, false
+	}
+	return w.out.Bytes(), true
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// skipWS advances over whitespace and returns it.
+func (w *jsonRewriter) skipWS() []byte {
+	start := w.pos
+	for w.pos < len(w.src) && isJSONSpace(w.src[w.pos]) {
+		w.pos++
+	}
+	return w.src[start:w.pos]
+}
+
+func (w *jsonRewriter) copyWS() {
+	w.out.Write(w.skipWS())
+}
+
+// scanString returns the raw literal (quotes included) of the string at pos.
+func (w *jsonRewriter) scanString() []byte {
+	start := w.pos
+	w.pos++ // opening quote
+	for w.pos < len(w.src) {
+		switch w.src[w.pos] {
+		case '\\':
+			w.pos += 2
+			continue
+		case '"':
+			w.pos++
+			return w.src[start:w.pos]
+		}
+		w.pos++
+	}
+	return w.src[start:w.pos]
+}
+
+// skipValue advances over the value at pos without emitting anything.
+func (w *jsonRewriter) skipValue() {
+	switch w.src[w.pos] {
+	case '"':
+		w.scanString()
+	case '{', '[':
+		depth := 0
+		for w.pos < len(w.src) {
+			switch w.src[w.pos] {
+			case '"':
+				w.scanString()
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			w.pos++
+			if depth == 0 {
+				return
+			}
+		}
+	default:
+		for w.pos < len(w.src) && !isJSONSpace(w.src[w.pos]) &&
+			w.src[w.pos] != ',' && w.src[w.pos] != '}' && w.src[w.pos] != ']' {
+			w.pos++
+		}
+	}
+}
+
+// isContainerAt reports whether the value at pos is an object or array.
+func (w *jsonRewriter) isContainerAt() bool {
+	return w.src[w.pos] == '{' || w.src[w.pos] == '['
+}
+
+// value emits the value at pos, sanitizing strings found at path.
+func (w *jsonRewriter) value(path jsonPath) {
+	switch w.src[w.pos] {
+	case '{':
+		w.object(path)
+	case '[':
+		w.array(path)
+	case '"':
+		raw := w.scanString()
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			w.out.Write(raw)
+			return
+		}
+		sanitized := w.sanitize(path, s)
+		if sanitized == s {
+			w.out.Write(raw)
+			return
+		}
+		w.changed = true
+		w.out.Write(encodeJSONString(sanitized))
+	default:
+		start := w.pos
+		w.skipValue()
+		w.out.Write(w.src[start:w.pos])
+	}
+}
+
+// members walks the members of an object or the items of an array, emitting
+// the kept ones. member is called with pos at each member and reports whether
+// to keep it; it must emit (if kept) or skip (if dropped) exactly that member.
+// Separators are preserved, except that a comma left dangling by a dropped
+// member is removed.
+func (w *jsonRewriter) members(close byte, member func() bool) {
+	w.out.WriteByte(w.src[w.pos])
+	w.pos++
+	wroteAny := false
+	for {
+		gapStart := w.pos
+		w.skipWS()
+		if w.src[w.pos] == close {
+			w.out.Write(w.src[gapStart:w.pos])
+			w.out.WriteByte(close)
+			w.pos++
+			return
+		}
+		if w.src[w.pos] == ',' {
+			w.pos++
+			w.skipWS()
+		}
+		gap := w.src[gapStart:w.pos]
+		mark := w.out.Len()
+		if wroteAny {
+			w.out.Write(gap)
+		} else {
+			w.out.Write(bytes.Replace(gap, []byte(","), nil, 1))
+		}
+		if member() {
+			wroteAny = true
+		} else {
+			w.out.Truncate(mark)
+			w.changed = true
+		}
+	}
+}
+
+func (w *jsonRewriter) object(path jsonPath) {
+	w.members('}', func() bool {
+		rawKey := w.scanString()
+		var field string
+		json.Unmarshal(rawKey, &field)
+		key, keep := w.checkKey(path, field)
+		if key != field {
+			rawKey, field = encodeJSONString(key), key
+			w.changed = true
+		}
+		childPath := path.key(field)
+		w.pol.see(field)
+		w.pol.see(childPath.paramName())
+
+		colonStart := w.pos
+		w.skipWS()
+		w.pos++ // ':'
+		w.skipWS()
+		sep := w.src[colonStart:w.pos]
+
+		if keep && w.isContainerAt() {
+			keep = w.checkScalar(childPath)
+		}
+		if !keep {
+			w.skipValue()
+			return false
+		}
+		if w.strict && !w.isContainerAt() && dropUnknownBodyField(w.k, w.pol, childPath, w.flag, w.al) {
+			w.skipValue()
+			return false
+		}
+		w.out.Write(rawKey)
+		w.out.Write(sep)
+		w.value(childPath)
+		return true
+	})
+}
+
+func (w *jsonRewriter) array(path jsonPath) {
+	i := 0
+	w.members(']', func() bool {
+		itemPath := path.index(i)
+		i++
+		if w.strict && !w.isContainerAt() && dropUnknownBodyField(w.k, w.pol, itemPath, w.flag, w.al) {
+			w.skipValue()
+			return false
+		}
+		w.value(itemPath)
+		return true
+	})
+}
+
+// encodeJSONString encodes s as a JSON string literal without the HTML
+// escaping json.Marshal applies to <, > and &.
+func encodeJSONString(s string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return []byte(strconv.Quote(s))
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
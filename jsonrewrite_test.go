@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRewriteJSON(t *testing.T) {
+	const rules = `
+form_params:
+  bio:
+    type: text
+    strip_html: true
+  id:
+    type: numeric
+  meta:
+    type: json
+  name:
+    type: text
+`
+	tests := []struct {
+		name, cfg, src, want string
+		events               []string
+	}{
+		{"untouched", rules,
+			"{\"z\": 1, \"a\":[1.10, 12345678901234567890, -0e5],\n \"s\": \"\\u00e9\\/\"}",
+			"{\"z\": 1, \"a\":[1.10, 12345678901234567890, -0e5],\n \"s\": \"\\u00e9\\/\"}", nil},
+		{"only changed string re-encoded", rules,
+			`{"n": 1.50, "bio": "<b>hi</b> & é", "s": "é"}`,
+			`{"n": 1.50, "bio": "hi & é", "s": "é"}`, []string{"form_params:$.bio"}},
+		{"nested", rules,
+			`{"users": [{"bio": "<i>x</i>"}, {"bio": "y"}]}`,
+			`{"users": [{"bio": "x"}, {"bio": "y"}]}`, []string{"form_params:$.users[0].bio"}},
+		{"embedded json", rules,
+			`{"meta": "{\"bio\": \"<b>x</b>\", \"n\": 1.0}"}`,
+			`{"meta": "{\"bio\": \"x\", \"n\": 1.0}"}`, []string{"form_params:$.meta.bio"}},
+		{"scalar root", rules, ` "text" `, ` "text" `, nil},
+		{"strict drops first", rules + "strict_params: true\n",
+			`{"x": 1, "name": "a", "y": [2]}`, `{ "name": "a", "y": []}`,
+			[]string{"unknown_param:$.x", "unknown_param:$.y[0]"}},
+		{"strict drops last", rules + "strict_params: true\n",
+			`{"name": "a" , "x": {"id": "1"}, "q": "b"}`, `{"name": "a" , "x": {"id": "1"}}`,
+			[]string{"unknown_param:$.q"}},
+		{"strict drops all", rules + "strict_params: true\n",
+			`[ "a", "b" ]`, `[ ]`,
+			[]string{"unknown_param:$[0]", "unknown_param:$[1]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, tt.cfg)
+			flag, al := &blockFlag{}, &auditLog{}
+			out, changed := rewriteJSON(c, &requestPolicy{}, []byte(tt.src), flag, al)
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+			if changed != (tt.src != tt.want) {
+				t.Errorf("changed %v", changed)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestEncodeJSONString(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"plain", `"plain"`},
+		{"<a&b>", `"<a&b>"`},
+		{"q\"\\\n", `"q\"\\\n"`},
+		{"\u2028", `"\u2028"`},
+		{"\x01", `"\u0001"`},
+	}
+	for _, tt := range tests {
+		if got := string(encodeJSONString(tt.s)); got != tt.want {
+			t.Errorf("encodeJSONString(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
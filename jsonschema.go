@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/file"
+)
+
+// schemaError is a single JSON Schema validation failure.
+type schemaError struct {
+	path    string // JSONPath of the offending instance value
+	keyword string
+	msg     string
+}
+
+// jsonSchemas caches parsed schema documents by file name.
+var jsonSchemas sync.Map
+
+// loadJSONSchema returns the parsed schema in file name, loading and watching it
+// on first use.
+func loadJSONSchema(name string) (interface{}, error) {
+	return loadWatchedFile(&jsonSchemas, name, "json_schema", decodeJSONNumbers)
+}
+
+// loadWatchedFile returns the parsed contents of file name from cache. The first
+// load parses the file and starts watching it, so later changes on disk are
+// re-parsed and swapped in like the main config; if a changed file fails to
+// parse the previous version stays in use. label prefixes log messages.
+func loadWatchedFile(cache *sync.Map, name, label string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	if v, ok := cache.Load(name); ok {
+		return v, nil
+	}
+	fp := file.Provider(name)
+	read := func() (interface{}, error) {
+		b, err := fp.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		return parse(b)
+	}
+	v, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if _, loaded := cache.LoadOrStore(name, v); !loaded {
+		err := fp.Watch(func(event interface{}, err error) {
+			if err != nil {
+				log.Printf("%s: watch error on %s: %v", label, name, err)
+				return
+			}
+			log.Printf("%s: change detected in %s. Reloading ...", label, name)
+			v, err := read()
+			if err != nil {
+				log.Printf("%s: keeping previous %s: %v", label, name, err)
+				return
+			}
+			cache.Store(name, v)
+		})
+		if err != nil {
+			log.Printf("%s: cannot watch %s: %v", label, name, err)
+		}
+	}
+	return v, nil
+}
+
+// decodeJSONNumbers decodes a JSON document keeping numbers as json.Number.
+func decodeJSONNumbers(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// validatingJSONSchema validates the (already sanitized) request body against
+// the json_schema entries of the matched route. An entry applies when the
+// request method is in its methods list (default POST, PUT, PATCH). In mode
+// reject (default) any error rejects the request; in mode audit errors are only
+// recorded. Each error becomes a json_schema audit event named by its JSONPath.
+func validatingJSONSchema(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
+	pol := policyFrom(req)
+	if pol.route == nil || !pol.route.Exists("json_schema") {
+		return
+	}
+	var entry *koanf.Koanf
+	for _, e := range pol.route.Slices("json_schema") {
+		methods := []string{"POST", "PUT", "PATCH"}
+		if e.Exists("methods") {
+			methods = e.Strings("methods")
+		}
+		for _, m := range methods {
+			if strings.EqualFold(m, req.Method) {
+				entry = e
+				break
+			}
+		}
+		if entry != nil {
+			break
+		}
+	}
+	if entry == nil {
+		return
+	}
+
+	name := entry.String("file")
+	schema, err := loadJSONSchema(name)
+	if err != nil {
+		log.Printf("json_schema: cannot load %s: %v; rejecting request", name, err)
+		if flag != nil {
+			flag.reject(fmt.Sprintf("json_schema %s unavailable", name))
+		}
+		return
+	}
+
+	body, _ := readBody(req)
+	var errs []schemaError
+	if instance, err := decodeJSONNumbers(body); err != nil {
+		errs = []schemaError{{path: "$", keyword: "type", msg: "body is empty or not valid JSON"}}
+	} else {
+		v := &schemaValidator{root: schema}
+		v.validate(schema, instance, nil)
+		errs = v.errs
+	}
+	if len(errs) == 0 {
+		return
+	}
+
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	reject := entry.String("mode") != "audit"
+	for _, e := range errs {
+		log.Printf("json_schema %s: %s: %s", name, e.path, e.msg)
+		if al != nil {
+			al.add("json_schema", e.path, "body")
+		}
+	}
+	if reject && flag != nil {
+		flag.reject(fmt.Sprintf("body violated json_schema %s at %s: %s", name, errs[0].path, errs[0].msg))
+	}
+}
+
+// schemaValidator implements the subset of JSON Schema draft 2020-12 used for
+// request validation: type, enum, const, required, properties,
+// additionalProperties, items, min/maxItems, min/maxLength, pattern,
+// minimum/maximum, exclusiveMinimum/exclusiveMaximum, allOf/anyOf/oneOf/not
+// and local $ref ("#/$defs/...").
+type schemaValidator struct {
+	root interface{}
+	errs []schemaError
+	// refs counts the $ref hops followed at the instance path of length
+	// refDepth without descending into the instance; a chain longer than
+	// maxSchemaRefHops is a reference cycle such as {"$ref": "#"}.
+	refs     int
+	refDepth int
+}
+
+// maxSchemaRefHops bounds chains of $ref that do not descend into the
+// instance, as resolveOpenAPIRef does for OpenAPI documents.
+const maxSchemaRefHops = 16
+
+func (v *schemaValidator) fail(path jsonPath, keyword, format string, args ...interface{}) {
+	v.errs = append(v.errs, schemaError{path: path.String(), keyword: keyword, msg: fmt.Sprintf(format, args...)})
+}
+
+// valid reports whether instance satisfies schema without recording errors.
+// A $ref that cannot be followed is an error in the schema, not a mismatch,
+// so it is recorded even under not.
+func (v *schemaValidator) valid(schema, instance interface{}, path jsonPath) bool {
+	sub := &schemaValidator{root: v.root, refs: v.refs, refDepth: v.refDepth}
+	sub.validate(schema, instance, path)
+	for _, e := range sub.errs {
+		if e.keyword == "$ref" {
+			v.errs = append(v.errs, e)
+		}
+	}
+	return len(sub.errs) == 0
+}
+
+func (v *schemaValidator) validate(schema, instance interface{}, path jsonPath) {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			v.fail(path, "false", "no value is allowed here")
+		}
+		return
+	case map[string]interface{}:
+		v.validateObject(s, instance, path)
+	}
+}
+
+func (v *schemaValidator) validateObject(s map[string]interface{}, instance interface{}, path jsonPath) {
+	if ref, ok := s["$ref"].(string); ok {
+		refs, refDepth := v.refs, v.refDepth
+		if refDepth != len(path) {
+			v.refs, v.refDepth = 0, len(path)
+		}
+		v.refs++
+		target, err := resolveSchemaRef(v.root, ref)
+		switch {
+		case v.refs > maxSchemaRefHops:
+			v.fail(path, "$ref", "more than %d $ref hops without reaching a value: reference cycle at %q", maxSchemaRefHops, ref)
+		case err != nil:
+			v.fail(path, "$ref", "%v", err)
+		default:
+			v.validate(target, instance, path)
+		}
+		v.refs, v.refDepth = refs, refDepth
+	}
+
+	if t, ok := s["type"]; ok && !schemaTypeMatches(t, instance) {
+		v.fail(path, "type", "expected %v, got %s", t, jsonTypeOf(instance))
+		return
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, instance) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "enum", "value is not one of the allowed values")
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, instance) {
+		v.fail(path, "const", "value does not equal the constant")
+	}
+
+	for _, kw := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, ok := s[kw].([]interface{})
+		if !ok {
+			continue
+		}
+		n := 0
+		for _, sub := range subs {
+			if kw == "allOf" {
+				v.validate(sub, instance, path)
+			} else if v.valid(sub, instance, path) {
+				n++
+			}
+		}
+		if kw == "anyOf" && n == 0 {
+			v.fail(path, kw, "value matches none of the anyOf schemas")
+		}
+		if kw == "oneOf" && n != 1 {
+			v.fail(path, kw, "value matches %d of the oneOf schemas, expected exactly 1", n)
+		}
+	}
+	if not, ok := s["not"]; ok && v.valid(not, instance, path) {
+		v.fail(path, "not", "value matches a schema it must not match")
+	}
+
+	switch val := instance.(type) {
+	case map[string]interface{}:
+		v.validateProperties(s, val, path)
+	case []interface{}:
+		if n, ok := schemaInt(s["minItems"]); ok && len(val) < n {
+			v.fail(path, "minItems", "array has %d items, minimum is %d", len(val), n)
+		}
+		if n, ok := schemaInt(s["maxItems"]); ok && len(val) > n {
+			v.fail(path, "maxItems", "array has %d items, maximum is %d", len(val), n)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range val {
+				v.validate(items, item, path.index(i))
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(val)
+		if n, ok := schemaInt(s["minLength"]); ok && length < n {
+			v.fail(path, "minLength", "string shorter than %d characters", n)
+		}
+		if n, ok := schemaInt(s["maxLength"]); ok && length > n {
+			v.fail(path, "maxLength", "string longer than %d characters", n)
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			re, err := cachedRegexp(pattern)
+			if err != nil {
+				v.fail(path, "pattern", "invalid pattern in schema: %v", err)
+			} else if !re.MatchString(val) {
+				v.fail(path, "pattern", "string does not match pattern %s", pattern)
+			}
+		}
+	case json.Number:
+		v.validateNumber(s, val, path)
+	}
+}
+
+func (v *schemaValidator) validateProperties(s map[string]interface{}, obj map[string]interface{}, path jsonPath) {
+	if req, ok := s["required"].([]interface{}); ok {
+		for _, r := range req {
+			if name, ok := r.(string); ok {
+				if _, present := obj[name]; !present {
+					v.fail(path.key(name), "required", "required property is missing")
+				}
+			}
+		}
+	}
+	props, _ := s["properties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		val := obj[name]
+		if sub, ok := props[name]; ok {
+			v.validate(sub, val, path.key(name))
+		} else if hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				v.fail(path.key(name), "additionalProperties", "property is not allowed")
+			} else {
+				v.validate(additional, val, path.key(name))
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(s map[string]interface{}, n json.Number, path jsonPath) {
+	val, ok := new(big.Float).SetString(n.String())
+	if !ok {
+		return
+	}
+	limit := func(kw string) (*big.Float, bool) {
+		num, ok := s[kw].(json.Number)
+		if !ok {
+			return nil, false
+		}
+		f, ok := new(big.Float).SetString(num.String())
+		return f, ok
+	}
+	if m, ok := limit("minimum"); ok && val.Cmp(m) < 0 {
+		v.fail(path, "minimum", "value is less than %s", m.String())
+	}
+	if m, ok := limit("maximum"); ok && val.Cmp(m) > 0 {
+		v.fail(path, "maximum", "value is greater than %s", m.String())
+	}
+	if m, ok := limit("exclusiveMinimum"); ok && val.Cmp(m) <= 0 {
+		v.fail(path, "exclusiveMinimum", "value must be greater than %s", m.String())
+	}
+	if m, ok := limit("exclusiveMaximum"); ok && val.Cmp(m) >= 0 {
+		v.fail(path, "exclusiveMaximum", "value must be less than %s", m.String())
+	}
+}
+
+// resolveSchemaRef resolves a local JSON Pointer reference such as
+// "#/$defs/address" against the root schema.
+func resolveSchemaRef(root interface{}, ref string) (interface{}, error) {
+	if ref == "#" {
+		return root, nil
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("unsupported $ref %q: only local references are supported", ref)
+	}
+	cur := root
+	for _, tok := range strings.Split(ref[2:], "/") {
+		tok = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if cur, ok = m[tok]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return cur, nil
+}
+
+func schemaInt(v interface{}) (int, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return int(i), err == nil
+}
+
+// jsonTypeOf returns the JSON Schema type name of a decoded value.
+func jsonTypeOf(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case json.Number:
+		if f, ok := new(big.Float).SetString(val.String()); ok && f.IsInt() {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// schemaTypeMatches checks the type keyword, which may be a name or a list.
+func schemaTypeMatches(t interface{}, instance interface{}) bool {
+	actual := jsonTypeOf(instance)
+	match := func(name string) bool {
+		return name == actual || (name == "number" && actual == "integer")
+	}
+	switch tt := t.(type) {
+	case string:
+		return match(tt)
+	case []interface{}:
+		for _, x := range tt {
+			if name, ok := x.(string); ok && match(name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// jsonEqual compares decoded JSON values, treating numbers numerically.
+func jsonEqual(a, b interface{}) bool {
+	an, aok := a.(json.Number)
+	bn, bok := b.(json.Number)
+	if aok && bok {
+		af, ok1 := new(big.Float).SetString(an.String())
+		bf, ok2 := new(big.Float).SetString(bn.String())
+		return ok1 && ok2 && af.Cmp(bf) == 0
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, x := range av {
+			if y, ok := bv[key]; !ok || !jsonEqual(x, y) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !jsonEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+// schemaErrors validates the JSON document instance against the JSON schema
+// and returns the keywords that failed.
+func schemaErrors(t *testing.T, schema, instance string) []string {
+	t.Helper()
+	s, err := decodeJSONNumbers([]byte(schema))
+	if err != nil {
+		t.Fatalf("schema %s: %v", schema, err)
+	}
+	i, err := decodeJSONNumbers([]byte(instance))
+	if err != nil {
+		t.Fatalf("instance %s: %v", instance, err)
+	}
+	v := &schemaValidator{root: s}
+	v.validate(s, i, nil)
+	var keywords []string
+	for _, e := range v.errs {
+		keywords = append(keywords, e.keyword)
+	}
+	return keywords
+}
+
+func TestSchemaValidator(t *testing.T) {
+	const user = `{
+		"type": "object",
+		"required": ["email"],
+		"additionalProperties": false,
+		"properties": {
+			"email": {"type": "string", "maxLength": 20},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2}
+		}
+	}`
+	tree := `{
+		"$defs": {"node": {"type": "object", "properties": {"child": {"$ref": "#/$defs/node"}}}},
+		"$ref": "#/$defs/node"
+	}`
+	tests := []struct {
+		name, schema, instance string
+		want                   []string
+	}{
+		{"valid", user, `{"email": "a@example.com", "age": 3, "tags": ["a"]}`, nil},
+		{"missing required", user, `{"age": 3}`, []string{"required"}},
+		{"wrong type", user, `{"email": 1}`, []string{"type"}},
+		{"too long", user, `{"email": "aaaaaaaaaaaaaaaaaaaaaaaaa"}`, []string{"maxLength"}},
+		{"negative", user, `{"email": "a", "age": -1}`, []string{"minimum"}},
+		{"not an integer", user, `{"email": "a", "age": 1.5}`, []string{"type"}},
+		{"extra property", user, `{"email": "a", "admin": true}`, []string{"additionalProperties"}},
+		{"enum", user, `{"email": "a", "tags": ["c"]}`, []string{"enum"}},
+		{"too many items", user, `{"email": "a", "tags": ["a", "b", "a"]}`, []string{"maxItems"}},
+		{"recursive", tree, `{"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {"child": {}}}}}}}}}}}}}}}}}}}`, nil},
+		{"recursive invalid", tree, `{"child": {"child": 1}}`, []string{"type"}},
+		{"unresolvable", `{"$ref": "#/$defs/missing"}`, `1`, []string{"$ref"}},
+		{"remote", `{"$ref": "https://example.com/schema.json"}`, `1`, []string{"$ref"}},
+		{"self", `{"$ref": "#"}`, `{}`, []string{"$ref"}},
+		{"self in defs", `{"$defs": {"a": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`, `{}`, []string{"$ref"}},
+		{"mutual", `{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`, `{}`, []string{"$ref"}},
+		{"through anyOf", `{"anyOf": [{"$ref": "#"}]}`, `{}`, []string{"$ref", "anyOf"}},
+		{"through not", `{"not": {"$ref": "#"}}`, `{}`, []string{"$ref"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := schemaErrors(t, tt.schema, tt.instance)
+			if len(got) != len(tt.want) {
+				t.Fatalf("errors %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("errors %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ldapiPatterns are the pattern IDs detectLDAPi reports and their confidence.
+var ldapiPatterns = map[string]int{
+	"ldapi-breakout":   95, // *)(uid=*))(|(uid=*: closes the filter and opens another
+	"ldapi-operator":   85, // (|, (&, (! starting a nested filter
+	"ldapi-assertion":  80, // (objectClass=*), an attribute assertion in parentheses
+	"ldapi-null":       80, // NUL or \00, truncating the filter
+	"ldapi-dn":         75, // cn=admin,dc=example: a DN injected into a DN
+	"ldapi-wildcard":   70, // a value that is only wildcards
+	"ldapi-unbalanced": 50, // more closing than opening parentheses
+}
+
+var (
+	ldapAssertion = regexp.MustCompile(`\(\s*[a-zA-Z][a-zA-Z0-9;.-]*\s*[~<>:]?=`)
+	ldapBreakout  = regexp.MustCompile(`\)\s*\(\s*(?:[|&!]|[a-zA-Z][a-zA-Z0-9;.-]*\s*[~<>:]?=)`)
+	ldapDN        = regexp.MustCompile(`(?i)\b(?:cn|ou|dc|uid|o|c|l|st|sn|mail|objectclass)\s*=[^,]*,\s*(?:cn|ou|dc|uid|o|c|l|st)\s*=`)
+)
+
+// detectLDAPi reports LDAP injection: a value that, placed in a search filter
+// such as (uid=VALUE) or in a DN, changes its structure. Parentheses,
+// operators and attribute assertions are what a filter is built from; a lone
+// unbalanced ")" scores below the default min_confidence, as it also ends
+// ordinary parenthetical text.
+func detectLDAPi(value string) (detection, bool) {
+	found := make(map[string]bool)
+	if ldapBreakout.MatchString(value) {
+		found["ldapi-breakout"] = true
+	}
+	if strings.Contains(value, "(|") || strings.Contains(value, "(&") || strings.Contains(value, "(!") {
+		found["ldapi-operator"] = true
+	}
+	if ldapAssertion.MatchString(value) {
+		found["ldapi-assertion"] = true
+	}
+	if strings.IndexByte(value, 0) >= 0 || strings.Contains(value, `\00`) {
+		found["ldapi-null"] = true
+	}
+	if ldapDN.MatchString(value) {
+		found["ldapi-dn"] = true
+	}
+	if strings.Trim(value, "* ") == "" {
+		found["ldapi-wildcard"] = true
+	}
+	if strings.Count(value, ")") > strings.Count(value, "(") {
+		found["ldapi-unbalanced"] = true
+	}
+	return patternDetection(found, ldapiPatterns)
+}
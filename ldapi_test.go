@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestDetectLDAPi(t *testing.T) {
+	runDetectorCases(t, detectLDAPi, []detectorCase{
+		{"*)(uid=*))(|(uid=*", "ldapi-breakout,ldapi-operator,ldapi-assertion", 95},
+		{"admin)(&)", "ldapi-breakout,ldapi-operator,ldapi-unbalanced", 95},
+		{"(objectClass=*)", "ldapi-assertion", 80},
+		{"admin\x00", "ldapi-null", 80},
+		{`admin\00`, "ldapi-null", 80},
+		{"cn=admin,dc=example,dc=com", "ldapi-dn", 75},
+		{"*", "ldapi-wildcard", 70},
+		{"john)", "ldapi-unbalanced", 50},
+		{"John Smith", "", 0},
+		{"smith*", "", 0},
+		{"Smith (née Jones)", "", 0},
+	})
+}
@@ -4,19 +4,25 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	valid "github.com/asaskevich/govalidator"
@@ -39,16 +45,28 @@ type auditKey struct{}
 type auditEvent struct {
 	Rule     string `json:"rule"`
 	Field    string `json:"field,omitempty"`
-	Location string `json:"location"` // "query", "post", "body", "header", "ip"
+	Location string `json:"location"` // "query", "post", "body", "header", "ip", "method", "request"
+	// OperationID is the operationId of the OpenAPI operation the request matched.
+	OperationID string `json:"operation_id,omitempty"`
+	// Fingerprint and Confidence describe an injection detector finding.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Confidence  int    `json:"confidence,omitempty"`
 }
 
 // auditLog accumulates sanitization events during a single request.
 type auditLog struct {
-	events []auditEvent
+	events      []auditEvent
+	operationID string // stamped on every event; set when an OpenAPI operation matched
 }
 
 func (a *auditLog) add(rule, field, location string) {
-	a.events = append(a.events, auditEvent{Rule: rule, Field: field, Location: location})
+	a.events = append(a.events, auditEvent{Rule: rule, Field: field, Location: location, OperationID: a.operationID})
+}
+
+// addDetection records a detector finding.
+func (a *auditLog) addDetection(rule, field, location string, d detection) {
+	a.events = append(a.events, auditEvent{Rule: rule, Field: field, Location: location, OperationID: a.operationID,
+		Fingerprint: d.fingerprint, Confidence: d.confidence})
 }
 
 // auditWriter wraps http.ResponseWriter to capture the response status code so it
@@ -80,36 +98,96 @@ func (w *auditWriter) Flush() {
 type blockKey struct{}
 
 // blockFlag accumulates violation signals from sanitizing functions.
-// A non-nil, triggered flag causes blockingTransport to return a 403 instead of
+// A triggered flag causes blockingTransport to return a 403 instead of
 // forwarding the request to the upstream.
 type blockFlag struct {
+	enabled   bool // block_on_detect: sanitizer hits block instead of being forwarded
 	triggered bool
 	reason    string
 }
 
+// trigger blocks the request if block_on_detect is enabled.
 func (f *blockFlag) trigger(reason string) {
+	if f.enabled {
+		f.reject(reason)
+	}
+}
+
+// reject blocks the request regardless of block_on_detect. Used for policy
+// violations that cannot be repaired by sanitizing, such as missing required params.
+func (f *blockFlag) reject(reason string) {
 	if !f.triggered {
 		f.triggered = true
 		f.reason = reason
 	}
 }
 
+// policyKey is the context key for the per-request requestPolicy.
+type policyKey struct{}
+
+// requestPolicy carries the route matched for a request and the parameter names
+// seen while sanitizing it, so checks spanning query and body (required params)
+// can run once all sanitizers are done.
+type requestPolicy struct {
+	route      *koanf.Koanf      // nil when no routes entry matched
+	op         *openAPIOperation // nil when openapi is off or no declared operation matched
+	pathParams map[string]string // path template parameters of op
+	soap       *soapRequest      // nil unless the route has a soap section
+	seen       map[string]bool
+	bodyParsed bool // a body sanitizer walked the body's parameters
+}
+
+// ruleSources returns the configs consulted for rules, most specific first: the
+// SOAP operation, the matched route, then the global config.
+func (p *requestPolicy) ruleSources(k *koanf.Koanf) []*koanf.Koanf {
+	var sources []*koanf.Koanf
+	if p.soap != nil && p.soap.op != nil {
+		sources = append(sources, p.soap.op)
+	}
+	if p.route != nil {
+		sources = append(sources, p.route)
+	}
+	return append(sources, k)
+}
+
+func (p *requestPolicy) see(name string) {
+	if p.seen == nil {
+		p.seen = make(map[string]bool)
+	}
+	p.seen[name] = true
+}
+
+// policyFrom returns the requestPolicy stored in the request context, or an
+// empty one so callers never have to nil-check.
+func policyFrom(req *http.Request) *requestPolicy {
+	if pol, ok := req.Context().Value(policyKey{}).(*requestPolicy); ok {
+		return pol
+	}
+	return &requestPolicy{}
+}
+
 // blockingTransport wraps the default RoundTripper. When a blockFlag in the
 // request context has been triggered it returns a synthetic 403 response without
-// ever contacting the upstream server.
+// ever contacting the upstream server. Requests to SOAP routes get a SOAP fault
+// instead.
 type blockingTransport struct{ base http.RoundTripper }
 
 func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if flag, ok := req.Context().Value(blockKey{}).(*blockFlag); ok && flag.triggered {
 		log.Printf("BLOCK: %s %s%s — %s", req.Method, req.Host, req.URL.RequestURI(), flag.reason)
-		body := "Forbidden\n"
+		status, contentType, body := http.StatusForbidden, "text/plain; charset=utf-8", "Forbidden\n"
+		if sr := policyFrom(req).soap; sr != nil {
+			status, contentType, body = soapFault(sr.version)
+		}
+		header := make(http.Header)
+		header.Set("Content-Type", contentType)
 		return &http.Response{
-			StatusCode:    http.StatusForbidden,
-			Status:        "403 Forbidden",
+			StatusCode:    status,
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
 			Proto:         "HTTP/1.1",
 			ProtoMajor:    1,
 			ProtoMinor:    1,
-			Header:        make(http.Header),
+			Header:        header,
 			Body:          ioutil.NopCloser(strings.NewReader(body)),
 			ContentLength: int64(len(body)),
 			Request:       req,
@@ -210,6 +288,9 @@ func main() {
 	}
 
 	router := httprouter.New()
+	// OPTIONS and 405 handling is done by the method policy in handle, so
+	// preflights reach the upstream and rejections carry our own Allow header.
+	router.HandleOPTIONS = false
 	origin, _ := url.Parse(upstreamURL)
 	path := "/*catchall"
 
@@ -224,19 +305,30 @@ func main() {
 		// Call default director first: strips hop-by-hop headers, sets X-Forwarded-For, sets URL scheme/host
 		defaultDirector(req)
 
-		// Extract block flag injected by the route handler (nil when block_on_detect is off).
+		// Extract block flag injected by the route handler.
 		flag, _ := req.Context().Value(blockKey{}).(*blockFlag)
 
-		switch m := req.Method; m {
-		case "POST", "PUT", "PATCH":
+		switch m := req.Method; {
+		case isStreamedBody(req):
+			// request_body.stream types are forwarded as they arrive.
+			sanitizingGET(req, k, flag)
+		case m == "POST" || m == "PUT" || m == "PATCH":
+			decompressingBody(req, k, flag)
+			sanitizingGraphQL(req, k, flag)
 			sanitizingGET(req, k, flag)
 			sanitizingJSONBody(req, k, flag)
+			validatingJSONSchema(req, k, flag)
+			identifyingSOAP(req, k, flag)
 			sanitizingXMLBody(req, k, flag)
 			sanitizingPOST(req, k, flag)
 		default:
+			sanitizingGraphQL(req, k, flag)
 			sanitizingGET(req, k, flag)
 		}
 
+		checkRequiredParams(req, k, flag)
+		validatingOpenAPI(req, k, flag)
+
 		sanitizingIncomingCookies(req, k)
 		req.Header.Add("X-Forwarded-Host", req.Host)
 		req.Header.Add("X-Origin-Host", origin.Host)
@@ -264,20 +356,28 @@ func main() {
 			log.Printf("from: %s %s %s%s duration: %s\n", r.RemoteAddr, r.Method, r.Host, r.RequestURI, time.Since(startTime))
 			return
 		}
-		if maxBodyBytes := int64(k.Int("server.maxBodyBytes")); maxBodyBytes > 0 && r.Body != nil {
-			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
-			if err != nil {
+		route := matchRoute(k, r.URL.Path)
+		if ok, allow := checkMethod(r, k, route); !ok {
+			rejectMethod(aw, r, allow, startTime)
+			return
+		}
+		body, err := bufferRequestBody(w, r, k, route)
+		if err != nil {
+			al := &auditLog{}
+			if errors.Is(err, errBodyTooLarge) {
 				log.Printf("REQUEST TOO LARGE: %s %s %s%s", r.RemoteAddr, r.Method, r.Host, r.RequestURI)
 				http.Error(aw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
-				al := &auditLog{}
 				al.add("max_body_bytes", "", "body")
-				writeAuditLog(r, aw.status, time.Since(startTime), al, false, false)
-				log.Printf("from: %s %s %s%s duration: %s\n", r.RemoteAddr, r.Method, r.Host, r.RequestURI, time.Since(startTime))
-				return
+			} else {
+				log.Printf("BODY READ ERROR: %s %s %s%s: %v", r.RemoteAddr, r.Method, r.Host, r.RequestURI, err)
+				http.Error(aw, "Bad Request", http.StatusBadRequest)
+				al.add("request_body", "", "body")
 			}
-			r.Body = ioutil.NopCloser(bytes.NewReader(body))
-			r.ContentLength = int64(len(body))
+			writeAuditLog(r, aw.status, time.Since(startTime), al, false, false)
+			log.Printf("from: %s %s %s%s duration: %s\n", r.RemoteAddr, r.Method, r.Host, r.RequestURI, time.Since(startTime))
+			return
 		}
+		defer body.close()
 
 		ctx := r.Context()
 		var al *auditLog
@@ -285,9 +385,16 @@ func main() {
 			al = &auditLog{}
 			ctx = context.WithValue(ctx, auditKey{}, al)
 		}
-		if k.Bool("block_on_detect") {
-			ctx = context.WithValue(ctx, blockKey{}, &blockFlag{})
+		ctx = context.WithValue(ctx, blockKey{}, &blockFlag{enabled: k.Bool("block_on_detect")})
+		ctx = context.WithValue(ctx, bodyKey{}, body)
+		pol := &requestPolicy{route: route}
+		if k.Exists("openapi") {
+			pol.op, pol.pathParams = matchOpenAPIOperation(k, r.Method, r.URL.EscapedPath())
+			if pol.op != nil && al != nil {
+				al.operationID = pol.op.id
+			}
 		}
+		ctx = context.WithValue(ctx, policyKey{}, pol)
 		r = r.WithContext(ctx)
 
 		reverseProxy.ServeHTTP(aw, r)
@@ -297,9 +404,17 @@ func main() {
 		log.Printf("from: %s %s %s%s duration: %s\n", r.RemoteAddr, r.Method, r.Host, r.RequestURI, time.Since(startTime))
 	}
 
-	for _, method := range []string{"HEAD", "GET", "POST", "PUT", "DELETE"} {
+	// httprouter dispatches on exact method names, so every verb the policy may
+	// allow has to be registered up front. Custom verbs added to the config after
+	// startup fall through to MethodNotAllowed until the next restart.
+	for _, method := range registeredMethods(k) {
 		router.Handle(method, path, handle)
 	}
+	router.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		_, allow := checkMethod(r, k, matchRoute(k, r.URL.Path))
+		rejectMethod(w, r, allow, startTime)
+	})
 
 	server := &http.Server{
 		Addr:           serverAddr,
@@ -437,6 +552,122 @@ func matchesCIDR(ip net.IP, entry string) bool {
 	return false
 }
 
+// defaultMethods is the allowed method set used when neither http_methods.allow
+// nor a matching route's methods list is configured.
+var defaultMethods = []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// methodOverrideHeaders are the de-facto headers some frameworks use to tunnel a
+// different verb through POST.
+var methodOverrideHeaders = []string{"X-HTTP-Method-Override", "X-HTTP-Method", "X-Method-Override"}
+
+// registeredMethods returns every method name the router needs a handle for:
+// the standard verbs plus any custom verb mentioned in the method policy.
+func registeredMethods(k *koanf.Koanf) []string {
+	seen := make(map[string]bool)
+	var out []string
+	add := func(names []string) {
+		for _, m := range names {
+			m = strings.ToUpper(m)
+			if m != "" && !seen[m] {
+				seen[m] = true
+				out = append(out, m)
+			}
+		}
+	}
+	add(defaultMethods)
+	add([]string{"TRACE", "CONNECT"})
+	add(k.Strings("http_methods.allow"))
+	add(k.Strings("http_methods.deny"))
+	for _, route := range k.Slices("routes") {
+		add(route.Strings("methods"))
+	}
+	return out
+}
+
+// matchRoute returns the first entry of the routes list whose path matches
+// reqPath, or nil when none does. A path ending in "*" is a prefix match;
+// anything else must match exactly.
+func matchRoute(k *koanf.Koanf, reqPath string) *koanf.Koanf {
+	for _, route := range k.Slices("routes") {
+		p := route.String("path")
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(reqPath, strings.TrimSuffix(p, "*")) {
+				return route
+			}
+		} else if p == reqPath {
+			return route
+		}
+	}
+	return nil
+}
+
+// checkMethod applies the http_methods policy to the request and returns
+// whether it may proceed together with the list of methods allowed for its
+// path (used for the Allow header on 405). route is the request's matchRoute
+// result.
+//
+//   - A matching route's methods list replaces http_methods.allow.
+//   - http_methods.deny always wins, including over route methods.
+//   - X-HTTP-Method-Override and friends are stripped unless
+//     http_methods.method_override is "honour", in which case the overriding
+//     verb must itself pass the policy.
+func checkMethod(r *http.Request, k, route *koanf.Koanf) (bool, []string) {
+	allowed := defaultMethods
+	if k.Exists("http_methods.allow") {
+		allowed = k.Strings("http_methods.allow")
+	}
+	if route != nil && route.Exists("methods") {
+		allowed = route.Strings("methods")
+	}
+	denySet := make(map[string]bool)
+	for _, m := range k.Strings("http_methods.deny") {
+		denySet[strings.ToUpper(m)] = true
+	}
+	var allow []string
+	allowSet := make(map[string]bool)
+	for _, m := range allowed {
+		m = strings.ToUpper(m)
+		if !denySet[m] && !allowSet[m] {
+			allowSet[m] = true
+			allow = append(allow, m)
+		}
+	}
+
+	if !allowSet[r.Method] {
+		return false, allow
+	}
+
+	honour := k.String("http_methods.method_override") == "honour"
+	for _, name := range methodOverrideHeaders {
+		override := strings.ToUpper(strings.TrimSpace(r.Header.Get(name)))
+		if override == "" {
+			continue
+		}
+		if !honour {
+			r.Header.Del(name)
+			log.Println("remove header: ", name)
+			continue
+		}
+		if !allowSet[override] {
+			log.Printf("method override %q via %s not allowed", override, name)
+			return false, allow
+		}
+	}
+	return true, allow
+}
+
+// rejectMethod writes a 405 response listing the allowed methods and the
+// audit entry for a request received at startTime.
+func rejectMethod(w http.ResponseWriter, r *http.Request, allow []string, startTime time.Time) {
+	log.Printf("METHOD NOT ALLOWED: %s %s %s%s", r.RemoteAddr, r.Method, r.Host, r.RequestURI)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	al := &auditLog{}
+	al.add("http_methods", r.Method, "method")
+	writeAuditLog(r, http.StatusMethodNotAllowed, time.Since(startTime), al, false, false)
+	log.Printf("from: %s %s %s%s duration: %s\n", r.RemoteAddr, r.Method, r.Host, r.RequestURI, time.Since(startTime))
+}
+
 func sanitizingOutgoingHeaders(res *http.Response, k *koanf.Koanf) {
 
 	// Apply only/del first to filter upstream headers, then set proxy-injected
@@ -504,9 +735,29 @@ func sanitizingIncomingHeaders(req *http.Request, k *koanf.Koanf, flag *blockFla
 		// Fix #4: removed url.QueryUnescape — HTTP headers are not URL-encoded;
 		// unescaping caused invalid % sequences (e.g. "100% genuine") to wipe the header.
 		// Fix #6: iterate all values per header name instead of Get/Set (which truncates multi-value headers).
+		var trusted string
+		sr := policyFrom(req).soap
+		if sr != nil {
+			trusted = sr.actionHeader
+		}
 		for name, values := range req.Header {
+			if name == trusted && name != "Content-Type" {
+				// Already verified against the SOAP body.
+				continue
+			}
 			sanitized := make([]string, 0, len(values))
 			for _, value := range values {
+				raw := value
+				var action, quote string
+				if name == trusted {
+					// Only the SOAP 1.2 action parameter was verified.
+					value, action = cutActionParam(value)
+				} else if sr != nil && name == "Soapaction" && len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+					// SOAPAction is a quoted string; filter only its content.
+					value, quote = value[1:len(value)-1], `"`
+				}
+				rest := value
+				value = applyDetectors(k, p, name, value, "header", flag, al)
 				original := value
 				value = validateMaxLen(k, p, value)
 				value = validateStripChars(k, p, value)
@@ -522,7 +773,14 @@ func sanitizingIncomingHeaders(req *http.Request, k *koanf.Koanf, flag *blockFla
 						al.add("sanitize_http_headers", name, "header")
 					}
 				}
-				sanitized = append(sanitized, value)
+				if action != "" {
+					if value == rest {
+						value = raw
+					} else {
+						value += action
+					}
+				}
+				sanitized = append(sanitized, quote+value+quote)
 			}
 			req.Header[name] = sanitized
 		}
@@ -595,188 +853,403 @@ func sanitizingIncomingCookies(req *http.Request, k *koanf.Koanf) {
 }
 
 func sanitizingGET(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
-	al, _ := req.Context().Value(auditKey{}).(*auditLog)
-	data := url.Values{}
-	for name, values := range req.URL.Query() {
-		for _, value := range values {
-			p := "form_params." + name
-			if k.Exists(p) == false {
-				if k.Exists("form_params._defaults_") {
-					p = "form_params._defaults_"
-				}
-			}
-			if k.Exists(p) {
-				//log.Printf("get sanitizing: %v\n", name)
-				original := value
-				switch t := k.String(p + ".type"); t {
-				case "text":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripQuotation(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateStripHTML(k, p, value)
-					value = validateStripSQLia(k, p, value)
-				case "numeric":
-					value = validateNumeric(value)
-				case "email":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateEmail(value)
-				case "ip":
-					value = validateIP(value)
-				case "url":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateURL(value)
-				case "path":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validatePath(value)
-				case "filename":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateFilePath(value)
-				case "unixtime":
-					value = validateUnixTime(value)
-				case "absent":
-					value = ""
-				default:
-				}
-				if value != original {
-					if flag != nil {
-						flag.trigger(fmt.Sprintf("query param %q violated form_params policy", name))
-					}
-					if al != nil {
-						al.add("form_params", name, "query")
-					}
-				}
-			}
-			if k.Exists("sanitize_form_names") {
-				name = validateFormName(k, "sanitize_form_names", name)
-			}
-			data.Add(name, value)
-		}
+	if req.URL.RawQuery == "" {
+		return
 	}
-
-	req.URL.RawQuery = data.Encode()
+	pairs := parseFormPairs(req.URL.RawQuery)
+	sanitizeFormPairs(req, k, pairs, "query", nil, flag)
+	// Only changed pairs are re-encoded, so a clean query string is forwarded byte-identical.
+	req.URL.RawQuery = encodeFormPairs(pairs)
 }
 
 func sanitizingPOST(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
-	al, _ := req.Context().Value(auditKey{}).(*auditLog)
-	// Fix #2: only process application/x-www-form-urlencoded bodies.
-	// For any other Content-Type (multipart/form-data, application/json, etc.),
-	// ParseForm silently does nothing, then the original body would be forwarded unsanitized.
-	// If form_params rules are configured, discard non-urlencoded bodies entirely,
-	// unless a dedicated body sanitizer already handled this Content-Type.
+	// Fix #2: only process application/x-www-form-urlencoded and
+	// multipart/form-data bodies. For any other Content-Type (application/json,
+	// etc.), ParseForm silently does nothing, then the original body would be
+	// forwarded unsanitized. If form_params rules are configured, discard such
+	// bodies entirely, unless a dedicated body sanitizer already handled this
+	// Content-Type.
 	ct := strings.TrimSpace(req.Header.Get("Content-Type"))
+	if media, params, err := mime.ParseMediaType(ct); err == nil && media == "multipart/form-data" {
+		sanitizingMultipart(req, k, params["boundary"], flag)
+		return
+	}
 	if !strings.HasPrefix(ct, "application/x-www-form-urlencoded") {
 		if k.Exists("form_params") {
-			isJSON := strings.HasPrefix(ct, "application/json")
-			isXML := strings.HasPrefix(ct, "text/xml") || strings.HasPrefix(ct, "application/xml")
-			if (isJSON && k.Exists("sanitize_json_body")) || (isXML && k.Exists("sanitize_xml_body")) {
+			// A graphql route sanitizes JSON and application/graphql bodies
+			// itself, with or without sanitize_json_body; NDJSON is not a
+			// GraphQL transport.
+			graphql := graphqlConfig(policyFrom(req)) != nil
+			isJSON := isJSONContentType(ct) || (isNDJSONContentType(ct) && !graphql)
+			isXML := isXMLContentType(ct)
+			isGraphQL := graphql && (isJSONContentType(ct) || (strings.HasPrefix(ct, "application/graphql") && !strings.HasPrefix(ct, "application/graphql-response")))
+			if (isJSON && k.Exists("sanitize_json_body")) || (isXML && k.Exists("sanitize_xml_body")) || isGraphQL {
 				// Already sanitized by the dedicated handler above; leave body as-is.
 				return
 			}
 			log.Printf("sanitizingPOST: unsupported Content-Type %q; discarding body to enforce form_params rules", ct)
-			req.Body = ioutil.NopCloser(bytes.NewBuffer(nil))
-			req.ContentLength = 0
+			setBody(req, nil)
 		}
 		return
 	}
 
-	data := url.Values{}
-	req.ParseForm()
-	if len(req.PostForm) == 0 {
+	if req.Body == nil {
 		return
 	}
-	for name, values := range req.PostForm {
-		for _, value := range values {
-			p := "form_params." + name
-			if k.Exists(p) == false {
-				if k.Exists("form_params._defaults_") {
-					p = "form_params._defaults_"
-				}
+	body, err := readBody(req)
+	if err != nil {
+		log.Printf("sanitizingPOST: read error: %v; discarding body", err)
+		setBody(req, nil)
+		return
+	}
+	pairs := parseFormPairs(string(body))
+	sanitizeFormPairs(req, k, pairs, "post", queryParamNames(req), flag)
+	policyFrom(req).bodyParsed = true
+
+	newBody := encodeFormPairs(pairs)
+	setBody(req, []byte(newBody))
+}
+
+// queryParamNames returns the names present in the query string, for
+// resolving parameters that also appear in the body.
+func queryParamNames(req *http.Request) map[string]bool {
+	query := make(map[string]bool)
+	for _, fp := range parseFormPairs(req.URL.RawQuery) {
+		if !fp.drop {
+			query[fp.name] = true
+		}
+	}
+	return query
+}
+
+// formPair is one name=value segment of a query string or urlencoded body.
+// The raw segment is kept so that pairs no rule touched can be forwarded with
+// their original order and percent-encoding.
+type formPair struct {
+	raw      string
+	rawName  string
+	name     string
+	value    string
+	blank    bool // empty segment ("a=1&&b=2"); forwarded as-is
+	drop     bool
+	changed  bool // name (and possibly value) rewritten
+	nameKept bool // only the value was rewritten; the raw name is reused
+}
+
+// parseFormPairs splits an urlencoded string into its pairs in original order.
+// Segments that cannot be decoded are marked for dropping, matching what
+// url.ParseQuery would have done with them.
+func parseFormPairs(raw string) []*formPair {
+	var pairs []*formPair
+	if raw == "" {
+		return pairs
+	}
+	for _, seg := range strings.Split(raw, "&") {
+		fp := &formPair{raw: seg}
+		pairs = append(pairs, fp)
+		if seg == "" {
+			fp.blank = true
+			continue
+		}
+		rawName, rawValue := seg, ""
+		if i := strings.Index(seg, "="); i >= 0 {
+			rawName, rawValue = seg[:i], seg[i+1:]
+		}
+		name, err1 := url.QueryUnescape(rawName)
+		value, err2 := url.QueryUnescape(rawValue)
+		if err1 != nil || err2 != nil || strings.Contains(rawName, ";") {
+			log.Printf("dropping undecodable form segment %q", seg)
+			fp.drop = true
+			continue
+		}
+		fp.rawName, fp.name, fp.value = rawName, name, value
+	}
+	return pairs
+}
+
+// encodeFormPairs joins pairs back into an urlencoded string. Unchanged pairs
+// keep their raw form; changed ones are re-encoded; dropped ones are omitted.
+func encodeFormPairs(pairs []*formPair) string {
+	segs := make([]string, 0, len(pairs))
+	for _, fp := range pairs {
+		switch {
+		case fp.drop:
+		case fp.changed:
+			segs = append(segs, url.QueryEscape(fp.name)+"="+url.QueryEscape(fp.value))
+		case fp.nameKept:
+			segs = append(segs, fp.rawName+"="+url.QueryEscape(fp.value))
+		default:
+			segs = append(segs, fp.raw)
+		}
+	}
+	return strings.Join(segs, "&")
+}
+
+// sanitizeFormPairs applies strict_params, the multi/max_repeats policy, form_params
+// rules and sanitize_form_names to urlencoded pairs in place. location is
+// "query" or "post"; for "post", query holds the names present in the query
+// string so parameters appearing in both can be resolved to one value.
+func sanitizeFormPairs(req *http.Request, k *koanf.Koanf, pairs []*formPair, location string, query map[string]bool, flag *blockFlag) {
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	pol := policyFrom(req)
+	strict := strictParams(k, pol.route)
+	label := "query param"
+	if location == "post" {
+		label = "POST param"
+	}
+
+	// Group occurrences by name, in order of first appearance.
+	var names []string
+	groups := make(map[string][]*formPair)
+	graphql := location == "query" && req.Method == http.MethodGet && graphqlConfig(pol) != nil
+	for _, fp := range pairs {
+		if fp.blank || fp.drop {
+			continue
+		}
+		if graphql && graphqlParams[fp.name] {
+			// Inspected by sanitizingGraphQL.
+			continue
+		}
+		if _, ok := groups[fp.name]; !ok {
+			names = append(names, fp.name)
+		}
+		groups[fp.name] = append(groups[fp.name], fp)
+	}
+
+	for _, name := range names {
+		group := groups[name]
+		pol.see(name)
+		rk, p, known := paramRule(k, pol, name)
+		if strict && !known {
+			log.Printf("strict_params: dropping unknown %s %q", label, name)
+			rejectUnknownParam(k, pol.route, flag, fmt.Sprintf("%s %q is not listed in form_params", label, name))
+			if al != nil {
+				al.add("unknown_param", name, location)
 			}
-			if k.Exists(p) {
-				//log.Printf("post sanitizing: %v\n", name)
-				original := value
-				switch t := k.String(p + ".type"); t {
-				case "text":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripQuotation(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateStripHTML(k, p, value)
-					value = validateStripSQLia(k, p, value)
-				case "numeric":
-					value = validateNumeric(value)
-				case "email":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateEmail(value)
-				case "ip":
-					value = validateIP(value)
-				case "url":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateURL(value)
-				case "path":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validatePath(value)
-				case "filename":
-					value = validateMaxLen(k, p, value)
-					value = validateStripChars(k, p, value)
-					value = validateStripBinary(k, p, value)
-					value = validateFilePath(value)
-				case "unixtime":
-					value = validateUnixTime(value)
-				case "absent":
-					value = ""
-				default:
+			for _, fp := range group {
+				fp.drop = true
+			}
+			continue
+		}
+		keep := limitRepeats(rk, p, name, location, len(group), flag, al)
+		if query[name] && p != "" {
+			resolveQueryBodyRepeat(req, rk, p, name, keep, flag, al)
+		}
+		for i, fp := range group {
+			if !keep[i] {
+				fp.drop = true
+				continue
+			}
+			value := fp.value
+			canonical, ok := canonicalize(k, rk, p, name, value, location, flag, al)
+			if !ok {
+				value = canonical
+			} else if p != "" {
+				value = canonical
+				if rk.String(p+".type") == "json" {
+					// Violations inside the document are recorded by path.
+					value = sanitizeEmbeddedJSON(k, pol, jsonPath{name}, value, location, flag, al)
 				}
-				if value != original {
+				value = applyDetectors(rk, p, name, value, location, flag, al)
+				before := value
+				value = applyRule(rk, p, value)
+				if value != before {
 					if flag != nil {
-						flag.trigger(fmt.Sprintf("POST param %q violated form_params policy", name))
+						flag.trigger(fmt.Sprintf("%s %q violated %s policy", label, name, ruleName(p)))
 					}
 					if al != nil {
-						al.add("form_params", name, "post")
+						al.add(ruleName(p), name, location)
+					}
+					if invalidAction(rk, p, name, location, flag) {
+						fp.drop = true
+						continue
 					}
 				}
+				value = canonicalForward(k, fp.value, canonical, value)
 			}
+			newName := name
 			if k.Exists("sanitize_form_names") {
-				name = validateFormName(k, "sanitize_form_names", name)
+				newName = validateFormName(k, "sanitize_form_names", name)
+			}
+			switch {
+			case newName != fp.name:
+				fp.name, fp.value, fp.changed = newName, value, true
+			case value != fp.value:
+				fp.value, fp.nameKept = value, true
 			}
-			data.Add(name, value)
 		}
 	}
+}
+
+// paramRule resolves the form_params rule for a parameter name. Names may be
+// PHP/Rails-style bracket paths ("user[email]", "items[0][name]", "filter[]");
+// JSON and XML bodies use the same notation for nested fields. Lookup tiers, in
+// order of precedence:
+//
+//  1. an entry whose key equals the full name
+//  2. glob keys matched segment by segment ("user[*]", "items[*][qty]", "search_*");
+//     the one with the most literal segments wins
+//  3. regex keys written as "/pattern/", matched against the full name
+//  4. an entry whose key equals the leaf name ("email" for "user[email]"; array
+//     indexes are skipped, so "tags[0]" falls back to "tags")
+//  5. _defaults_
+//
+// Within each tier the form_params of a SOAP operation take precedence over a
+// matching route's, those over the global ones, and all of them over the rules
+// derived from the matched OpenAPI operation (see openAPIRule). It returns the koanf instance holding the rule
+// and the rule's key prefix (empty when no rule applies); known reports whether
+// a rule other than _defaults_ matched.
+func paramRule(k *koanf.Koanf, pol *requestPolicy, name string) (*koanf.Koanf, string, bool) {
+	route := pol.route
+	sources := pol.ruleSources(k)
+	if pol.op != nil {
+		sources = append(sources, pol.op.rules)
+	}
+	segs := paramPath(name)
+	leaf := paramLeaf(segs)
+	tiers := []func(*koanf.Koanf) string{
+		func(rk *koanf.Koanf) string { return exactRuleKey(rk, name) },
+		func(rk *koanf.Koanf) string { return globRuleKey(rk, segs) },
+		func(rk *koanf.Koanf) string { return regexRuleKey(rk, name) },
+		func(rk *koanf.Koanf) string { return exactRuleKey(rk, leaf) },
+	}
+	for _, tier := range tiers {
+		for _, rk := range sources {
+			if key := tier(rk); key != "" {
+				if pol.op != nil && rk == pol.op.rules {
+					return openAPIRule(k, route, rk, key)
+				}
+				return rk, "form_params." + key, true
+			}
+		}
+	}
+	for _, rk := range sources {
+		if rk.Exists("form_params._defaults_") {
+			return rk, "form_params._defaults_", false
+		}
+	}
+	return k, "", false
+}
 
-	newBody := data.Encode()
-	req.Body = ioutil.NopCloser(bytes.NewBuffer([]byte(newBody)))
-	req.ContentLength = int64(len(newBody))
+// exactRuleKey returns name if form_params has an entry for it.
+func exactRuleKey(k *koanf.Koanf, name string) string {
+	if name == "" || name == "_defaults_" || !k.Exists("form_params."+name) {
+		return ""
+	}
+	return name
 }
 
-// sanitizeBodyField applies form_params rules for a named field.
-// Falls back to _defaults_ when no per-field rule exists.
-// flag and al may be nil; when non-nil they record violations for blocking and audit logging.
-func sanitizeBodyField(k *koanf.Koanf, fieldName string, value string, flag *blockFlag, al *auditLog) string {
-	p := "form_params." + fieldName
-	if !k.Exists(p) {
-		if k.Exists("form_params._defaults_") {
-			p = "form_params._defaults_"
+// globRuleKey returns the most specific glob key of form_params matching the
+// parameter path segs. Keys containing "*" or brackets are globs; each bracket
+// segment is matched with path.Match, so "*" matches exactly one segment.
+func globRuleKey(k *koanf.Koanf, segs []string) string {
+	best, bestLiterals := "", -1
+	keys := k.MapKeys("form_params")
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.HasPrefix(key, "/") || !strings.ContainsAny(key, "*[") {
+			continue
+		}
+		pattern := paramPath(key)
+		if len(pattern) != len(segs) {
+			continue
+		}
+		literals := 0
+		matched := true
+		for i, ps := range pattern {
+			if ok, err := path.Match(ps, segs[i]); err != nil || !ok {
+				matched = false
+				break
+			}
+			if !strings.ContainsAny(ps, "*?[") {
+				literals++
+			}
+		}
+		if matched && literals > bestLiterals {
+			best, bestLiterals = key, literals
 		}
 	}
-	if !k.Exists(p) {
-		return value
+	return best
+}
+
+// regexRuleKey returns the first (in key order) "/pattern/" key of form_params
+// whose pattern matches name. Patterns are unanchored unless they say otherwise.
+func regexRuleKey(k *koanf.Koanf, name string) string {
+	keys := k.MapKeys("form_params")
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(key) < 2 || !strings.HasPrefix(key, "/") || !strings.HasSuffix(key, "/") {
+			continue
+		}
+		re, err := cachedRegexp(key[1 : len(key)-1])
+		if err != nil {
+			log.Printf("form_params: invalid regex key %q: %v", key, err)
+			continue
+		}
+		if re.MatchString(name) {
+			return key
+		}
 	}
-	original := value
+	return ""
+}
+
+// regexpCache holds compiled patterns from the config, keyed by source text, so
+// hot-reloaded configs don't pay for recompilation on every request.
+var regexpCache sync.Map
+
+func cachedRegexp(expr string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(expr); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Store(expr, re)
+	return re, nil
+}
+
+// paramPath splits a bracket-path parameter name into its segments:
+// "items[0][name]" → [items 0 name], "filter[]" → [filter ""]. Names that are
+// not well-formed bracket paths are returned as a single segment.
+func paramPath(name string) []string {
+	i := strings.Index(name, "[")
+	if i <= 0 || !strings.HasSuffix(name, "]") {
+		return []string{name}
+	}
+	segs := []string{name[:i]}
+	rest := name[i:]
+	for rest != "" {
+		end := strings.Index(rest, "]")
+		if rest[0] != '[' || end < 0 {
+			return []string{name}
+		}
+		segs = append(segs, rest[1:end])
+		rest = rest[end+1:]
+	}
+	return segs
+}
+
+// paramLeaf returns the last segment of a parameter path that is neither empty
+// nor an array index, so array elements inherit the rule of the field that
+// holds them. XML attribute segments keep their "@" ("@id"), so attribute
+// values never fall back to the rule of an element with the same name.
+func paramLeaf(segs []string) string {
+	for i := len(segs) - 1; i >= 0; i-- {
+		seg := segs[i]
+		if seg == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(seg); err == nil && i > 0 {
+			continue
+		}
+		return seg
+	}
+	return ""
+}
+
+// applyRule runs the type validation and filters of the form_params rule at p.
+func applyRule(k *koanf.Koanf, p string, value string) string {
 	switch t := k.String(p + ".type"); t {
 	case "text":
 		value = validateMaxLen(k, p, value)
@@ -799,6 +1272,7 @@ func sanitizeBodyField(k *koanf.Koanf, fieldName string, value string, flag *blo
 		value = validateStripChars(k, p, value)
 		value = validateStripBinary(k, p, value)
 		value = validateURL(value)
+		value = validateURLTarget(k, p, value)
 	case "path":
 		value = validateMaxLen(k, p, value)
 		value = validateStripChars(k, p, value)
@@ -811,162 +1285,416 @@ func sanitizeBodyField(k *koanf.Koanf, fieldName string, value string, flag *blo
 		value = validateFilePath(value)
 	case "unixtime":
 		value = validateUnixTime(value)
+	case "json":
+		value = validateMaxLen(k, p, value)
+		value = validateJSON(value)
+	case "regex", "enum", "integer", "decimal", "boolean":
+		value = validateTyped(k, p, t, value)
 	case "absent":
 		value = ""
+	default:
+	}
+	return value
+}
+
+// limitRepeats applies the multi/max_repeats settings of the rule at p to a parameter
+// occurring n times within one location (query or body) and reports which
+// occurrences to forward:
+//
+//   - multi: allow (default) forwards all values, capped at max_repeats when set
+//   - multi: first / last forwards only the first / last value
+//   - multi: reject rejects the request regardless of block_on_detect
+func limitRepeats(k *koanf.Koanf, p, name, location string, n int, flag *blockFlag, al *auditLog) []bool {
+	keep := make([]bool, n)
+	for i := range keep {
+		keep[i] = true
+	}
+	if p == "" || n < 2 {
+		return keep
+	}
+	mode := k.String(p + ".multi")
+	switch mode {
+	case "first", "last":
+		for i := range keep {
+			keep[i] = false
+		}
+		if mode == "first" {
+			keep[0] = true
+		} else {
+			keep[n-1] = true
+		}
+	case "reject":
+	default:
+		max := k.Int(p + ".max_repeats")
+		if max <= 0 || n <= max {
+			return keep
+		}
+		for i := max; i < n; i++ {
+			keep[i] = false
+		}
+	}
+	if flag != nil {
+		reason := fmt.Sprintf("%s param %q repeated %d times", location, name, n)
+		if mode == "reject" {
+			flag.reject(reason)
+		} else {
+			flag.trigger(reason)
+		}
+	}
+	if al != nil {
+		al.add("param_pollution", name, location)
+	}
+	return keep
+}
+
+// resolveQueryBodyRepeat applies the multi/max_repeats settings of the rule at p
+// to a parameter present in both the query string and an urlencoded body, so the
+// upstream sees one unambiguous value whichever one it reads. first keeps the
+// query value, last keeps the body value, and max_repeats counts both locations.
+// keep marks the body occurrences to forward and is narrowed in place; query
+// occurrences are removed from the URL when the body value wins.
+func resolveQueryBodyRepeat(req *http.Request, k *koanf.Koanf, p, name string, keep []bool, flag *blockFlag, al *auditLog) {
+	queryPairs := parseFormPairs(req.URL.RawQuery)
+	switch k.String(p + ".multi") {
+	case "first":
+		for i := range keep {
+			keep[i] = false
+		}
+	case "last":
+		for _, fp := range queryPairs {
+			if !fp.blank && fp.name == name {
+				fp.drop = true
+			}
+		}
+		req.URL.RawQuery = encodeFormPairs(queryPairs)
+	case "reject":
+		if flag != nil {
+			flag.reject(fmt.Sprintf("param %q present in both query and body", name))
+		}
+	default:
+		max := k.Int(p + ".max_repeats")
+		if max <= 0 {
+			return
+		}
+		total := 0
+		for _, fp := range queryPairs {
+			if !fp.blank && !fp.drop && fp.name == name {
+				total++
+			}
+		}
+		trimmed := false
+		for i := range keep {
+			if !keep[i] {
+				continue
+			}
+			if total >= max {
+				keep[i] = false
+				trimmed = true
+				continue
+			}
+			total++
+		}
+		if !trimmed {
+			return
+		}
+	}
+	if flag != nil {
+		flag.trigger(fmt.Sprintf("param %q present in both query and body", name))
+	}
+	if al != nil {
+		al.add("param_pollution", name, "post")
+	}
+}
+
+// strictParams reports whether unknown parameters are rejected for the request.
+// A route's strict_params setting overrides the global one.
+func strictParams(k, route *koanf.Koanf) bool {
+	if route != nil && route.Exists("strict_params") {
+		return route.String("strict_params") != "false"
+	}
+	return k.Exists("strict_params") && k.String("strict_params") != "false"
+}
+
+// rejectUnknownParam signals an unknown parameter under strict_params. With
+// strict_params: block the request is always rejected; otherwise the parameter is
+// only dropped, and blocked when block_on_detect is enabled.
+func rejectUnknownParam(k, route *koanf.Koanf, flag *blockFlag, reason string) {
+	mode := k.String("strict_params")
+	if route != nil && route.Exists("strict_params") {
+		mode = route.String("strict_params")
+	}
+	if mode == "block" {
+		flag.reject(reason)
+	} else {
+		flag.trigger(reason)
+	}
+}
+
+// checkRequiredParams rejects the request when a form_params rule marked
+// required: true was not present in the query string or body. Rules from the
+// SOAP operation, the matched route and the global form_params are all considered.
+// Parameters inside a body no sanitizer parsed (streamed, or of a type no
+// enabled sanitizer handles) cannot be seen, so they do not count as present.
+func checkRequiredParams(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
+	pol := policyFrom(req)
+	missing := "required param %q is missing"
+	if b := bodyFrom(req); b != nil && (b.streamed || b.size > 0) && !pol.bodyParsed {
+		missing = "required param %q is missing from the query string and the body was not parsed"
+	}
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	reported := make(map[string]bool)
+	check := func(rk *koanf.Koanf) {
+		for _, name := range rk.MapKeys("form_params") {
+			if name == "_defaults_" || !rk.Bool("form_params."+name+".required") || pol.seen[name] || reported[name] {
+				continue
+			}
+			reported[name] = true
+			log.Printf("required param %q missing: %s %s", name, req.Method, req.URL.Path)
+			flag.reject(fmt.Sprintf(missing, name))
+			if al != nil {
+				al.add("missing_param", name, "request")
+			}
+		}
 	}
+	for _, rk := range pol.ruleSources(k) {
+		check(rk)
+	}
+}
+
+// sanitizeBodyField applies form_params rules for a named field.
+// Falls back to _defaults_ when no per-field rule exists.
+// flag and al may be nil; when non-nil they record violations for blocking and audit logging.
+func sanitizeBodyField(k *koanf.Koanf, pol *requestPolicy, fieldName string, value string, flag *blockFlag, al *auditLog) string {
+	rk, p, _ := paramRule(k, pol, fieldName)
+	return applyBodyRule(k, rk, p, fieldName, value, flag, al)
+}
+
+// ruleName returns the config section a rule prefix returned by paramRule or
+// jsonRule comes from, as reported in audit events and block reasons.
+func ruleName(p string) string {
+	switch p {
+	case "json_rule":
+		return "json_rules"
+	case "xml_rule":
+		return "xml_rules"
+	case "openapi_rule":
+		return "openapi"
+	}
+	return "form_params"
+}
+
+// applyBodyRule runs the rule at p on a body value and records a violation
+// under field when the value changed.
+func applyBodyRule(k, rk *koanf.Koanf, p string, field string, value string, flag *blockFlag, al *auditLog) string {
+	return applyFieldRule(k, rk, p, field, value, "body", flag, al)
+}
+
+// applyFieldRule is applyBodyRule for a value found in location (body, query
+// or post).
+func applyFieldRule(k, rk *koanf.Koanf, p string, field string, value string, location string, flag *blockFlag, al *auditLog) string {
+	if p == "" {
+		return value
+	}
+	rule := ruleName(p)
+	raw := value
+	value, ok := canonicalize(k, rk, p, field, value, location, flag, al)
+	if !ok {
+		return value
+	}
+	canonical := value
+	value = applyDetectors(rk, p, field, value, location, flag, al)
+	original := value
+	value = applyRule(rk, p, value)
 	if value != original {
 		if flag != nil {
-			flag.trigger(fmt.Sprintf("body field %q violated form_params policy", fieldName))
+			flag.trigger(fmt.Sprintf("%s field %q violated %s policy", location, field, rule))
 		}
 		if al != nil {
-			al.add("form_params", fieldName, "body")
+			al.add(rule, field, location)
 		}
+		// A body field cannot be dropped here; on_invalid: drop blanks it.
+		invalidAction(rk, p, field, location, flag)
 	}
-	return value
+	return canonicalForward(k, raw, canonical, value)
 }
 
 // sanitizingJSONBody sanitizes string values in a JSON request body.
 // Enabled by setting sanitize_json_body: true in config.
 // Field-level rules are sourced from form_params (with _defaults_ fallback).
+// application/json, +json media types and NDJSON bodies are handled. On a
+// route with a graphql section the body is always inspected as a
+// GraphQL-over-HTTP request instead.
 func sanitizingJSONBody(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
-	if !k.Exists("sanitize_json_body") {
+	graphql := graphqlConfig(policyFrom(req)) != nil
+	if !k.Exists("sanitize_json_body") && !graphql {
 		return
 	}
-	if !strings.HasPrefix(strings.TrimSpace(req.Header.Get("Content-Type")), "application/json") {
+	ct := req.Header.Get("Content-Type")
+	ndjson := isNDJSONContentType(ct)
+	if !(isJSONContentType(ct) || (ndjson && !graphql)) || req.Body == nil {
 		return
 	}
 
-	body, err := ioutil.ReadAll(req.Body)
-	req.Body.Close()
+	body, err := readBody(req)
 	if err != nil {
 		log.Printf("sanitizingJSONBody: read error: %v; discarding body", err)
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(nil))
-		req.ContentLength = 0
+		setBody(req, nil)
 		return
 	}
 
-	var data interface{}
-	if err := json.Unmarshal(body, &data); err != nil {
-		log.Printf("sanitizingJSONBody: invalid JSON, discarding body: %v", err)
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(nil))
-		req.ContentLength = 0
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	var sanitized []byte
+	switch {
+	case ndjson:
+		// Each line is a document of its own, checked and sanitized like a
+		// JSON body; blank lines and line endings are kept.
+		var out bytes.Buffer
+		for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+			doc := bytes.TrimRight(line, "\r\n")
+			if len(bytes.TrimSpace(doc)) == 0 {
+				out.Write(line)
+				continue
+			}
+			if !checkJSONDocument(k, doc, flag, al) {
+				setBody(req, nil)
+				return
+			}
+			rewritten, _ := rewriteJSON(k, policyFrom(req), doc, flag, al)
+			out.Write(rewritten)
+			out.Write(line[len(doc):])
+		}
+		sanitized = out.Bytes()
+	case !checkJSONDocument(k, body, flag, al):
+		setBody(req, nil)
 		return
+	case graphql:
+		sanitized = sanitizeGraphQLBody(req, k, body, flag)
+	default:
+		// Token-level rewrite: key order, number literals and whitespace
+		// survive, and the original bytes are forwarded untouched when no
+		// rule fired.
+		sanitized, _ = rewriteJSON(k, policyFrom(req), body, flag, al)
 	}
+	policyFrom(req).bodyParsed = true
+	setBody(req, sanitized)
+}
 
-	al, _ := req.Context().Value(auditKey{}).(*auditLog)
-	data = sanitizeJSONNode(k, "", data, flag, al)
+// checkJSONDocument reports whether doc is valid JSON within json_limits. When
+// it is not, the violation has been logged and recorded and the body must be
+// discarded.
+func checkJSONDocument(k *koanf.Koanf, doc []byte, flag *blockFlag, al *auditLog) bool {
+	// Structural limits are checked on the token stream before the body is
+	// decoded into memory, and also catch duplicate keys that Unmarshal would
+	// silently collapse.
+	if lim, ok := loadJSONLimits(k); ok {
+		err := checkJSONLimits(doc, lim)
+		limitErr, isLimit := err.(*jsonLimitError)
+		if err != nil && !isLimit {
+			log.Printf("sanitizingJSONBody: invalid JSON, discarding body: %v", err)
+			return false
+		}
+		if err != nil {
+			log.Printf("sanitizingJSONBody: json_limits violated, discarding body: %v", err)
+			if flag != nil {
+				flag.trigger(fmt.Sprintf("JSON body violated json_limits: %v", err))
+			}
+			if al != nil {
+				al.add("json_limits", limitErr.limit, "body")
+			}
+			return false
+		}
+	}
+	if !json.Valid(doc) {
+		log.Printf("sanitizingJSONBody: invalid JSON, discarding body")
+		return false
+	}
+	return true
+}
 
-	sanitized, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("sanitizingJSONBody: marshal error: %v; forwarding original body", err)
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-		req.ContentLength = int64(len(body))
-		return
+// dropUnknownBodyField reports whether a JSON value has no rule and must be
+// dropped under strict_params, recording the violation if so.
+func dropUnknownBodyField(k *koanf.Koanf, pol *requestPolicy, path jsonPath, flag *blockFlag, al *auditLog) bool {
+	if _, _, known := jsonRule(k, pol, path); known {
+		return false
+	}
+	log.Printf("strict_params: dropping unknown body field %q", path.String())
+	rejectUnknownParam(k, pol.route, flag, fmt.Sprintf("body field %q is not listed in form_params", path.String()))
+	if al != nil {
+		al.add("unknown_param", path.String(), "body")
 	}
+	return true
+}
 
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(sanitized))
-	req.ContentLength = int64(len(sanitized))
+// mediaType returns the lower-cased media type of a Content-Type, without
+// parameters.
+func mediaType(ct string) string {
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ct))
 }
 
-// sanitizeJSONNode recursively walks a decoded JSON value and sanitizes all strings.
-// Object keys are used as field names for form_params lookup.
-// Array items inherit the field name of their parent array.
-func sanitizeJSONNode(k *koanf.Koanf, key string, val interface{}, flag *blockFlag, al *auditLog) interface{} {
-	switch v := val.(type) {
-	case string:
-		return sanitizeBodyField(k, key, v, flag, al)
-	case map[string]interface{}:
-		for field, child := range v {
-			v[field] = sanitizeJSONNode(k, field, child, flag, al)
-		}
-		return v
-	case []interface{}:
-		for i, item := range v {
-			v[i] = sanitizeJSONNode(k, key, item, flag, al)
-		}
-		return v
-	default:
-		// numbers, booleans, null — no sanitization needed
-		return val
+// isXMLContentType reports whether a Content-Type is handled by sanitizingXMLBody:
+// text/xml, application/xml and any +xml structured syntax suffix
+// (application/soap+xml, application/atom+xml, ...).
+func isXMLContentType(ct string) bool {
+	media := mediaType(ct)
+	return media == "text/xml" || media == "application/xml" || strings.HasSuffix(media, "+xml")
+}
+
+// isJSONContentType reports whether a Content-Type carries one JSON document:
+// application/json and any +json structured syntax suffix
+// (application/vnd.api+json, application/merge-patch+json, ...).
+func isJSONContentType(ct string) bool {
+	media := mediaType(ct)
+	return media == "application/json" || strings.HasSuffix(media, "+json")
+}
+
+// isNDJSONContentType reports whether a Content-Type carries newline-delimited
+// JSON, one document per line.
+func isNDJSONContentType(ct string) bool {
+	switch mediaType(ct) {
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		return true
 	}
+	return false
 }
 
 // sanitizingXMLBody sanitizes character data and attribute values in an XML request body.
 // Enabled by setting sanitize_xml_body: true in config.
 // Field-level rules are sourced from form_params (with _defaults_ fallback).
+// DTDs and processing instructions are handled per xml_security, and bodies
+// exceeding xml_limits are discarded.
 func sanitizingXMLBody(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
 	if !k.Exists("sanitize_xml_body") {
 		return
 	}
 	ct := strings.TrimSpace(req.Header.Get("Content-Type"))
-	if !strings.HasPrefix(ct, "text/xml") && !strings.HasPrefix(ct, "application/xml") {
+	if !isXMLContentType(ct) || req.Body == nil {
 		return
 	}
 
-	body, err := ioutil.ReadAll(req.Body)
-	req.Body.Close()
+	body, err := readBody(req)
 	if err != nil {
 		log.Printf("sanitizingXMLBody: read error: %v; discarding body", err)
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(nil))
-		req.ContentLength = 0
+		setBody(req, nil)
 		return
 	}
 
 	al, _ := req.Context().Value(auditKey{}).(*auditLog)
-	decoder := xml.NewDecoder(bytes.NewReader(body))
-	var buf bytes.Buffer
-	encoder := xml.NewEncoder(&buf)
-	var elementStack []string
-
-	for {
-		tok, err := decoder.Token()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
+	// Byte-level rewrite: prefixes, namespace declarations, quoting and
+	// whitespace survive, and the original bytes are forwarded untouched when no
+	// rule fired.
+	sanitized, err := rewriteXML(k, policyFrom(req), body, flag, al)
+	if err != nil {
+		if err != errXMLDiscarded {
 			log.Printf("sanitizingXMLBody: invalid XML, discarding body: %v", err)
-			req.Body = ioutil.NopCloser(bytes.NewBuffer(nil))
-			req.ContentLength = 0
-			return
-		}
-
-		switch t := tok.(type) {
-		case xml.StartElement:
-			elementStack = append(elementStack, t.Name.Local)
-			for i, attr := range t.Attr {
-				t.Attr[i].Value = sanitizeBodyField(k, attr.Name.Local, attr.Value, flag, al)
-			}
-			encoder.EncodeToken(t)
-		case xml.EndElement:
-			if len(elementStack) > 0 {
-				elementStack = elementStack[:len(elementStack)-1]
-			}
-			encoder.EncodeToken(t)
-		case xml.CharData:
-			currentElement := ""
-			if len(elementStack) > 0 {
-				currentElement = elementStack[len(elementStack)-1]
-			}
-			// Copy: the underlying byte slice is reused across Token() calls.
-			data := make(xml.CharData, len(t))
-			copy(data, t)
-			sanitized := sanitizeBodyField(k, currentElement, string(data), flag, al)
-			encoder.EncodeToken(xml.CharData(sanitized))
-		default:
-			encoder.EncodeToken(tok)
 		}
-	}
-
-	if err := encoder.Flush(); err != nil {
-		log.Printf("sanitizingXMLBody: flush error: %v; forwarding original body", err)
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-		req.ContentLength = int64(len(body))
+		setBody(req, nil)
 		return
 	}
-
-	sanitized := buf.Bytes()
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(sanitized))
-	req.ContentLength = int64(len(sanitized))
+	policyFrom(req).bodyParsed = true
+	setBody(req, sanitized)
 }
 
 func validateFormName(k *koanf.Koanf, name string, value string) string {
@@ -1085,6 +1813,16 @@ func validateNumeric(value string) string {
 	return value
 }
 
+// validateJSON blanks a value that is not a JSON document. The document's
+// own values are sanitized before, by sanitizeEmbeddedJSON.
+func validateJSON(value string) string {
+	if !json.Valid([]byte(value)) {
+		log.Printf("not valid JSON: %v", value)
+		value = ""
+	}
+	return value
+}
+
 func validateIP(value string) string {
 	if valid.IsIP(value) == false {
 		log.Printf("not valid IP: %v", value)
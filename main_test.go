@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/rawbytes"
+)
+
+// testConfig loads a YAML config the way main loads config.yaml.
+func testConfig(t *testing.T, src string) *koanf.Koanf {
+	t.Helper()
+	c := koanf.New(".")
+	if err := c.Load(rawbytes.Provider([]byte(src)), yaml.Parser()); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	return c
+}
+
+// testRequest builds a request as the route handler hands it to the director:
+// body buffered, and block flag, audit log and request policy in its context.
+func testRequest(t *testing.T, c *koanf.Koanf, method, target, contentType, body string) (*http.Request, *blockFlag, *auditLog) {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body == "" {
+		r.Body = http.NoBody
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	route := matchRoute(c, r.URL.Path)
+	b, err := bufferRequestBody(httptest.NewRecorder(), r, c, route)
+	if err != nil {
+		t.Fatalf("body: %v", err)
+	}
+	if b != nil {
+		t.Cleanup(b.close)
+	}
+	flag := &blockFlag{enabled: c.Bool("block_on_detect")}
+	al := &auditLog{}
+	pol := &requestPolicy{route: route}
+	if c.Exists("openapi") {
+		pol.op, pol.pathParams = matchOpenAPIOperation(c, r.Method, r.URL.EscapedPath())
+	}
+	ctx := context.WithValue(r.Context(), auditKey{}, al)
+	ctx = context.WithValue(ctx, blockKey{}, flag)
+	ctx = context.WithValue(ctx, bodyKey{}, b)
+	ctx = context.WithValue(ctx, policyKey{}, pol)
+	return r.WithContext(ctx), flag, al
+}
+
+// auditFields returns the rule:field of each audit event.
+func auditFields(al *auditLog) []string {
+	var out []string
+	for _, e := range al.events {
+		out = append(out, e.Rule+":"+e.Field)
+	}
+	return out
+}
+
+func TestCheckRequiredParams(t *testing.T) {
+	c := testConfig(t, `
+routes:
+  - path: /login
+    form_params:
+      username:
+        type: text
+        required: true
+`)
+	tests := []struct {
+		name, target, contentType, body string
+		rejected                        bool
+	}{
+		{"in query", "/login?username=a", "", "", false},
+		{"no body", "/login", "", "", true},
+		{"in form body", "/login", "application/x-www-form-urlencoded", "username=a", false},
+		{"missing from form body", "/login", "application/x-www-form-urlencoded", "password=a", true},
+		{"unparsed body", "/login", "application/json", `{"username": "a"}`, true},
+		{"unparsed body with query", "/login?username=a", "text/plain", "x", false},
+		{"unparsed body without query", "/login", "text/plain", "x", true},
+		{"other route", "/", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, flag, al := testRequest(t, c, "POST", tt.target, tt.contentType, tt.body)
+			sanitizingGET(r, c, flag)
+			sanitizingJSONBody(r, c, flag)
+			sanitizingPOST(r, c, flag)
+			checkRequiredParams(r, c, flag)
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+			if tt.rejected && (len(al.events) != 1 || al.events[0].Rule != "missing_param") {
+				t.Errorf("audit events %+v, want missing_param", al.events)
+			}
+		})
+	}
+}
+
+func TestCheckMethod(t *testing.T) {
+	c := testConfig(t, `
+http_methods:
+  deny: [DELETE]
+routes:
+  - path: /dav/*
+    methods: [GET, PROPFIND, DELETE]
+`)
+	tests := []struct {
+		name, method, target, override string
+		ok                             bool
+		allow                          string
+	}{
+		{"default allowed", "GET", "/", "", true, "HEAD, GET, POST, PUT, PATCH, OPTIONS"},
+		{"denied", "DELETE", "/", "", false, "HEAD, GET, POST, PUT, PATCH, OPTIONS"},
+		{"route method", "PROPFIND", "/dav/a", "", true, "GET, PROPFIND"},
+		{"not a route method", "POST", "/dav/a", "", false, "GET, PROPFIND"},
+		{"deny beats route", "DELETE", "/dav/a", "", false, "GET, PROPFIND"},
+		{"override stripped", "POST", "/", "DELETE", true, "HEAD, GET, POST, PUT, PATCH, OPTIONS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.override != "" {
+				r.Header.Set("X-HTTP-Method-Override", tt.override)
+			}
+			ok, allow := checkMethod(r, c, matchRoute(c, r.URL.Path))
+			if ok != tt.ok || strings.Join(allow, ", ") != tt.allow {
+				t.Errorf("got %v %v, want %v [%s]", ok, allow, tt.ok, tt.allow)
+			}
+			if r.Header.Get("X-HTTP-Method-Override") != "" {
+				t.Errorf("override header kept")
+			}
+		})
+	}
+}
+
+func TestRejectMethodAudit(t *testing.T) {
+	var buf bytes.Buffer
+	auditLogger = log.New(&buf, "", 0)
+	defer func() { auditLogger = nil }()
+
+	w := httptest.NewRecorder()
+	rejectMethod(w, httptest.NewRequest("TRACE", "/", nil), []string{"GET", "HEAD"}, time.Now())
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("response %d Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	var entry struct {
+		Status int          `json:"status"`
+		Events []auditEvent `json:"events"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("audit entry %q: %v", buf.String(), err)
+	}
+	if entry.Status != http.StatusMethodNotAllowed || len(entry.Events) != 1 || entry.Events[0].Rule != "http_methods" || entry.Events[0].Field != "TRACE" {
+		t.Errorf("audit entry %s", buf.String())
+	}
+}
+
+func TestFormPairsOrder(t *testing.T) {
+	c := testConfig(t, `
+form_params:
+  q:
+    type: text
+    strip_html: true
+`)
+	tests := []struct {
+		query, want string
+	}{
+		{"z=1&a=%41&q=plain&m=a+b&&x", "z=1&a=%41&q=plain&m=a+b&&x"},
+		{"z=1&q=%3Cb%3Ehi&a=%7e", "z=1&q=hi&a=%7e"},
+		{"b=2&q=%3Ci%3E&a=1&q=ok", "b=2&q=&a=1&q=ok"},
+		{"bad=%zz&a=1", "a=1"},
+		{"a;b=1&c=2", "c=2"},
+	}
+	for _, tt := range tests {
+		r, flag, _ := testRequest(t, c, "GET", "/?"+tt.query, "", "")
+		sanitizingGET(r, c, flag)
+		if r.URL.RawQuery != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.query, r.URL.RawQuery, tt.want)
+		}
+	}
+
+	body := "z=%7E&q=%3Cb%3Ehi&a=1"
+	r, flag, _ := testRequest(t, c, "POST", "/", "application/x-www-form-urlencoded", body)
+	sanitizingPOST(r, c, flag)
+	if got, _ := readBody(r); string(got) != "z=%7E&q=hi&a=1" {
+		t.Errorf("body %s, want z=%%7E&q=hi&a=1", got)
+	}
+}
+
+func TestRepeatedParams(t *testing.T) {
+	c := testConfig(t, `
+form_params:
+  first:
+    type: text
+    multi: first
+  last:
+    type: text
+    multi: last
+  once:
+    type: text
+    multi: reject
+  tags:
+    type: text
+    max_repeats: 2
+  id:
+    type: integer
+    min: 1
+    max: 1
+  any:
+    type: text
+`)
+	tests := []struct {
+		name, query, body, wantQuery, wantBody string
+		rejected                               bool
+	}{
+		{"allow", "any=1&any=2&any=3", "", "any=1&any=2&any=3", "", false},
+		{"first", "first=1&x=0&first=2", "", "first=1&x=0", "", false},
+		{"last", "last=1&x=0&last=2", "", "x=0&last=2", "", false},
+		{"reject", "once=1&once=2", "", "once=1&once=2", "", true},
+		{"single reject", "once=1", "", "once=1", "", false},
+		{"max_repeats", "tags=a&tags=b&tags=c", "", "tags=a&tags=b", "", false},
+		{"first across locations", "first=q", "first=b&x=0", "first=q", "x=0", false},
+		{"last across locations", "last=q&y=1", "last=b", "y=1", "last=b", false},
+		{"reject across locations", "once=q", "once=b", "once=q", "once=b", true},
+		{"max_repeats across locations", "tags=a", "tags=b&tags=c", "tags=a", "tags=b", false},
+		{"max is a value bound", "id=1&id=1", "", "id=1&id=1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, ct := "GET", ""
+			if tt.body != "" {
+				method, ct = "POST", "application/x-www-form-urlencoded"
+			}
+			r, flag, al := testRequest(t, c, method, "/?"+tt.query, ct, tt.body)
+			sanitizingGET(r, c, flag)
+			sanitizingPOST(r, c, flag)
+			if r.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query %s, want %s", r.URL.RawQuery, tt.wantQuery)
+			}
+			if body, _ := readBody(r); string(body) != tt.wantBody {
+				t.Errorf("body %s, want %s", body, tt.wantBody)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+			polluted := tt.query+tt.body != tt.wantQuery+tt.wantBody || tt.rejected
+			if got := len(al.events) > 0 && al.events[0].Rule == "param_pollution"; got != polluted {
+				t.Errorf("audit events %+v, want param_pollution %v", al.events, polluted)
+			}
+		})
+	}
+}
+
+func TestParamPath(t *testing.T) {
+	tests := []struct {
+		name, path, leaf string
+	}{
+		{"email", "email", "email"},
+		{"user[email]", "user email", "email"},
+		{"items[0][name]", "items 0 name", "name"},
+		{"tags[0]", "tags 0", "tags"},
+		{"filter[]", "filter ", "filter"},
+		{"order[@id]", "order @id", "@id"},
+		{"a[b", "a[b", "a[b"},
+		{"[a]", "[a]", "[a]"},
+		{"a[b]c", "a[b]c", "a[b]c"},
+	}
+	for _, tt := range tests {
+		segs := paramPath(tt.name)
+		if got := strings.Join(segs, " "); got != tt.path {
+			t.Errorf("paramPath(%q) = %q, want %q", tt.name, got, tt.path)
+		}
+		if got := paramLeaf(segs); got != tt.leaf {
+			t.Errorf("paramLeaf(%q) = %q, want %q", tt.name, got, tt.leaf)
+		}
+	}
+}
+
+func TestParamRule(t *testing.T) {
+	c := testConfig(t, `
+form_params:
+  _defaults_:
+    type: text
+  email:
+    type: email
+  "user[email]":
+    type: text
+  "user[*]":
+    type: text
+  "items[*][qty]":
+    type: numeric
+  "items[0][*]":
+    type: text
+  "search_*":
+    type: text
+  "/^q[0-9]+$/":
+    type: text
+  "/^z/":
+    type: text
+  "/^za/":
+    type: text
+routes:
+  - path: /admin
+    form_params:
+      "user[*]":
+        type: email
+`)
+	tests := []struct {
+		target, name, key string
+		known             bool
+	}{
+		{"/", "user[email]", "user[email]", true},
+		{"/", "user[name]", "user[*]", true},
+		{"/", "items[3][qty]", "items[*][qty]", true},
+		{"/", "items[0][qty]", "items[*][qty]", true},
+		{"/", "items[0][sku]", "items[0][*]", true},
+		{"/", "search_term", "search_*", true},
+		{"/", "q12", "/^q[0-9]+$/", true},
+		{"/", "q12x", "_defaults_", false},
+		{"/", "zap", "/^z/", true},
+		{"/", "contact[email]", "email", true},
+		{"/", "emails[0]", "_defaults_", false},
+		{"/", "other", "_defaults_", false},
+		{"/admin", "user[name]", "user[*]", true},
+	}
+	for _, tt := range tests {
+		r, _, _ := testRequest(t, c, "GET", tt.target, "", "")
+		pol := policyFrom(r)
+		rk, p, known := paramRule(c, pol, tt.name)
+		if p != "form_params."+tt.key || known != tt.known {
+			t.Errorf("%s %s: rule %s %v, want %s %v", tt.target, tt.name, p, known, tt.key, tt.known)
+		}
+		if tt.target == "/admin" && rk != pol.route {
+			t.Errorf("%s %s: global rule used over the route's", tt.target, tt.name)
+		}
+	}
+}
+
+func TestBodyContentTypes(t *testing.T) {
+	tests := []struct {
+		ct          string
+		json, nd, x bool
+	}{
+		{"application/json", true, false, false},
+		{"Application/JSON; charset=utf-8", true, false, false},
+		{"application/vnd.api+json", true, false, false},
+		{"application/merge-patch+json", true, false, false},
+		{"application/jsonp", false, false, false},
+		{"text/json", false, false, false},
+		{"application/x-ndjson", false, true, false},
+		{"application/jsonl", false, true, false},
+		{"application/x-jsonlines", false, true, false},
+		{"text/xml; charset=utf-8", false, false, true},
+		{"application/soap+xml; action=x", false, false, true},
+		{"application/xhtml", false, false, false},
+	}
+	for _, tt := range tests {
+		if got := isJSONContentType(tt.ct); got != tt.json {
+			t.Errorf("isJSONContentType(%q) = %v", tt.ct, got)
+		}
+		if got := isNDJSONContentType(tt.ct); got != tt.nd {
+			t.Errorf("isNDJSONContentType(%q) = %v", tt.ct, got)
+		}
+		if got := isXMLContentType(tt.ct); got != tt.x {
+			t.Errorf("isXMLContentType(%q) = %v", tt.ct, got)
+		}
+	}
+}
+
+func TestNDJSONBody(t *testing.T) {
+	c := testConfig(t, `
+sanitize_json_body: true
+form_params:
+  bio:
+    type: text
+    strip_html: true
+`)
+	tests := []struct {
+		name, body, want string
+		events           []string
+	}{
+		{"untouched", "{\"a\": 1}\n\n{\"b\": 2.50}\r\n", "{\"a\": 1}\n\n{\"b\": 2.50}\r\n", nil},
+		{"sanitized per line", "{\"bio\": \"x\"}\n{\"bio\": \"<b>y</b>\"}\r\n{\"bio\": \"z\"}",
+			"{\"bio\": \"x\"}\n{\"bio\": \"y\"}\r\n{\"bio\": \"z\"}", []string{"form_params:$.bio"}},
+		{"invalid line", "{\"a\": 1}\n{\"a\": \n", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, flag, al := testRequest(t, c, "POST", "/", "application/x-ndjson", tt.body)
+			sanitizingJSONBody(r, c, flag)
+			if got, _ := readBody(r); string(got) != tt.want {
+				t.Errorf("body %q, want %q", got, tt.want)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestEmbeddedJSONField(t *testing.T) {
+	c := testConfig(t, `
+form_params:
+  payload:
+    type: json
+    maxlen: 64
+  "payload[user][email]":
+    type: email
+  bio:
+    type: text
+    strip_html: true
+`)
+	tests := []struct {
+		name, payload, want string
+		events              []string
+	}{
+		{"untouched", `{"user": {"email": "a@example.com"}, "n": 1.0}`, `{"user": {"email": "a@example.com"}, "n": 1.0}`, nil},
+		{"nested rule", `{"user": {"email": "not an email"}}`, `{"user": {"email": ""}}`, []string{"form_params:$.payload.user.email"}},
+		{"leaf fallback", `{"bio": "<b>x</b>"}`, `{"bio": "x"}`, []string{"form_params:$.payload.bio"}},
+		{"not json", `{"user": `, "", []string{"form_params:payload"}},
+		{"too long", `{"bio": "` + strings.Repeat("a", 70) + `"}`, "", []string{"form_params:payload"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := "payload=" + url.QueryEscape(tt.payload)
+			r, flag, al := testRequest(t, c, "POST", "/", "application/x-www-form-urlencoded", body)
+			sanitizingPOST(r, c, flag)
+			raw, _ := readBody(r)
+			form, err := url.ParseQuery(string(raw))
+			if err != nil {
+				t.Fatalf("body %s: %v", raw, err)
+			}
+			if got := form.Get("payload"); got != tt.want {
+				t.Errorf("payload %s, want %s", got, tt.want)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	const rules = `
+form_params:
+  _defaults_:
+    type: text
+  q:
+    type: text
+routes:
+  - path: /open
+    strict_params: false
+`
+	tests := []struct {
+		name, strict, target, want string
+		rejected                   bool
+	}{
+		{"off", "", "/?q=1&x=2", "q=1&x=2", false},
+		{"drop", "strict_params: true\n", "/?q=1&x=2", "q=1", false},
+		{"block", "strict_params: block\n", "/?q=1&x=2", "q=1", true},
+		{"route override", "strict_params: block\n", "/open?q=1&x=2", "q=1&x=2", false},
+		{"known only", "strict_params: block\n", "/?q=1", "q=1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, tt.strict+rules)
+			r, flag, al := testRequest(t, c, "GET", tt.target, "", "")
+			sanitizingGET(r, c, flag)
+			if r.URL.RawQuery != tt.want {
+				t.Errorf("query %s, want %s", r.URL.RawQuery, tt.want)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+			dropped := tt.want != strings.SplitN(tt.target, "?", 2)[1]
+			if got := auditFields(al); dropped != reflect.DeepEqual(got, []string{"unknown_param:x"}) {
+				t.Errorf("audit %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+// multipartPart is one part of a multipart/form-data body. field holds the
+// name and value of a text field for sanitizeFormPairs; it is nil for file
+// parts, which are forwarded unchanged.
+type multipartPart struct {
+	header  textproto.MIMEHeader
+	content []byte
+	field   *formPair
+}
+
+// sanitizingMultipart applies the form_params rules to the text fields of a
+// multipart/form-data body, as sanitizingPOST does for urlencoded fields, so
+// type: json fields, strict_params and the multi policy work the same way.
+// Parts with a filename are files and are forwarded unchanged. The body is
+// rebuilt with the original boundary; one that cannot be parsed is discarded.
+func sanitizingMultipart(req *http.Request, k *koanf.Koanf, boundary string, flag *blockFlag) {
+	if req.Body == nil {
+		return
+	}
+	body, err := readBody(req)
+	if err != nil {
+		log.Printf("sanitizingPOST: read error: %v; discarding body", err)
+		setBody(req, nil)
+		return
+	}
+	parts, err := parseMultipart(body, boundary)
+	if err != nil {
+		log.Printf("sanitizingPOST: invalid multipart body: %v; discarding body", err)
+		setBody(req, nil)
+		return
+	}
+	var pairs []*formPair
+	for _, mp := range parts {
+		if mp.field != nil {
+			pairs = append(pairs, mp.field)
+		}
+	}
+	sanitizeFormPairs(req, k, pairs, "post", queryParamNames(req), flag)
+	policyFrom(req).bodyParsed = true
+
+	newBody, err := encodeMultipart(parts, boundary)
+	if err != nil {
+		log.Printf("sanitizingPOST: cannot rebuild multipart body: %v; discarding body", err)
+		setBody(req, nil)
+		return
+	}
+	setBody(req, newBody)
+}
+
+// parseMultipart splits a multipart/form-data body into its parts, in order.
+// Text fields that cannot be inspected, those without a form name or with a
+// Content-Transfer-Encoding that hides their value, are marked for dropping.
+func parseMultipart(body []byte, boundary string) ([]*multipartPart, error) {
+	if boundary == "" {
+		return nil, errors.New("no boundary")
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	var parts []*multipartPart
+	for {
+		// NextRawPart leaves Content-Transfer-Encoding alone, so a field is
+		// never inspected in a form other than the one forwarded.
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		mp := &multipartPart{header: p.Header, content: content}
+		parts = append(parts, mp)
+		_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		if _, ok := params["filename"]; ok {
+			continue
+		}
+		mp.field = &formPair{name: p.FormName(), value: string(content)}
+		switch cte := strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))); {
+		case mp.field.name == "":
+			log.Printf("dropping multipart part without a form name")
+			mp.field.drop = true
+		case cte != "" && cte != "7bit" && cte != "8bit" && cte != "binary":
+			log.Printf("dropping multipart field %q with Content-Transfer-Encoding %q", mp.field.name, cte)
+			mp.field.drop = true
+		}
+	}
+}
+
+// encodeMultipart rebuilds a multipart/form-data body from parts. Dropped
+// fields are omitted and renamed fields get a new Content-Disposition.
+func encodeMultipart(parts []*multipartPart, boundary string) ([]byte, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	if err := w.SetBoundary(boundary); err != nil {
+		return nil, err
+	}
+	for _, mp := range parts {
+		content := mp.content
+		if fp := mp.field; fp != nil {
+			if fp.drop {
+				continue
+			}
+			if fp.changed {
+				mp.header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": fp.name}))
+			}
+			content = []byte(fp.value)
+		}
+		pw, err := w.CreatePart(mp.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
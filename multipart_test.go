@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestSanitizingMultipart(t *testing.T) {
+	c := testConfig(t, `
+form_params:
+  payload:
+    type: json
+  "payload[user][email]":
+    type: email
+  bio:
+    type: text
+    strip_html: true
+  avatar:
+    type: text
+    strip_html: true
+`)
+	type part struct{ name, filename, cte, content string }
+	tests := []struct {
+		name   string
+		parts  []part
+		want   map[string]string // form name or filename -> forwarded content
+		events []string
+	}{
+		{
+			name:  "untouched",
+			parts: []part{{name: "bio", content: "hello"}, {name: "payload", content: `{"n": 1.0}`}},
+			want:  map[string]string{"bio": "hello", "payload": `{"n": 1.0}`},
+		},
+		{
+			name:   "text field",
+			parts:  []part{{name: "bio", content: "<b>x</b>"}},
+			want:   map[string]string{"bio": "x"},
+			events: []string{"form_params:bio"},
+		},
+		{
+			name:   "embedded json",
+			parts:  []part{{name: "payload", content: `{"user": {"email": "not an email"}}`}},
+			want:   map[string]string{"payload": `{"user": {"email": ""}}`},
+			events: []string{"form_params:$.payload.user.email"},
+		},
+		{
+			name:  "file kept",
+			parts: []part{{name: "avatar", filename: "a.html", content: "<b>x</b>"}},
+			want:  map[string]string{"a.html": "<b>x</b>"},
+		},
+		{
+			name:  "encoded field dropped",
+			parts: []part{{name: "bio", cte: "base64", content: "PGI+eDwvYj4="}, {name: "x", content: "1"}},
+			want:  map[string]string{"x": "1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			w := multipart.NewWriter(&b)
+			for _, p := range tt.parts {
+				h := textproto.MIMEHeader{}
+				h.Set("Content-Disposition", `form-data; name="`+p.name+`"`)
+				if p.filename != "" {
+					h.Set("Content-Disposition", `form-data; name="`+p.name+`"; filename="`+p.filename+`"`)
+				}
+				if p.cte != "" {
+					h.Set("Content-Transfer-Encoding", p.cte)
+				}
+				pw, _ := w.CreatePart(h)
+				io.WriteString(pw, p.content)
+			}
+			w.Close()
+			r, flag, al := testRequest(t, c, "POST", "/", w.FormDataContentType(), b.String())
+			sanitizingPOST(r, c, flag)
+			raw, _ := readBody(r)
+			got := make(map[string]string)
+			mr := multipart.NewReader(bytes.NewReader(raw), w.Boundary())
+			for {
+				p, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("body %q: %v", raw, err)
+				}
+				content, _ := ioutil.ReadAll(p)
+				key := p.FormName()
+				if p.FileName() != "" {
+					key = p.FileName()
+				}
+				got[key] = string(content)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parts %v, want %v", got, tt.want)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestSanitizingMultipartInvalid(t *testing.T) {
+	c := testConfig(t, "form_params:\n  bio:\n    type: text\n")
+	r, flag, _ := testRequest(t, c, "POST", "/", "multipart/form-data; boundary=xyz", "--abc\r\nnot a part")
+	sanitizingPOST(r, c, flag)
+	if raw, _ := readBody(r); len(raw) != 0 {
+		t.Errorf("invalid body forwarded: %q", raw)
+	}
+}
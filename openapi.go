@@ -0,0 +1,611 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/maps"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/confmap"
+)
+
+// openAPISpec is a parsed OpenAPI 3 document reduced to what request
+// validation needs.
+type openAPISpec struct {
+	doc  map[string]interface{} // the whole document, for resolving $ref
+	base string                 // path of the first servers entry, e.g. "/v1"
+	ops  []*openAPIOperation
+}
+
+// openAPIOperation is one method of one path template.
+type openAPIOperation struct {
+	id       string // operationId, or "METHOD template" when the spec has none
+	method   string
+	template string
+	segs     []*regexp.Regexp // one per path segment; literal segments are quoted
+	literals int              // number of segments without parameters
+	params   []openAPIParam
+	body     map[string]interface{} // requestBody object; nil when none is declared
+	rules    *koanf.Koanf           // form_params derived from parameter and body schemas
+}
+
+// openAPIParam is a path, query or header parameter. Cookie parameters are
+// left to the cookie sanitizer.
+type openAPIParam struct {
+	name     string
+	in       string
+	required bool
+	explode  bool
+	schema   interface{}
+}
+
+// openAPISpecs caches parsed specs by file name.
+var openAPISpecs sync.Map
+
+func loadOpenAPI(name string) (*openAPISpec, error) {
+	v, err := loadWatchedFile(&openAPISpecs, name, "openapi", parseOpenAPI)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*openAPISpec), nil
+}
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"}
+
+// parseOpenAPI parses a JSON or YAML OpenAPI 3 document.
+func parseOpenAPI(b []byte) (interface{}, error) {
+	// YAML is a superset of JSON, so one parser handles both. The result is
+	// round-tripped through JSON so numbers become json.Number, as the schema
+	// validator expects.
+	raw, err := yaml.Parser().Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	maps.IntfaceKeysToStrings(raw)
+	js, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	v, err := decodeJSONNumbers(js)
+	if err != nil {
+		return nil, err
+	}
+	doc, _ := v.(map[string]interface{})
+	if version, _ := doc["openapi"].(string); !strings.HasPrefix(version, "3.") {
+		return nil, fmt.Errorf("not an OpenAPI 3 document (openapi: %q)", version)
+	}
+
+	spec := &openAPISpec{doc: doc}
+	if servers, ok := doc["servers"].([]interface{}); ok && len(servers) > 0 {
+		if server, ok := servers[0].(map[string]interface{}); ok {
+			if u, err := url.Parse(fmt.Sprint(server["url"])); err == nil && !strings.Contains(u.Path, "{") {
+				spec.base = strings.TrimSuffix(u.Path, "/")
+			}
+		}
+	}
+
+	paths, _ := doc["paths"].(map[string]interface{})
+	templates := make([]string, 0, len(paths))
+	for t := range paths {
+		templates = append(templates, t)
+	}
+	sort.Strings(templates)
+	for _, t := range templates {
+		item, _ := resolveOpenAPIRef(doc, paths[t]).(map[string]interface{})
+		common := openAPIParams(doc, item["parameters"])
+		for _, m := range openAPIMethods {
+			opObj, ok := item[m].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			op, err := newOpenAPIOperation(doc, strings.ToUpper(m), t, opObj, common)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %v", strings.ToUpper(m), t, err)
+			}
+			spec.ops = append(spec.ops, op)
+		}
+	}
+	return spec, nil
+}
+
+func newOpenAPIOperation(doc map[string]interface{}, method, template string, obj map[string]interface{}, common []openAPIParam) (*openAPIOperation, error) {
+	op := &openAPIOperation{method: method, template: template}
+	op.id, _ = obj["operationId"].(string)
+	if op.id == "" {
+		op.id = method + " " + template
+	}
+	for _, seg := range strings.Split(strings.Trim(template, "/"), "/") {
+		if !strings.Contains(seg, "{") {
+			op.literals++
+		}
+		re, err := cachedRegexp("^" + openAPITemplateParam.ReplaceAllStringFunc(regexp.QuoteMeta(seg), func(m string) string {
+			return "(?P<" + openAPIGroupName(m) + ">.+)"
+		}) + "$")
+		if err != nil {
+			return nil, err
+		}
+		op.segs = append(op.segs, re)
+	}
+
+	// Operation parameters override path-level ones with the same name and location.
+	own := openAPIParams(doc, obj["parameters"])
+	op.params = own
+	for _, c := range common {
+		overridden := false
+		for _, p := range own {
+			if p.name == c.name && p.in == c.in {
+				overridden = true
+			}
+		}
+		if !overridden {
+			op.params = append(op.params, c)
+		}
+	}
+	op.body, _ = resolveOpenAPIRef(doc, obj["requestBody"]).(map[string]interface{})
+
+	// Derive form_params rules from the query parameters and the top-level (or
+	// bracket-nested) properties of form and JSON body schemas.
+	rules := make(map[string]interface{})
+	for _, p := range op.params {
+		if p.in == "query" {
+			addOpenAPIRules(doc, rules, p.name, p.schema, 0)
+		}
+	}
+	if content, ok := op.body["content"].(map[string]interface{}); ok {
+		for media, v := range content {
+			if media != "application/x-www-form-urlencoded" && !isJSONContentType(media) {
+				continue
+			}
+			if mt, ok := v.(map[string]interface{}); ok {
+				addOpenAPIRules(doc, rules, "", mt["schema"], 0)
+			}
+		}
+	}
+	op.rules = koanf.New(".")
+	if err := op.rules.Load(confmap.Provider(map[string]interface{}{"form_params": rules}, ""), nil); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// openAPITemplateParam matches a quoted "{name}" in a path segment.
+var openAPITemplateParam = regexp.MustCompile(`\\\{[^}]*\\\}`)
+
+// openAPIGroupName turns a quoted "{name}" into a regexp group name. Names that
+// are not valid group names are hex-encoded and decoded again in matchSegments.
+func openAPIGroupName(quoted string) string {
+	name := strings.NewReplacer(`\{`, "", `\}`, "", `\`, "").Replace(quoted)
+	return fmt.Sprintf("p%x", name)
+}
+
+func openAPIParams(doc map[string]interface{}, v interface{}) []openAPIParam {
+	list, _ := v.([]interface{})
+	var params []openAPIParam
+	for _, entry := range list {
+		obj, ok := resolveOpenAPIRef(doc, entry).(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := openAPIParam{schema: obj["schema"]}
+		p.name, _ = obj["name"].(string)
+		p.in, _ = obj["in"].(string)
+		p.required, _ = obj["required"].(bool)
+		// Per the spec, form style (the query default) explodes by default.
+		style, _ := obj["style"].(string)
+		p.explode = p.in == "query" && (style == "" || style == "form")
+		if e, ok := obj["explode"].(bool); ok {
+			p.explode = e
+		}
+		if p.name == "" || p.in == "cookie" {
+			continue
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// resolveOpenAPIRef follows a {"$ref": "#/..."} object, if v is one.
+func resolveOpenAPIRef(doc map[string]interface{}, v interface{}) interface{} {
+	for i := 0; i < 16; i++ {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		ref, ok := obj["$ref"].(string)
+		if !ok {
+			return v
+		}
+		target, err := resolveSchemaRef(doc, ref)
+		if err != nil {
+			log.Printf("openapi: %v", err)
+			return nil
+		}
+		v = target
+	}
+	return v
+}
+
+// addOpenAPIRules adds a form_params rule for the value named name with the
+// given schema. Objects recurse into their properties as bracket names
+// ("user[email]") and arrays into their items ("tags[*]"); an empty name is the
+// body root.
+func addOpenAPIRules(doc map[string]interface{}, rules map[string]interface{}, name string, schema interface{}, depth int) {
+	s, ok := resolveOpenAPIRef(doc, schema).(map[string]interface{})
+	if !ok || depth > 8 {
+		return
+	}
+	child := func(n string) string {
+		if name == "" {
+			return n
+		}
+		return name + "[" + n + "]"
+	}
+	switch schemaTypeName(s) {
+	case "object":
+		props, _ := s["properties"].(map[string]interface{})
+		for n, ps := range props {
+			addOpenAPIRules(doc, rules, child(n), ps, depth+1)
+		}
+		return
+	case "array":
+		if name == "" {
+			return
+		}
+		// Query arrays arrive as repeated params ("tags=a&tags=b"), JSON arrays
+		// as indexed names ("tags[0]"); cover both.
+		items, _ := resolveOpenAPIRef(doc, s["items"]).(map[string]interface{})
+		if schemaTypeName(items) != "object" && schemaTypeName(items) != "array" {
+			if rule := openAPIScalarRule(items); rule != nil {
+				if n, ok := schemaInt(s["maxItems"]); ok {
+					rule["max_repeats"] = n
+				}
+				rules[name] = rule
+			}
+		}
+		addOpenAPIRules(doc, rules, child("*"), items, depth+1)
+		return
+	}
+	if name == "" || strings.Contains(name, ".") {
+		return
+	}
+	if rule := openAPIScalarRule(s); rule != nil {
+		rules[name] = rule
+	}
+}
+
+// openAPIScalarRule maps a scalar schema onto the closest form_params rule.
+func openAPIScalarRule(s map[string]interface{}) map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	rule := make(map[string]interface{})
+	switch schemaTypeName(s) {
+	case "integer":
+		rule["type"] = "integer"
+	case "number":
+		rule["type"] = "decimal"
+	case "boolean":
+		rule["type"] = "boolean"
+	case "string", "":
+		rule["type"] = "text"
+		switch s["format"] {
+		case "email":
+			rule["type"] = "email"
+		case "ipv4", "ipv6":
+			rule["type"] = "ip"
+		case "uri", "url":
+			rule["type"] = "url"
+		}
+		if n, ok := schemaInt(s["maxLength"]); ok {
+			rule["maxlen"] = n
+		}
+	default:
+		return nil
+	}
+	return rule
+}
+
+// schemaTypeName returns the type of a schema, ignoring "null" in type lists.
+func schemaTypeName(s map[string]interface{}) string {
+	switch t := s["type"].(type) {
+	case string:
+		return t
+	case []interface{}:
+		for _, x := range t {
+			if name, ok := x.(string); ok && name != "null" {
+				return name
+			}
+		}
+	}
+	if _, ok := s["properties"]; ok {
+		return "object"
+	}
+	return ""
+}
+
+// openAPIRule builds the effective rule for a name matched by an
+// operation-derived entry at key. The derived type and limits are layered over
+// the _defaults_ rule (route first, then global), so the text filters
+// configured there keep applying to spec-described values.
+func openAPIRule(k, route, rules *koanf.Koanf, key string) (*koanf.Koanf, string, bool) {
+	rk := koanf.New(".")
+	for _, src := range []*koanf.Koanf{k, route} {
+		if src != nil && src.Exists("form_params._defaults_") {
+			rk.MergeAt(src.Cut("form_params._defaults_"), "openapi_rule")
+		}
+	}
+	rk.MergeAt(rules.Cut("form_params."+key), "openapi_rule")
+	return rk, "openapi_rule", true
+}
+
+// matchOpenAPIOperation finds the operation declared for method and the
+// escaped request path in the configured spec. The path is split before each
+// segment is unescaped, once, so %2F stays inside its segment. Templates with
+// more literal segments win, so /users/me is preferred over /users/{id}. It
+// returns nil when the spec cannot be loaded or declares no such operation.
+func matchOpenAPIOperation(k *koanf.Koanf, method, escapedPath string) (*openAPIOperation, map[string]string) {
+	spec, err := loadOpenAPI(k.String("openapi.file"))
+	if err != nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(escapedPath, spec.base+"/") && escapedPath != spec.base {
+		return nil, nil
+	}
+	segs := strings.Split(strings.Trim(strings.TrimPrefix(escapedPath, spec.base), "/"), "/")
+	for i, seg := range segs {
+		if segs[i], err = url.PathUnescape(seg); err != nil {
+			return nil, nil
+		}
+	}
+	var best *openAPIOperation
+	var bestParams map[string]string
+	for _, op := range spec.ops {
+		if op.method != method || len(op.segs) != len(segs) || (best != nil && op.literals <= best.literals) {
+			continue
+		}
+		if params, ok := matchSegments(op.segs, segs); ok {
+			best, bestParams = op, params
+		}
+	}
+	return best, bestParams
+}
+
+func matchSegments(res []*regexp.Regexp, segs []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, re := range res {
+		m := re.FindStringSubmatch(segs[i])
+		if m == nil {
+			return nil, false
+		}
+		for j, group := range re.SubexpNames() {
+			if group == "" {
+				continue
+			}
+			var name []byte
+			fmt.Sscanf(group[1:], "%x", &name)
+			params[string(name)] = m[j]
+		}
+	}
+	return params, true
+}
+
+// openAPIError is one violation of the spec, located by where in the request it
+// was found.
+type openAPIError struct {
+	location string // "request", "path", "query", "header" or "body"
+	field    string
+	msg      string
+}
+
+// validatingOpenAPI enforces the operation declared in the openapi spec as a
+// positive security model: undeclared operations and query parameters are
+// rejected, and parameters and the request body must satisfy their schemas. It
+// runs after the sanitizers, so it sees what would be forwarded. In mode
+// reject (default) any error rejects the request; in mode audit errors are only
+// recorded.
+func validatingOpenAPI(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
+	if !k.Exists("openapi") {
+		return
+	}
+	name := k.String("openapi.file")
+	spec, err := loadOpenAPI(name)
+	if err != nil {
+		log.Printf("openapi: cannot load %s: %v; rejecting request", name, err)
+		if flag != nil {
+			flag.reject(fmt.Sprintf("openapi spec %s unavailable", name))
+		}
+		return
+	}
+
+	pol := policyFrom(req)
+	var errs []openAPIError
+	if pol.op == nil {
+		errs = []openAPIError{{"request", req.Method + " " + req.URL.Path, "operation is not declared in the spec"}}
+	} else {
+		errs = checkOpenAPIParams(spec, pol.op, req, pol.pathParams)
+		errs = append(errs, checkOpenAPIBody(spec, pol.op, req)...)
+	}
+	if len(errs) == 0 {
+		return
+	}
+
+	op := "-"
+	if pol.op != nil {
+		op = pol.op.id
+	}
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	for _, e := range errs {
+		log.Printf("openapi %s: %s %s: %s", op, e.location, e.field, e.msg)
+		if al != nil {
+			al.add("openapi", e.field, e.location)
+		}
+	}
+	if k.String("openapi.mode") != "audit" && flag != nil {
+		flag.reject(fmt.Sprintf("request violated openapi operation %s: %s %s: %s", op, errs[0].location, errs[0].field, errs[0].msg))
+	}
+}
+
+func checkOpenAPIParams(spec *openAPISpec, op *openAPIOperation, req *http.Request, pathParams map[string]string) []openAPIError {
+	var errs []openAPIError
+	query := make(map[string][]string)
+	var queryNames []string
+	for _, fp := range parseFormPairs(req.URL.RawQuery) {
+		if fp.blank || fp.drop {
+			continue
+		}
+		if _, ok := query[fp.name]; !ok {
+			queryNames = append(queryNames, fp.name)
+		}
+		query[fp.name] = append(query[fp.name], fp.value)
+	}
+
+	declared := make(map[string]bool)
+	for _, p := range op.params {
+		var values []string
+		switch p.in {
+		case "path":
+			if v, ok := pathParams[p.name]; ok {
+				values = []string{v}
+			}
+		case "query":
+			declared[p.name] = true
+			values = query[p.name]
+		case "header":
+			values = req.Header.Values(p.name)
+		}
+		if len(values) == 0 {
+			if p.required {
+				errs = append(errs, openAPIError{p.in, p.name, "required parameter is missing"})
+			}
+			continue
+		}
+		instance := coerceOpenAPIParam(spec.doc, p.schema, values, p.explode)
+		v := &schemaValidator{root: spec.doc}
+		v.validate(p.schema, instance, nil)
+		for _, e := range v.errs {
+			errs = append(errs, openAPIError{p.in, p.name + strings.TrimPrefix(e.path, "$"), e.msg})
+		}
+	}
+	for _, name := range queryNames {
+		if !declared[name] {
+			errs = append(errs, openAPIError{"query", name, "parameter is not declared"})
+		}
+	}
+	return errs
+}
+
+// coerceOpenAPIParam converts the raw string values of a parameter into the
+// JSON value its schema describes, so it can be validated like a body value.
+// Values that do not parse as the declared type stay strings and fail the
+// type check.
+func coerceOpenAPIParam(doc map[string]interface{}, schema interface{}, values []string, explode bool) interface{} {
+	s, _ := resolveOpenAPIRef(doc, schema).(map[string]interface{})
+	if schemaTypeName(s) == "array" {
+		if len(values) == 1 && !explode {
+			values = strings.Split(values[0], ",")
+		}
+		items, _ := resolveOpenAPIRef(doc, s["items"]).(map[string]interface{})
+		out := make([]interface{}, len(values))
+		for i, v := range values {
+			out[i] = coerceOpenAPIScalar(items, v)
+		}
+		return out
+	}
+	return coerceOpenAPIScalar(s, values[0])
+}
+
+func coerceOpenAPIScalar(s map[string]interface{}, v string) interface{} {
+	switch schemaTypeName(s) {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(v, 64); err == nil && json.Valid([]byte(v)) {
+			return json.Number(v)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil && (v == "true" || v == "false") {
+			return b
+		}
+	}
+	return v
+}
+
+func checkOpenAPIBody(spec *openAPISpec, op *openAPIOperation, req *http.Request) []openAPIError {
+	body, _ := readBody(req)
+	if op.body == nil {
+		if len(body) > 0 {
+			return []openAPIError{{"body", "", "operation does not take a request body"}}
+		}
+		return nil
+	}
+	if len(body) == 0 {
+		if required, _ := op.body["required"].(bool); required {
+			return []openAPIError{{"body", "", "required request body is missing"}}
+		}
+		return nil
+	}
+
+	media, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	content, _ := op.body["content"].(map[string]interface{})
+	var mt map[string]interface{}
+	for _, key := range []string{media, strings.SplitN(media, "/", 2)[0] + "/*", "*/*"} {
+		if m, ok := content[key].(map[string]interface{}); ok {
+			mt = m
+			break
+		}
+	}
+	if mt == nil {
+		return []openAPIError{{"body", "", fmt.Sprintf("media type %q is not declared", media)}}
+	}
+	schema, ok := mt["schema"]
+	if !ok {
+		return nil
+	}
+
+	var instance interface{}
+	switch {
+	case isJSONContentType(media):
+		v, err := decodeJSONNumbers(body)
+		if err != nil {
+			return []openAPIError{{"body", "$", "body is not valid JSON"}}
+		}
+		instance = v
+	case media == "application/x-www-form-urlencoded":
+		instance = coerceOpenAPIForm(spec.doc, schema, string(body))
+	default:
+		return nil
+	}
+	v := &schemaValidator{root: spec.doc}
+	v.validate(schema, instance, nil)
+	var errs []openAPIError
+	for _, e := range v.errs {
+		errs = append(errs, openAPIError{"body", e.path, e.msg})
+	}
+	return errs
+}
+
+// coerceOpenAPIForm turns an urlencoded body into an object whose members are
+// coerced by the matching property schemas.
+func coerceOpenAPIForm(doc map[string]interface{}, schema interface{}, body string) map[string]interface{} {
+	s, _ := resolveOpenAPIRef(doc, schema).(map[string]interface{})
+	props, _ := s["properties"].(map[string]interface{})
+	values := make(map[string][]string)
+	for _, fp := range parseFormPairs(body) {
+		if !fp.blank && !fp.drop {
+			values[fp.name] = append(values[fp.name], fp.value)
+		}
+	}
+	obj := make(map[string]interface{})
+	for name, vs := range values {
+		obj[name] = coerceOpenAPIParam(doc, props[name], vs, true)
+	}
+	return obj
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAddOpenAPIRules(t *testing.T) {
+	doc, err := decodeJSONNumbers([]byte(`{
+		"components": {"schemas": {"Email": {"type": "string", "format": "email"}}},
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer"},
+			"price": {"type": ["number", "null"]},
+			"active": {"type": "boolean"},
+			"email": {"$ref": "#/components/schemas/Email"},
+			"site": {"type": "string", "format": "uri", "maxLength": 200},
+			"tags": {"type": "array", "maxItems": 3, "items": {"type": "string"}},
+			"ids": {"type": "array", "maxItems": 3, "items": {"type": "integer"}},
+			"user": {"type": "object", "properties": {"ip": {"type": "string", "format": "ipv4"}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	m := doc.(map[string]interface{})
+	rules := make(map[string]interface{})
+	addOpenAPIRules(m, rules, "", m, 0)
+	want := map[string]interface{}{
+		"id":       map[string]interface{}{"type": "integer"},
+		"price":    map[string]interface{}{"type": "decimal"},
+		"active":   map[string]interface{}{"type": "boolean"},
+		"email":    map[string]interface{}{"type": "email"},
+		"site":     map[string]interface{}{"type": "url", "maxlen": 200},
+		"tags":     map[string]interface{}{"type": "text", "max_repeats": 3},
+		"tags[*]":  map[string]interface{}{"type": "text"},
+		"ids":      map[string]interface{}{"type": "integer", "max_repeats": 3},
+		"ids[*]":   map[string]interface{}{"type": "integer"},
+		"user[ip]": map[string]interface{}{"type": "ip"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules\n%v\nwant\n%v", rules, want)
+	}
+}
+
+func TestValidatingOpenAPI(t *testing.T) {
+	spec := filepath.Join(t.TempDir(), "api.yaml")
+	err := ioutil.WriteFile(spec, []byte(`
+openapi: 3.0.3
+servers:
+  - url: https://api.example.com/v1
+paths:
+  /users/{id}:
+    parameters:
+      - {name: id, in: path, required: true, schema: {type: integer}}
+    get:
+      operationId: getUser
+      parameters:
+        - {name: fields, in: query, schema: {type: array, items: {type: string, enum: [name, email]}}, explode: false}
+    put:
+      operationId: updateUser
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              type: object
+              required: [email]
+              properties:
+                email: {type: string, format: email}
+                age: {type: integer, minimum: 0}
+  /users/me:
+    get:
+      operationId: getMe
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, mode, method, target, body string
+		fields                           []string // location:field of each error
+		rejected                         bool
+	}{
+		{"valid", "", "GET", "/v1/users/7?fields=name,email", "", nil, false},
+		{"literal template wins", "", "GET", "/v1/users/me", "", nil, false},
+		{"path type", "", "GET", "/v1/users/abc", "", []string{"path:id"}, true},
+		{"encoded path digit", "", "GET", "/v1/users/%37", "", nil, false},
+		{"encoded slash stays in segment", "", "GET", "/v1/users/7%2F8", "", []string{"path:id"}, true},
+		{"path decoded once", "", "GET", "/v1/users/%2537", "", []string{"path:id"}, true},
+		{"query enum", "", "GET", "/v1/users/7?fields=name,password", "", []string{"query:fields[1]"}, true},
+		{"undeclared query", "", "GET", "/v1/users/7?debug=1", "", []string{"query:debug"}, true},
+		{"undeclared operation", "", "DELETE", "/v1/users/7", "", []string{"request:DELETE /v1/users/7"}, true},
+		{"outside base path", "", "GET", "/users/7", "", []string{"request:GET /users/7"}, true},
+		{"valid body", "", "PUT", "/v1/users/7", `{"email": "a@example.com", "age": 3}`, nil, false},
+		{"body schema", "", "PUT", "/v1/users/7", `{"age": -1}`, []string{"body:$.email", "body:$.age"}, true},
+		{"missing body", "", "PUT", "/v1/users/7", "", []string{"body:"}, true},
+		{"audit mode", "audit", "DELETE", "/v1/users/7", "", []string{"request:DELETE /v1/users/7"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, "openapi:\n  file: "+spec+"\n  mode: "+tt.mode+"\n")
+			ct := ""
+			if tt.body != "" {
+				ct = "application/json"
+			}
+			r, flag, al := testRequest(t, c, tt.method, tt.target, ct, tt.body)
+			validatingOpenAPI(r, c, flag)
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+			var got []string
+			for _, e := range al.events {
+				got = append(got, e.Location+":"+e.Field)
+			}
+			if !reflect.DeepEqual(got, tt.fields) {
+				t.Errorf("errors %v, want %v", got, tt.fields)
+			}
+		})
+	}
+}
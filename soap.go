@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+const (
+	soap11Envelope = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Envelope = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// soapRequest is what identifyingSOAP learned about a request to a route with a
+// soap section.
+type soapRequest struct {
+	version string       // "1.1" or "1.2"; selects the fault format
+	action  string       // SOAPAction header (1.1) or action media type parameter (1.2), unquoted
+	body    xmlName      // first child of soap:Body; local is "" when the body is not a SOAP envelope
+	op      *koanf.Koanf // matched soap.operations entry, nil when none matched
+	// actionHeader is the header that carried exactly the action declared for
+	// the operation: SOAPAction, which sanitize_http_headers leaves alone, or
+	// Content-Type, of which it skips only the action parameter.
+	actionHeader string
+}
+
+// identifyingSOAP identifies the SOAP operation of a request to a route with a
+// soap section, from the first child element of soap:Body and from the
+// SOAPAction header (SOAP 1.1) or the action parameter of the
+// application/soap+xml content type (SOAP 1.2). The request is rejected when
+// the two disagree, when no operation can be identified, or when
+// soap.operations is set and does not list the operation. The matched entry's
+// xml_rules and form_params then take precedence over the route's.
+func identifyingSOAP(req *http.Request, k *koanf.Koanf, flag *blockFlag) {
+	pol := policyFrom(req)
+	if pol.route == nil || !pol.route.Exists("soap") {
+		return
+	}
+	sr := &soapRequest{version: "1.1"}
+	pol.soap = sr
+
+	media, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if media == "application/soap+xml" {
+		sr.version = "1.2"
+		sr.action = params["action"]
+	} else {
+		sr.action = strings.Trim(strings.TrimSpace(req.Header.Get("SOAPAction")), `"`)
+	}
+
+	body, _ := readBody(req)
+	if version, name, ok := soapBodyChild(body); ok {
+		sr.version, sr.body = version, name
+	}
+
+	al, _ := req.Context().Value(auditKey{}).(*auditLog)
+	fail := func(field, reason string) {
+		log.Printf("soap: %s %s: %s", req.Method, req.URL.Path, reason)
+		if al != nil {
+			al.add("soap", field, "body")
+		}
+		if flag != nil {
+			flag.reject(reason)
+		}
+	}
+	if sr.body.local == "" {
+		fail("operation", "request is not a SOAP envelope with a Body element")
+		return
+	}
+
+	soapCfg := pol.route.Cut("soap")
+	operations := soapCfg.Slices("operations")
+	for _, entry := range operations {
+		if entry.String("name") != sr.body.local {
+			continue
+		}
+		if ns := entry.String("namespace"); ns != "" && ns != sr.body.space {
+			continue
+		}
+		sr.op = entry
+		break
+	}
+	if len(operations) > 0 && sr.op == nil {
+		fail(sr.body.local, fmt.Sprintf("SOAP operation %q is not allowed", sr.body.local))
+		return
+	}
+
+	if sr.action == "" {
+		if soapCfg.Bool("require_action") {
+			fail("action", fmt.Sprintf("SOAP operation %q sent without an action", sr.body.local))
+		}
+		return
+	}
+	if !soapActionAgrees(sr.action, sr.body.local, sr.op) {
+		fail("action", fmt.Sprintf("SOAP action %q does not match body operation %q", sr.action, sr.body.local))
+		return
+	}
+	// Only the action declared for the operation is exempt from header
+	// sanitizing; one that merely ends in the operation name may carry
+	// anything before it.
+	if sr.op == nil || !sr.op.Exists("action") {
+		return
+	}
+	if sr.version == "1.2" && media == "application/soap+xml" {
+		sr.actionHeader = "Content-Type"
+	} else if values := req.Header.Values("SOAPAction"); len(values) == 1 {
+		if raw := strings.TrimSpace(values[0]); raw == sr.action || raw == `"`+sr.action+`"` {
+			sr.actionHeader = "Soapaction"
+		}
+	}
+}
+
+// cutActionParam cuts the action parameter out of a Content-Type value. It
+// returns the value without it and the parameter with its leading separator as
+// written ("; action=\"urn:example#Login\""), or value and "" when there is
+// none.
+func cutActionParam(value string) (rest, param string) {
+	start := -1 // index of the ';' opening the current parameter
+	quoted := false
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) {
+			switch c := value[i]; {
+			case c == '\\' && quoted:
+				i++
+				continue
+			case c == '"':
+				quoted = !quoted
+				continue
+			case c != ';' || quoted:
+				continue
+			}
+		}
+		if start >= 0 {
+			name := value[start+1 : i]
+			if eq := strings.IndexByte(name, '='); eq >= 0 && strings.EqualFold(strings.TrimSpace(name[:eq]), "action") {
+				return value[:start] + value[i:], value[start:i]
+			}
+		}
+		start = i
+	}
+	return value, ""
+}
+
+// soapActionAgrees reports whether an action names the body operation. When the
+// operations entry declares its action the two must be equal; otherwise the
+// last segment of the action URI ("http://tempuri.org/IService/Login",
+// "urn:example#Login") must equal the element name.
+func soapActionAgrees(action, name string, op *koanf.Koanf) bool {
+	if op != nil && op.Exists("action") {
+		return action == op.String("action")
+	}
+	last := action
+	if i := strings.LastIndexAny(action, "#/:"); i >= 0 {
+		last = action[i+1:]
+	}
+	return last == name
+}
+
+// soapBodyChild returns the SOAP version of an envelope and the name of the
+// first element inside its Body. ok is false when body is not a SOAP envelope.
+func soapBodyChild(body []byte) (version string, name xmlName, ok bool) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	inBody := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", xmlName{}, false
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1:
+				if t.Name.Local != "Envelope" {
+					return "", xmlName{}, false
+				}
+				switch t.Name.Space {
+				case soap11Envelope:
+					version = "1.1"
+				case soap12Envelope:
+					version = "1.2"
+				default:
+					return "", xmlName{}, false
+				}
+			case depth == 2 && t.Name.Local == "Body" && (t.Name.Space == soap11Envelope || t.Name.Space == soap12Envelope):
+				inBody = true
+			case depth == 3 && inBody:
+				return version, xmlName{local: t.Name.Local, space: t.Name.Space}, true
+			case depth == 2:
+				// Header: skip its content.
+				if err := dec.Skip(); err != nil {
+					return "", xmlName{}, false
+				}
+				depth--
+			}
+		case xml.EndElement:
+			if depth == 2 && inBody {
+				// Empty Body.
+				return "", xmlName{}, false
+			}
+			depth--
+		}
+	}
+}
+
+// soapFault builds the fault returned instead of a plain 403 when a SOAP
+// request is blocked: a SOAP 1.1 Client fault with status 500, as the 1.1 HTTP
+// binding requires, or a SOAP 1.2 Sender fault with status 400. The reason is
+// not disclosed.
+func soapFault(version string) (int, string, string) {
+	if version == "1.2" {
+		return http.StatusBadRequest, "application/soap+xml; charset=utf-8", `<?xml version="1.0" encoding="UTF-8"?>
+<env:Envelope xmlns:env="` + soap12Envelope + `"><env:Body><env:Fault><env:Code><env:Value>env:Sender</env:Value></env:Code><env:Reason><env:Text xml:lang="en">Forbidden</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>
+`
+	}
+	return http.StatusInternalServerError, "text/xml; charset=utf-8", `<?xml version="1.0" encoding="UTF-8"?>
+<soap:Envelope xmlns:soap="` + soap11Envelope + `"><soap:Body><soap:Fault><faultcode>soap:Client</faultcode><faultstring>Forbidden</faultstring></soap:Fault></soap:Body></soap:Envelope>
+`
+}
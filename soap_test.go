@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCutActionParam(t *testing.T) {
+	tests := []struct{ value, rest, param string }{
+		{`application/soap+xml; charset=utf-8; action="urn:example#Login"`, `application/soap+xml; charset=utf-8`, `; action="urn:example#Login"`},
+		{`application/soap+xml;action="urn:a;b";charset=utf-8`, `application/soap+xml;charset=utf-8`, `;action="urn:a;b"`},
+		{`application/soap+xml; ACTION=urn:x`, `application/soap+xml`, `; ACTION=urn:x`},
+		{`application/soap+xml; charset="a\"; action=x"`, `application/soap+xml; charset="a\"; action=x"`, ``},
+		{`application/soap+xml; charset=utf-8`, `application/soap+xml; charset=utf-8`, ``},
+		{`action=x`, `action=x`, ``},
+	}
+	for _, tt := range tests {
+		rest, param := cutActionParam(tt.value)
+		if rest != tt.rest || param != tt.param {
+			t.Errorf("%s: got %q %q, want %q %q", tt.value, rest, param, tt.rest, tt.param)
+		}
+	}
+}
+
+func TestSOAPActionAgrees(t *testing.T) {
+	op := testConfig(t, "action: urn:example:auth#Login\n")
+	tests := []struct {
+		action, name string
+		declared     bool
+		want         bool
+	}{
+		{"http://tempuri.org/IService/Login", "Login", false, true},
+		{"urn:example#Login", "Login", false, true},
+		{"urn:example:Login", "Login", false, true},
+		{"urn:example#Logout", "Login", false, false},
+		{"urn:example:auth#Login", "Login", true, true},
+		{"urn:other#Login", "Login", true, false},
+	}
+	for _, tt := range tests {
+		o := op
+		if !tt.declared {
+			o = nil
+		}
+		if got := soapActionAgrees(tt.action, tt.name, o); got != tt.want {
+			t.Errorf("%s for %s: got %v", tt.action, tt.name, got)
+		}
+	}
+}
+
+const soapTestConfig = `
+sanitize_xml_body: true
+sanitize_http_headers:
+  strip_quotation: true
+  strip_html: true
+routes:
+  - path: /service
+    soap:
+      require_action: true
+      operations:
+        - name: Login
+          namespace: urn:example:auth
+          action: "urn:example:auth#Login"
+        - name: GetBalance
+`
+
+func soapEnvelope(ns, op string) string {
+	return `<?xml version="1.0"?><s:Envelope xmlns:s="` + ns + `"><s:Header><x/></s:Header>` +
+		`<s:Body><a:` + op + ` xmlns:a="urn:example:auth"><a:user>bob</a:user></a:` + op + `></s:Body></s:Envelope>`
+}
+
+func TestIdentifyingSOAP(t *testing.T) {
+	c := testConfig(t, soapTestConfig)
+	tests := []struct {
+		name, contentType, soapAction, body string
+		version                             string
+		rejected                            bool
+	}{
+		{"1.1", "text/xml", `"urn:example:auth#Login"`, soapEnvelope(soap11Envelope, "Login"), "1.1", false},
+		{"1.2", `application/soap+xml; action="urn:example:auth#Login"`, "", soapEnvelope(soap12Envelope, "Login"), "1.2", false},
+		{"action mismatch", "text/xml", `"urn:example:auth#GetBalance"`, soapEnvelope(soap11Envelope, "Login"), "1.1", true},
+		{"missing action", "text/xml", "", soapEnvelope(soap11Envelope, "Login"), "1.1", true},
+		{"unlisted operation", "text/xml", `"urn:x#Delete"`, soapEnvelope(soap11Envelope, "Delete"), "1.1", true},
+		{"not an envelope", "text/xml", `"urn:x#Login"`, `<Login/>`, "1.1", true},
+		{"1.2 envelope", "application/soap+xml", "", soapEnvelope(soap12Envelope, "GetBalance"), "1.2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, flag, _ := testRequest(t, c, "POST", "/service", tt.contentType, tt.body)
+			if tt.soapAction != "" {
+				r.Header.Set("SOAPAction", tt.soapAction)
+			}
+			identifyingSOAP(r, c, flag)
+			sr := policyFrom(r).soap
+			if sr == nil || sr.version != tt.version {
+				t.Fatalf("soap request %+v, want version %s", sr, tt.version)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestSOAPActionHeaderSanitizing(t *testing.T) {
+	c := testConfig(t, soapTestConfig)
+	tests := []struct {
+		name, contentType, soapAction string
+		body                          string
+		wantContentType, wantAction   string
+	}{
+		{
+			name:            "1.1 SOAPAction is kept",
+			contentType:     "text/xml; charset=utf-8",
+			soapAction:      `"urn:example:auth#Login"`,
+			body:            soapEnvelope(soap11Envelope, "Login"),
+			wantContentType: "text/xml; charset=utf-8",
+			wantAction:      `"urn:example:auth#Login"`,
+		},
+		{
+			name:            "1.2 action parameter is kept",
+			contentType:     `application/soap+xml; charset=utf-8; action="urn:example:auth#Login"`,
+			body:            soapEnvelope(soap12Envelope, "Login"),
+			wantContentType: `application/soap+xml; charset=utf-8; action="urn:example:auth#Login"`,
+		},
+		{
+			name:            "1.2 rest of Content-Type is sanitized",
+			contentType:     `application/soap+xml; action="urn:example:auth#Login"; x="<script>alert(1)</script>"`,
+			body:            soapEnvelope(soap12Envelope, "Login"),
+			wantContentType: `application/soap+xml; x=alert(1); action="urn:example:auth#Login"`,
+		},
+		{
+			name:            "unverified SOAPAction is sanitized",
+			contentType:     `application/soap+xml; action="urn:example:auth#Login"`,
+			soapAction:      `"<b>x</b>"`,
+			body:            soapEnvelope(soap12Envelope, "Login"),
+			wantContentType: `application/soap+xml; action="urn:example:auth#Login"`,
+			wantAction:      `"x"`,
+		},
+		{
+			name:            "undeclared SOAPAction is sanitized",
+			contentType:     "text/xml",
+			soapAction:      `"urn:<b>x</b>#GetBalance"`,
+			body:            soapEnvelope(soap11Envelope, "GetBalance"),
+			wantContentType: "text/xml",
+			wantAction:      `"urn:x#GetBalance"`,
+		},
+		{
+			name:            "undeclared SOAPAction keeps its quotes",
+			contentType:     "text/xml",
+			soapAction:      `"urn:example#GetBalance"`,
+			body:            soapEnvelope(soap11Envelope, "GetBalance"),
+			wantContentType: "text/xml",
+			wantAction:      `"urn:example#GetBalance"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, flag, _ := testRequest(t, c, "POST", "/service", tt.contentType, tt.body)
+			if tt.soapAction != "" {
+				r.Header.Set("SOAPAction", tt.soapAction)
+			}
+			identifyingSOAP(r, c, flag)
+			if flag.triggered {
+				t.Fatalf("rejected: %s", flag.reason)
+			}
+			sanitizingIncomingHeaders(r, c, flag)
+			if got := r.Header.Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type %q, want %q", got, tt.wantContentType)
+			}
+			if got := r.Header.Get("SOAPAction"); got != tt.wantAction {
+				t.Errorf("SOAPAction %q, want %q", got, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestSOAPFault(t *testing.T) {
+	status, ct, body := soapFault("1.2")
+	if status != 400 || !strings.HasPrefix(ct, "application/soap+xml") || !strings.Contains(body, "env:Sender") {
+		t.Errorf("1.2 fault: %d %s %s", status, ct, body)
+	}
+	status, ct, body = soapFault("1.1")
+	if status != 500 || !strings.HasPrefix(ct, "text/xml") || !strings.Contains(body, "soap:Client") {
+		t.Errorf("1.1 fault: %d %s %s", status, ct, body)
+	}
+}
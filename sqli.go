@@ -0,0 +1,559 @@
+package main
+
+import (
+	"strings"
+)
+
+// sqlToken is one token of the SQL tokenizer. Types are single letters so a
+// token sequence reads as a fingerprint, in the style of libinjection:
+//
+//	s string     1 number      n name        v variable (@x, @@x)
+//	k keyword    E statement   U union       f function (name followed by '(')
+//	& and/or     o operator    c comment     X MySQL executable comment (/*!)
+//	; ( ) , .    punctuation
+type sqlToken struct {
+	typ    byte
+	val    string // lower-cased text; string contents for s
+	closed bool   // s: the closing quote was found
+	hex    bool   // 1: hexadecimal or binary literal
+}
+
+var sqlStatements = map[string]bool{
+	"select": true, "insert": true, "update": true, "delete": true, "drop": true,
+	"create": true, "alter": true, "truncate": true, "replace": true, "exec": true,
+	"execute": true, "declare": true, "shutdown": true, "grant": true, "revoke": true,
+	"merge": true, "call": true, "rename": true, "handler": true,
+}
+
+var sqlKeywords = map[string]bool{
+	"from": true, "where": true, "into": true, "values": true, "table": true,
+	"set": true, "having": true, "group": true, "order": true, "by": true,
+	"limit": true, "offset": true, "join": true, "inner": true, "outer": true,
+	"left": true, "right": true, "on": true, "as": true, "case": true,
+	"when": true, "then": true, "else": true, "end": true, "waitfor": true,
+	"delay": true, "procedure": true, "outfile": true, "dumpfile": true,
+	"all": true, "distinct": true, "top": true, "asc": true, "desc": true,
+	"collate": true, "exists": true, "begin": true, "commit": true,
+	"rollback": true, "database": true, "schema": true, "column": true,
+}
+
+var sqlLogic = map[string]bool{"and": true, "or": true, "xor": true, "&&": true, "||": true}
+
+var sqlWordOperators = map[string]bool{
+	"like": true, "rlike": true, "regexp": true, "is": true, "not": true,
+	"in": true, "between": true, "div": true, "mod": true, "sounds": true,
+}
+
+var sqlValues = map[string]bool{"null": true, "true": true, "false": true}
+
+// sqlClauseKeywords follow a closed string or number in ORDER BY / GROUP BY /
+// UNION probing and similar clause injection.
+var sqlClauseKeywords = map[string]bool{
+	"order": true, "group": true, "having": true, "limit": true, "procedure": true,
+	"into": true, "where": true, "from": true,
+}
+
+// sqlStatementObjects are the keywords that may directly follow a statement
+// keyword (DROP TABLE, SELECT DISTINCT, DELETE FROM).
+var sqlStatementObjects = map[string]bool{
+	"table": true, "database": true, "schema": true, "from": true, "into": true,
+	"all": true, "distinct": true, "top": true, "procedure": true, "column": true,
+}
+
+// sqlDangerousFunctions delay the response, read files or run commands; their
+// presence in an expression is strong evidence on its own.
+var sqlDangerousFunctions = map[string]bool{
+	"sleep": true, "benchmark": true, "pg_sleep": true, "load_file": true,
+	"extractvalue": true, "updatexml": true, "xp_cmdshell": true,
+	"dbms_pipe.receive_message": true, "randomblob": true, "utl_inaddr.get_host_address": true,
+	"utl_http.request": true, "sys_eval": true, "sys_exec": true, "dbms_lock.sleep": true,
+}
+
+func isSQLSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f', 0xa0:
+		return true
+	}
+	return false
+}
+
+func isSQLWordChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// sqlTokenizer splits a value into SQL tokens. quote is the string literal
+// the value is assumed to start inside of (0, '\” or '"'): a value written
+// into a quoted SQL string begins with the tail of that string.
+type sqlTokenizer struct {
+	src        string
+	pos        int
+	toks       []sqlToken
+	obfuscated bool // a block comment split a word (UN/**/ION)
+}
+
+func tokenizeSQL(src string, quote byte) ([]sqlToken, bool) {
+	t := &sqlTokenizer{src: src}
+	if quote != 0 {
+		t.str(quote)
+	}
+	for t.pos < len(t.src) {
+		t.next()
+	}
+	return t.toks, t.obfuscated
+}
+
+func (t *sqlTokenizer) emit(typ byte, val string) {
+	t.toks = append(t.toks, sqlToken{typ: typ, val: val})
+}
+
+// str reads a string literal whose opening quote is before pos.
+func (t *sqlTokenizer) str(quote byte) {
+	var b strings.Builder
+	for t.pos < len(t.src) {
+		c := t.src[t.pos]
+		switch {
+		case c == '\\' && t.pos+1 < len(t.src):
+			b.WriteByte(t.src[t.pos+1])
+			t.pos += 2
+			continue
+		case c == quote && t.pos+1 < len(t.src) && t.src[t.pos+1] == quote:
+			b.WriteByte(quote)
+			t.pos += 2
+			continue
+		case c == quote:
+			t.pos++
+			t.toks = append(t.toks, sqlToken{typ: 's', val: b.String(), closed: true})
+			return
+		}
+		b.WriteByte(c)
+		t.pos++
+	}
+	t.toks = append(t.toks, sqlToken{typ: 's', val: b.String()})
+}
+
+func (t *sqlTokenizer) next() {
+	src := t.src
+	c := src[t.pos]
+	switch {
+	case isSQLSpace(c):
+		t.pos++
+	case c == '\'' || c == '"':
+		t.pos++
+		t.str(c)
+	case c == '`':
+		// Quoted identifier.
+		end := strings.IndexByte(src[t.pos+1:], '`')
+		if end < 0 {
+			end = len(src) - t.pos - 1
+		}
+		t.emit('n', strings.ToLower(src[t.pos+1:t.pos+1+end]))
+		t.pos += end + 2
+	case c == '#' || (c == '-' && strings.HasPrefix(src[t.pos:], "--")):
+		t.emit('c', "--")
+		if i := strings.IndexAny(src[t.pos:], "\r\n"); i >= 0 {
+			t.pos += i
+		} else {
+			t.pos = len(src)
+		}
+	case strings.HasPrefix(src[t.pos:], "/*"):
+		end := strings.Index(src[t.pos+2:], "*/")
+		if strings.HasPrefix(src[t.pos:], "/*!") {
+			// MySQL runs the content of /*! ... */ as code.
+			t.emit('X', "/*!")
+		}
+		if end < 0 {
+			t.emit('c', "/*")
+			t.pos = len(src)
+			return
+		}
+		start := t.pos
+		t.pos += end + 4
+		// A block comment is whitespace to the server; one that splits a
+		// word in two is obfuscation.
+		if start > 0 && t.pos < len(src) && isSQLWordChar(src[start-1]) && isSQLWordChar(src[t.pos]) {
+			t.obfuscated = true
+			if n := len(t.toks); n > 0 && (t.toks[n-1].typ == 'n' || t.toks[n-1].typ == 'k' || t.toks[n-1].typ == 'E' || t.toks[n-1].typ == 'U') {
+				prev := t.toks[n-1].val
+				t.toks = t.toks[:n-1]
+				t.word(prev)
+			}
+		}
+	case c >= '0' && c <= '9' || (c == '.' && t.pos+1 < len(src) && src[t.pos+1] >= '0' && src[t.pos+1] <= '9'):
+		t.number()
+	case c == '@':
+		start := t.pos
+		t.pos++
+		if t.pos < len(src) && src[t.pos] == '@' {
+			t.pos++
+		}
+		for t.pos < len(src) && (isSQLWordChar(src[t.pos]) || src[t.pos] == '.') {
+			t.pos++
+		}
+		t.emit('v', strings.ToLower(src[start:t.pos]))
+	case isSQLWordChar(c):
+		t.word("")
+	case c == ';' || c == '(' || c == ')' || c == ',' || c == '.':
+		t.emit(c, string(c))
+		t.pos++
+	default:
+		// Operators, longest match first.
+		for _, op := range []string{"<=>", "<>", "!=", "<=", ">=", "||", "&&", "<<", ">>", ":="} {
+			if strings.HasPrefix(src[t.pos:], op) {
+				t.pos += len(op)
+				if sqlLogic[op] {
+					t.emit('&', op)
+				} else {
+					t.emit('o', op)
+				}
+				return
+			}
+		}
+		if strings.IndexByte("=<>!+-*/%^|&~:", c) >= 0 {
+			t.emit('o', string(c))
+		}
+		t.pos++
+	}
+}
+
+func (t *sqlTokenizer) number() {
+	src := t.src
+	start := t.pos
+	if src[t.pos] == '0' && t.pos+1 < len(src) && strings.IndexByte("xXbB", src[t.pos+1]) >= 0 {
+		t.pos += 2
+		for t.pos < len(src) && isSQLWordChar(src[t.pos]) {
+			t.pos++
+		}
+		t.toks = append(t.toks, sqlToken{typ: '1', val: strings.ToLower(src[start:t.pos]), hex: true})
+		return
+	}
+	for t.pos < len(src) && (src[t.pos] >= '0' && src[t.pos] <= '9' || src[t.pos] == '.' ||
+		((src[t.pos] == 'e' || src[t.pos] == 'E') && t.pos+1 < len(src) && (src[t.pos+1] >= '0' && src[t.pos+1] <= '9' || src[t.pos+1] == '-' || src[t.pos+1] == '+'))) {
+		if src[t.pos] == 'e' || src[t.pos] == 'E' {
+			t.pos++
+		}
+		t.pos++
+	}
+	if t.pos < len(src) && isSQLWordChar(src[t.pos]) {
+		// 1abc is a name in MySQL.
+		for t.pos < len(src) && isSQLWordChar(src[t.pos]) {
+			t.pos++
+		}
+		t.emit('n', strings.ToLower(src[start:t.pos]))
+		return
+	}
+	t.emit('1', src[start:t.pos])
+}
+
+// word reads a bare word, prefixed by prefix (the first half of a word split
+// by a comment), and classifies it.
+func (t *sqlTokenizer) word(prefix string) {
+	src := t.src
+	start := t.pos
+	for t.pos < len(src) && isSQLWordChar(src[t.pos]) {
+		t.pos++
+	}
+	// Qualified function names (dbms_lock.sleep).
+	w := prefix + strings.ToLower(src[start:t.pos])
+	if t.pos < len(src) && src[t.pos] == '.' {
+		j := t.pos + 1
+		for j < len(src) && isSQLWordChar(src[j]) {
+			j++
+		}
+		if q := w + strings.ToLower(src[t.pos:j]); sqlDangerousFunctions[q] {
+			w, t.pos = q, j
+		}
+	}
+	j := t.pos
+	for j < len(src) && isSQLSpace(src[j]) {
+		j++
+	}
+	followedByParen := j < len(src) && src[j] == '('
+	switch {
+	case w == "union":
+		t.emit('U', w)
+	case sqlStatements[w]:
+		t.emit('E', w)
+	case sqlLogic[w]:
+		t.emit('&', w)
+	case sqlWordOperators[w]:
+		t.emit('o', w)
+	case sqlValues[w]:
+		t.emit('1', w)
+	case followedByParen && !sqlKeywords[w]:
+		t.emit('f', w)
+	case sqlKeywords[w]:
+		t.emit('k', w)
+	default:
+		t.emit('n', w)
+	}
+}
+
+func isSQLValue(typ byte) bool {
+	return typ == '1' || typ == 'n' || typ == 's' || typ == 'v'
+}
+
+func isSQLArithmetic(op string) bool {
+	switch op {
+	case "+", "-", "*", "/", "%", "^", "|", "&", "<<", ">>", "div", "mod":
+		return true
+	}
+	return false
+}
+
+// foldSQL simplifies a token sequence so equivalent expressions share a
+// fingerprint: adjacent strings concatenate, unary signs disappear, arithmetic
+// between values folds into one value, (value) into the value and name.name
+// into one name. It folds in one pass, keeping the folded prefix as a stack,
+// so nested parentheses and runs of signs take linear time.
+func foldSQL(toks []sqlToken) []sqlToken {
+	out := make([]sqlToken, 0, len(toks))
+	for i := 0; i < len(toks); i++ {
+		tk := toks[i]
+		// Concatenate a run of strings before it takes part in arithmetic.
+		for tk.typ == 's' && i+1 < len(toks) && toks[i+1].typ == 's' {
+			i++
+			tk.closed = toks[i].closed
+		}
+		out = pushSQL(out, tk)
+	}
+	return out
+}
+
+// pushSQL appends tk to the folded tokens out, folding it with the tokens
+// before it as long as a fold applies.
+func pushSQL(out []sqlToken, tk sqlToken) []sqlToken {
+	for {
+		n := len(out)
+		switch {
+		case tk.typ == 's' && n > 0 && out[n-1].typ == 's':
+			out[n-1].closed = tk.closed
+			return out
+		case tk.typ == 'n' && n > 1 && out[n-1].typ == '.' && out[n-2].typ == 'n':
+			return out[:n-1]
+		case tk.typ == ')' && n > 1 && isSQLValue(out[n-1].typ) && out[n-2].typ == '(' &&
+			(n == 2 || out[n-3].typ != 'f'):
+			// (value) becomes the value, which may fold further.
+			tk = out[n-1]
+			out = out[:n-2]
+			continue
+		case (isSQLValue(tk.typ) || tk.typ == 'f' || tk.typ == '(') && n > 0 && isSQLUnary(out[n-1]) &&
+			(n == 1 || strings.IndexByte("o&(,kE;", out[n-2].typ) >= 0):
+			out = out[:n-1]
+			continue
+		case isSQLValue(tk.typ) && n > 1 && out[n-1].typ == 'o' && isSQLArithmetic(out[n-1].val) && isSQLValue(out[n-2].typ):
+			left := out[n-2]
+			left.hex = left.hex || tk.hex
+			tk = left
+			out = out[:n-2]
+			continue
+		}
+		return append(out, tk)
+	}
+}
+
+func isSQLUnary(tk sqlToken) bool {
+	return tk.typ == 'o' && (tk.val == "-" || tk.val == "+" || tk.val == "~" || tk.val == "!" || tk.val == "not")
+}
+
+// sqlStatementFollows reports whether the statement keyword at toks[j] is
+// followed by something that continues a statement (DROP TABLE, SELECT 1,
+// SELECT name FROM) rather than by prose (drop by anytime).
+func sqlStatementFollows(toks []sqlToken, j int) bool {
+	if toks[j].val == "shutdown" {
+		return true
+	}
+	if j+1 >= len(toks) {
+		return false
+	}
+	switch toks[j+1].typ {
+	case 'k':
+		return sqlStatementObjects[toks[j+1].val]
+	case '1', 's', 'v', 'f', 'o', '(':
+		return true
+	case 'n':
+		return j+2 < len(toks) && strings.IndexByte("k,c;", toks[j+2].typ) >= 0
+	}
+	return false
+}
+
+func sqlFingerprint(toks []sqlToken) string {
+	var b strings.Builder
+	for i, tk := range toks {
+		if i == 8 {
+			break
+		}
+		b.WriteByte(tk.typ)
+	}
+	return b.String()
+}
+
+// detectSQLi reports whether a value looks like SQL injection. The value is
+// tokenized three ways, as bare SQL and as the tail of a single- and a
+// double-quoted string, and each token sequence is scored against the shapes
+// injections take: a closed string or number followed by a boolean
+// expression, a comment, a clause or a second statement; UNION SELECT;
+// subqueries; time-delay and file functions; and comment obfuscation. The
+// highest scoring context wins and names the fingerprint.
+func detectSQLi(value string) (detection, bool) {
+	var best detection
+	for _, quote := range []byte{0, '\'', '"'} {
+		if quote != 0 && strings.IndexByte(value, quote) < 0 {
+			continue
+		}
+		toks, obfuscated := tokenizeSQL(value, quote)
+		toks = foldSQL(toks)
+		if conf := scoreSQLi(toks, quote != 0, obfuscated); conf > best.confidence {
+			best = detection{fingerprint: sqlFingerprint(toks), confidence: conf}
+		}
+	}
+	return best, best.confidence > 0
+}
+
+func scoreSQLi(toks []sqlToken, quoted, obfuscated bool) int {
+	if len(toks) == 0 {
+		return 0
+	}
+	score := 0
+	raise := func(n int) {
+		if n > score {
+			score = n
+		}
+	}
+
+	// Break-out prefix: the closed string (quoted context) or the leading
+	// value (numeric context), and any closing parentheses after it.
+	i := 0
+	breakout := 0 // base score of evidence that follows the prefix
+	switch {
+	case quoted && toks[0].typ == 's' && toks[0].closed:
+		i, breakout = 1, 75
+	case !quoted && (toks[0].typ == '1' || toks[0].typ == 'n'):
+		i, breakout = 1, 45
+		if toks[0].typ == '1' {
+			breakout = 60
+		}
+	}
+	if breakout > 0 {
+		for i < len(toks) && toks[i].typ == ')' {
+			i++
+		}
+	}
+	rest := toks[i:]
+	endsInComment := toks[len(toks)-1].typ == 'c'
+	bonus := 0
+	if endsInComment {
+		bonus = 10
+	}
+
+	if breakout > 0 && len(rest) > 0 {
+		switch r := rest[0]; {
+		case r.typ == '&':
+			// ' OR 1=1, ' OR 'a'='a, 1 AND 1=2
+			conf := breakout
+			if len(rest) >= 4 && isSQLValue(rest[1].typ) && rest[2].typ == 'o' && (isSQLValue(rest[3].typ) || rest[3].typ == '(') {
+				conf += 15
+			} else if len(rest) >= 2 && (rest[1].typ == 'f' || rest[1].typ == '(' || rest[1].typ == 'E') {
+				conf += 5
+			} else if len(rest) >= 2 && quoted && (rest[1].typ == '1' || rest[1].typ == 's') {
+				conf += 5
+			} else {
+				conf -= 15
+			}
+			raise(conf + bonus)
+		case r.typ == 'c':
+			// admin'--
+			if quoted {
+				raise(80)
+			} else {
+				raise(breakout - 20)
+			}
+		case r.typ == ';':
+			if len(rest) > 1 && (sqlStatementFollows(rest, 1) || rest[1].val == "waitfor") {
+				raise(90)
+			} else {
+				raise(breakout - 15 + bonus)
+			}
+		case r.typ == 'k' && sqlClauseKeywords[r.val]:
+			// 1' ORDER BY 3--
+			raise(breakout + bonus)
+		case r.typ == 'o' && len(rest) > 1 && (rest[1].typ == 'f' || rest[1].typ == '(' || rest[1].typ == 'E'):
+			// '+sleep(5)+', '||(select ...)||'
+			raise(breakout + 5)
+		case quoted && r.typ == 'o' && len(rest) == 2 && rest[1].typ == 's':
+			// '='
+			raise(70)
+		}
+	}
+
+	for j, tk := range toks {
+		next := func(k int) byte {
+			if j+k < len(toks) {
+				return toks[j+k].typ
+			}
+			return 0
+		}
+		switch tk.typ {
+		case 'U':
+			// UNION [ALL] [(] SELECT
+			k := 1
+			for next(k) == 'k' || next(k) == '(' {
+				k++
+			}
+			if next(k) == 'E' && sqlStatementFollows(toks, j+k) {
+				raise(95)
+			} else if breakout > 0 {
+				raise(breakout + bonus)
+			}
+		case ';':
+			if next(1) == 'E' && sqlStatementFollows(toks, j+1) {
+				raise(90)
+			}
+		case 'f':
+			if sqlDangerousFunctions[tk.val] {
+				prev := byte(0)
+				if j > 0 {
+					prev = toks[j-1].typ
+				}
+				switch {
+				case strings.IndexByte("&o;(,E", prev) >= 0 || (breakout > 0 && j == i):
+					raise(90)
+				case next(1) == '(' && (next(2) == '1' || next(2) == 'f' || next(2) == 'v'):
+					// sleep(5) on its own
+					raise(70)
+				}
+			}
+		case 'k':
+			if tk.val == "waitfor" && next(1) == 'k' && toks[j+1].val == "delay" {
+				raise(90)
+			}
+			if tk.val == "into" && next(1) == 'k' && (toks[j+1].val == "outfile" || toks[j+1].val == "dumpfile") {
+				raise(90)
+			}
+		case '(':
+			if next(1) == 'E' && toks[j+1].val == "select" {
+				if breakout > 0 {
+					raise(85)
+				} else {
+					raise(70)
+				}
+			}
+		case 'X':
+			raise(90)
+		}
+	}
+	if obfuscated {
+		raise(90)
+	}
+	if score > 0 {
+		for _, tk := range toks {
+			if tk.hex {
+				score += 5
+				break
+			}
+		}
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score
+}
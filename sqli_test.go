@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectSQLi(t *testing.T) {
+	tests := []struct {
+		value string
+		fp    string // "" for no detection
+		conf  int
+	}{
+		{`' OR '1'='1`, "s&sos", 90},
+		{`' or 1=1--`, "s&1o1c", 100},
+		{`admin'--`, "sc", 80},
+		{`1 OR 1=1`, "1&1o1", 75},
+		{`1 union select 1,2`, "1UE1,1", 95},
+		{`1; DROP TABLE users`, "1;Ekn", 90},
+		{`1 AND SLEEP(5)`, "1&f(1)", 90},
+		{`1' ORDER BY 3--`, "skk1c", 85},
+		{`1 O/**/R 1=1`, "1&1o1", 90},
+		{`UN/**/ION SEL/**/ECT 1`, "UE1", 95},
+		{`/*!50000SELECT*/ 1`, "X1", 90},
+		{`1 or -(-1)=+1`, "1&1o1", 75},
+		{`' or ('a')=('a')`, "s&sos", 90},
+		{`please update my address`, "", 0},
+		{`O'Reilly or whatever`, "", 0},
+		{`Tom's and Jerry's`, "", 0},
+		{`50% off - today only`, "", 0},
+		{`3.14`, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			d, ok := detectSQLi(tt.value)
+			if tt.fp == "" {
+				if ok && d.confidence >= 60 {
+					t.Errorf("detected %q %d", d.fingerprint, d.confidence)
+				}
+				return
+			}
+			if d.fingerprint != tt.fp || d.confidence != tt.conf {
+				t.Errorf("got %q %d, want %q %d", d.fingerprint, d.confidence, tt.fp, tt.conf)
+			}
+		})
+	}
+}
+
+func TestFoldSQL(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{`'a' 'b' 'c'`, "s"},
+		{`1 + 2 * 3`, "1"},
+		{`- - ~ 1`, "1"},
+		{`1 - - 1`, "1"},
+		{`((((1))))`, "1"},
+		{`-(1)+(2)`, "1"},
+		{`a.b.c`, "n"},
+		{`sleep(5)`, "f(1)"},
+		{`1 + 'a' 'b'`, "1"},
+		{`not (select 1)`, "(E1)"},
+	}
+	for _, tt := range tests {
+		toks, _ := tokenizeSQL(tt.src, 0)
+		if got := sqlFingerprint(foldSQL(toks)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+// TestDetectSQLiLinear checks that inputs that used to take foldSQL one pass
+// per nesting level or sign finish quickly.
+func TestDetectSQLiLinear(t *testing.T) {
+	for name, value := range map[string]string{
+		"nested parentheses": strings.Repeat("(", 20000) + "1" + strings.Repeat(")", 20000),
+		"unary signs":        strings.Repeat("- ", 20000) + "1",
+		"arithmetic":         strings.Repeat("1+", 20000) + "1",
+		"strings":            strings.Repeat("'a' ", 20000),
+		"names":              strings.Repeat("a.", 20000) + "a",
+	} {
+		start := time.Now()
+		detectSQLi(value)
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: %v", name, d)
+		}
+	}
+}
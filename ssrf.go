@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+)
+
+// resolveTimeout bounds the DNS lookup of resolve_hosts.
+const resolveTimeout = 2 * time.Second
+
+// lookupIP resolves a hostname for resolve_hosts. It is a variable so tests
+// can substitute a stub resolver.
+var lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// privateNetworks are the ranges deny_private_networks refuses: this host,
+// loopback, RFC 1918, shared address space, link-local (cloud metadata
+// services), benchmarking, multicast and reserved, and their IPv6 equivalents.
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+		"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15",
+		"224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// validateURLTarget applies the SSRF settings of the url rule at p to a value
+// that already passed validateURL:
+//
+//   - allowed_schemes: schemes the URL may use (default any)
+//   - allowed_hosts: path.Match globs the host must match ("*.example.com")
+//   - deny_private_networks: refuse hosts in private, loopback, link-local and
+//     reserved ranges, however the address is written
+//   - resolve_hosts: also resolve hostnames and refuse them if any address
+//     they resolve to is private
+//
+// A URL that fails a check is blanked like an invalid one.
+func validateURLTarget(k *koanf.Koanf, p string, value string) string {
+	if value == "" {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		log.Printf("not valid URL: %v", value)
+		return ""
+	}
+	if k.Exists(p + ".allowed_schemes") {
+		allowed := false
+		for _, s := range k.Strings(p + ".allowed_schemes") {
+			if strings.EqualFold(s, u.Scheme) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			log.Printf("url scheme %q not in allowed_schemes: %v", u.Scheme, value)
+			return ""
+		}
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if k.Exists(p + ".allowed_hosts") {
+		allowed := false
+		for _, pattern := range k.Strings(p + ".allowed_hosts") {
+			if ok, err := path.Match(strings.ToLower(pattern), host); err == nil && ok {
+				allowed = true
+			}
+		}
+		if !allowed {
+			log.Printf("url host %q not in allowed_hosts: %v", host, value)
+			return ""
+		}
+	}
+	if !k.Bool(p + ".deny_private_networks") {
+		return value
+	}
+	if host == "" || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		log.Printf("url host %q is a private network address: %v", host, value)
+		return ""
+	}
+	if ip := parseHostIP(host); ip != nil {
+		if isPrivateIP(ip) {
+			log.Printf("url host %q is a private network address: %v", host, value)
+			return ""
+		}
+		return value
+	}
+	if k.Bool(p + ".resolve_hosts") {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		ips, err := lookupIP(ctx, host)
+		if err != nil || len(ips) == 0 {
+			// Fail closed: the upstream may resolve what the proxy could not.
+			log.Printf("url host %q cannot be resolved: %v", host, err)
+			return ""
+		}
+		for _, ip := range ips {
+			if isPrivateIP(ip) {
+				log.Printf("url host %q resolves to private network address %s: %v", host, ip, value)
+				return ""
+			}
+		}
+	}
+	return value
+}
+
+// parseHostIP parses a URL host as an IP address the way resolvers and
+// browsers accept it: IPv6 with an optional zone, and IPv4 in the inet_aton
+// forms (2130706433, 0177.0.0.1, 0x7f.1, 127.1). It returns nil for a
+// hostname.
+func parseHostIP(host string) net.IP {
+	if i := strings.IndexByte(host, '%'); i >= 0 && strings.Contains(host, ":") {
+		host = host[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	var nums []uint64
+	for _, part := range parts {
+		base := 10
+		switch {
+		case strings.HasPrefix(part, "0x"):
+			base, part = 16, part[2:]
+		case len(part) > 1 && part[0] == '0':
+			base, part = 8, part[1:]
+		}
+		n, err := strconv.ParseUint(part, base, 32)
+		if err != nil && !(part == "" && base == 16) {
+			return nil
+		}
+		nums = append(nums, n)
+	}
+	// The last part fills the remaining bytes: a.b.c.d, a.b.cd, a.bcd, abcd.
+	var addr uint64
+	for i, n := range nums {
+		if i < len(nums)-1 {
+			if n > 0xff {
+				return nil
+			}
+			addr |= n << (8 * uint(3-i))
+			continue
+		}
+		if n >= 1<<(8*uint(4-i)) {
+			return nil
+		}
+		addr |= n
+	}
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
+
+// isPrivateIP reports whether ip is in privateNetworks, including IPv4
+// addresses embedded in IPv6 as IPv4-mapped (::ffff:127.0.0.1),
+// IPv4-compatible (::127.0.0.1), NAT64 (64:ff9b::7f00:1) and 6to4
+// (2002:7f00:1::) addresses.
+func isPrivateIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if ip16 := ip.To16(); ip16 != nil {
+		switch {
+		case isZero(ip16[:12]) && !isZero(ip16[12:]) && !ip16.Equal(net.IPv6loopback):
+			ip = ip16[12:]
+		case ip16[0] == 0x00 && ip16[1] == 0x64 && ip16[2] == 0xff && ip16[3] == 0x9b && isZero(ip16[4:12]):
+			ip = ip16[12:]
+		case ip16[0] == 0x20 && ip16[1] == 0x02:
+			if isPrivateIP(net.IP(ip16[2:6])) {
+				return true
+			}
+		}
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseHostIP(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"127.0.0.1", "127.0.0.1"},
+		{"2130706433", "127.0.0.1"},
+		{"0177.0.0.1", "127.0.0.1"},
+		{"0x7f.1", "127.0.0.1"},
+		{"127.1", "127.0.0.1"},
+		{"10.1.65535", "10.1.255.255"},
+		{"0x7f000001", "127.0.0.1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"::ffff:127.0.0.1", "127.0.0.1"},
+		{"example.com", "<nil>"},
+		{"1.2.3.4.5", "<nil>"},
+		{"256.1.1.1", "<nil>"},
+		{"1.2.65536", "<nil>"},
+		{"08.1.1.1", "<nil>"},
+	}
+	for _, tt := range tests {
+		if got := parseHostIP(tt.host).String(); got != tt.want {
+			t.Errorf("parseHostIP(%q) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::127.0.0.1", true},
+		{"64:ff9b::7f00:1", true},
+		{"2002:c0a8:101::", true},
+		{"8.8.8.8", false},
+		{"2606:4700::1111", false},
+		{"64:ff9b::808:808", false},
+		{"2002:808:808::", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.private {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.private)
+		}
+	}
+}
+
+func TestValidateURLTarget(t *testing.T) {
+	defer func(f func(context.Context, string) ([]net.IP, error)) { lookupIP = f }(lookupIP)
+	lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "public.example":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		case "rebind.example":
+			return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	c := testConfig(t, `
+form_params:
+  open:
+    type: url
+  target:
+    type: url
+    allowed_schemes: [https]
+    deny_private_networks: true
+  hook:
+    type: url
+    allowed_hosts: ["*.example.com"]
+  resolved:
+    type: url
+    deny_private_networks: true
+    resolve_hosts: true
+`)
+	tests := []struct {
+		field, value string
+		ok           bool
+	}{
+		{"open", "http://127.0.0.1/", true},
+		{"target", "https://example.org/", true},
+		{"target", "http://example.org/", false},
+		{"target", "https://127.0.0.1/", false},
+		{"target", "https://2130706433/", false},
+		{"target", "https://0x7f.1/", false},
+		{"target", "https://[::ffff:127.0.0.1]/", false},
+		{"target", "https://[64:ff9b::a00:1]/", false},
+		{"target", "https://localhost./", false},
+		{"target", "https://api.localhost/", false},
+		{"target", "https://example.com@10.0.0.1/", false},
+		{"target", "https://unresolved.example/", true},
+		{"hook", "https://api.example.com/", true},
+		{"hook", "https://API.Example.com./", true},
+		{"hook", "https://example.com.evil.net/", false},
+		{"resolved", "https://public.example/", true},
+		{"resolved", "https://rebind.example/", false},
+		{"resolved", "https://missing.example/", false},
+		{"resolved", "https://8.8.8.8/", true},
+	}
+	for _, tt := range tests {
+		got := validateURLTarget(c, "form_params."+tt.field, tt.value)
+		if (got == tt.value) != tt.ok {
+			t.Errorf("%s %s: got %q, want ok %v", tt.field, tt.value, got, tt.ok)
+		}
+	}
+}
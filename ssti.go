@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+)
+
+// sstiPatterns are the pattern IDs detectSSTI reports and their confidence.
+var sstiPatterns = map[string]int{
+	"ssti-introspection": 95, // __class__, __globals__, __import__ inside an expression
+	"ssti-java":          95, // T(java.lang.Runtime), .getClass(), freemarker Execute
+	"ssti-object":        85, // config, self, request, lipsum and other template globals
+	"ssti-arith":         80, // {{7*7}}, ${7*7}, #{7*7}, <%= 7*7 %>
+	"ssti-erb":           80, // <%= ... %>, <% ... %>
+	"ssti-directive":     80, // <#assign>, #set($...), {php}
+	"ssti-call":          65, // a call or filter inside an expression
+	"ssti-statement":     60, // {% ... %}
+	"ssti-expression":    35, // any {{...}}, ${...} or #{...}
+}
+
+// sstiIntrospection are attribute names used to climb from a template value to
+// the Python runtime.
+var sstiIntrospection = []string{"__class__", "__mro__", "__subclasses__", "__globals__", "__builtins__", "__import__", "__init__", "__base__", "__dict__"}
+
+// sstiJava are Java expression language and Freemarker gadgets.
+var sstiJava = []string{"t(java.", "java.lang.", ".getclass(", ".forname(", "runtime.getruntime", "freemarker.template.utility", "processbuilder", "@java.lang", "new java."}
+
+// sstiObjects are globals template engines expose that reach configuration or
+// the request (Jinja2, Twig, Smarty, Tornado).
+var sstiObjects = []string{"config", "self", "request", "lipsum", "cycler", "joiner", "namespace", "_self", "app", "settings", "smarty", "env", "handler"}
+
+// detectSSTI reports server-side template injection: template expressions
+// ({{...}}, ${...}, #{...}, *{...}), statements ({% ... %}, <% ... %>) and
+// engine directives in a value a template might render. A bare {{name}} is
+// only ssti-expression; what makes a finding strong is the expression body,
+// scored by sstiExpression.
+func detectSSTI(value string) (detection, bool) {
+	lower := strings.ToLower(value)
+	found := make(map[string]bool)
+
+	for _, d := range []struct{ open, close string }{
+		{"{{", "}}"}, {"${", "}"}, {"#{", "}"}, {"*{", "}"}, {"<%=", "%>"}, {"{%", "%}"}, {"<%", "%>"},
+	} {
+		for i := 0; i < len(lower); {
+			start := strings.Index(lower[i:], d.open)
+			if start < 0 {
+				break
+			}
+			start += i + len(d.open)
+			end := strings.Index(lower[start:], d.close)
+			if end < 0 {
+				break
+			}
+			expr := strings.TrimSpace(lower[start : start+end])
+			i = start + end + len(d.close)
+			if expr == "" {
+				continue
+			}
+			switch d.open {
+			case "{%":
+				found["ssti-statement"] = true
+			case "<%=", "<%":
+				found["ssti-erb"] = true
+			default:
+				found["ssti-expression"] = true
+			}
+			sstiExpression(expr, found)
+		}
+	}
+
+	for _, s := range []string{"<#assign", "<#list", "<#if", "#set($", "#foreach(", "{php}", "{/php}", "{system(", "{$smarty"} {
+		if strings.Contains(lower, s) {
+			found["ssti-directive"] = true
+		}
+	}
+	for _, s := range sstiJava {
+		if strings.Contains(lower, s) {
+			found["ssti-java"] = true
+		}
+	}
+
+	return patternDetection(found, sstiPatterns)
+}
+
+// sstiExpression scores the body of one template expression or statement.
+func sstiExpression(expr string, found map[string]bool) {
+	for _, s := range sstiIntrospection {
+		if strings.Contains(expr, s) {
+			found["ssti-introspection"] = true
+		}
+	}
+	if isTemplateArithmetic(expr) {
+		found["ssti-arith"] = true
+	}
+	for _, obj := range sstiObjects {
+		if rest := strings.TrimPrefix(expr, obj); rest != expr && rest != "" && strings.IndexByte(".[|", rest[0]) >= 0 {
+			found["ssti-object"] = true
+		}
+	}
+	if strings.ContainsAny(expr, "(|") && !found["ssti-arith"] {
+		found["ssti-call"] = true
+	}
+}
+
+// isTemplateArithmetic reports an expression made of number or quoted
+// number operands and arithmetic operators, the probe used to find
+// template injection ({{7*7}}, {{7*'7'}}).
+func isTemplateArithmetic(expr string) bool {
+	operands, operators := 0, 0
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c >= '0' && c <= '9':
+			if i == 0 || !(expr[i-1] >= '0' && expr[i-1] <= '9') {
+				operands++
+			}
+		case c == '*' || c == '+' || c == '-' || c == '/' || c == '%':
+			operators++
+		case c == ' ' || c == '\'' || c == '"' || c == '(' || c == ')':
+		default:
+			return false
+		}
+	}
+	return operands >= 2 && operators >= 1
+}
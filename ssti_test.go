@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestDetectSSTI(t *testing.T) {
+	runDetectorCases(t, detectSSTI, []detectorCase{
+		{"{{7*7}}", "ssti-arith,ssti-expression", 80},
+		{"${7*7}", "ssti-arith,ssti-expression", 80},
+		{"<%= 7*7 %>", "ssti-arith,ssti-erb", 80},
+		{"{{config.items()}}", "ssti-object,ssti-call,ssti-expression", 85},
+		{"{{''.__class__.__mro__[1].__subclasses__()}}", "ssti-introspection,ssti-call,ssti-expression", 95},
+		{"${T(java.lang.Runtime).getRuntime().exec('id')}", "ssti-java,ssti-call,ssti-expression", 95},
+		{`<#assign ex="freemarker.template.utility.Execute"?new()>`, "ssti-java,ssti-directive", 95},
+		{"#set($x=1)", "ssti-directive", 80},
+		{"{% for x in y %}", "ssti-statement", 60},
+		{"{{ user.name|upper }}", "ssti-call,ssti-expression", 65},
+		{"{{name}}", "ssti-expression", 35},
+		{"hello world", "", 0},
+		{"50% off {today}", "", 0},
+		{"a {b} c", "", 0},
+	})
+}
+
+func TestIsTemplateArithmetic(t *testing.T) {
+	for expr, want := range map[string]bool{
+		"7*7":      true,
+		"7*'7'":    true,
+		" 3 + 4 ":  true,
+		"7":        false,
+		"a*7":      false,
+		"2024-":    false,
+		"(1)-(2)":  true,
+		"10 % 3 x": false,
+	} {
+		if got := isTemplateArithmetic(expr); got != want {
+			t.Errorf("%q: got %v", expr, got)
+		}
+	}
+}
@@ -308,9 +308,9 @@ CODE=$(http_code -X POST -d "text=hello&num=42&email=a@b.com" "$PROXY/")
 CODE=$(http_code -X POST -H "Content-Type: application/json" -d '{"key":"value"}' "$PROXY/")
 [ "$CODE" != "000" ] && pass "POST JSON body: discarded (HTTP $CODE)" || fail "POST JSON body: no response"
 
-# Non-urlencoded body (multipart) — discarded
-CODE=$(http_code -X POST -F "file=@/dev/null" "$PROXY/")
-[ "$CODE" != "000" ] && pass "POST multipart: discarded (HTTP $CODE)" || fail "POST multipart: no response"
+# Multipart body — text fields sanitized, files forwarded
+CODE=$(http_code -X POST -F "file=@/dev/null" --form-string "text=<script>alert(1)</script>" "$PROXY/")
+[ "$CODE" != "000" ] && pass "POST multipart: fields sanitized (HTTP $CODE)" || fail "POST multipart: no response"
 
 # Empty POST body
 CODE=$(http_code -X POST -d "" "$PROXY/")
@@ -357,6 +357,18 @@ CODE=$(http_code -X PUT -d "text=hello" "$PROXY/")
 CODE=$(http_code -X DELETE "$PROXY/")
 [ "$CODE" != "000" ] && pass "DELETE method (HTTP $CODE)" || fail "DELETE method: no response"
 
+CODE=$(http_code -X PATCH -d "text=hello" "$PROXY/")
+[ "$CODE" != "000" ] && [ "$CODE" != "405" ] && pass "PATCH method (HTTP $CODE)" || fail "PATCH method: HTTP $CODE"
+
+CODE=$(http_code -X OPTIONS "$PROXY/")
+[ "$CODE" != "000" ] && [ "$CODE" != "405" ] && pass "OPTIONS reaches upstream (HTTP $CODE)" || fail "OPTIONS method: HTTP $CODE"
+
+CODE=$(http_code -X TRACE "$PROXY/")
+[ "$CODE" = "405" ] && pass "TRACE rejected with 405" || fail "TRACE expected 405, got $CODE"
+
+H=$(curl -si -X TRACE "$PROXY/")
+has_header "Allow" "$H" && pass "405 carries Allow header" || fail "405 missing Allow header"
+
 # ---------------------------------------------------------------------------
 # 9. EDGE CASES
 # ---------------------------------------------------------------------------
@@ -383,6 +395,38 @@ CODE=$(http_code --data-urlencode "text=héllo wörld 日本語" -G "$PROXY/")
 CODE=$(http_code --data-urlencode $'text=hello\x00world' -G "$PROXY/")
 [ "$CODE" != "000" ] && pass "null byte in param value (HTTP $CODE)" || fail "null byte: no response"
 
+# ---------------------------------------------------------------------------
+# 10. REQUEST BODIES
+# ---------------------------------------------------------------------------
+section "request bodies"
+
+CODE=$(http_code -X POST -H "Content-Type: application/json" -d '{"text": "<b>x</b>", "n": 1.10}' "$PROXY/")
+[ "$CODE" != "000" ] && pass "JSON body (HTTP $CODE)" || fail "JSON body: no response"
+
+CODE=$(http_code -X POST -H "Content-Type: application/vnd.api+json" -d '{"data": {"text": "x"}}' "$PROXY/")
+[ "$CODE" != "000" ] && pass "+json body (HTTP $CODE)" || fail "+json body: no response"
+
+CODE=$(http_code -X POST -H "Content-Type: application/x-ndjson" --data-binary $'{"text": "a"}\n{"text": "<i>b</i>"}\n' "$PROXY/")
+[ "$CODE" != "000" ] && pass "NDJSON body (HTTP $CODE)" || fail "NDJSON body: no response"
+
+CODE=$(http_code -X POST -H "Content-Type: application/json" -d '{"text": ' "$PROXY/")
+[ "$CODE" != "000" ] && pass "truncated JSON body (HTTP $CODE)" || fail "truncated JSON body: no response"
+
+# xml_security defaults: DOCTYPE stripped, entity declarations rejected
+CODE=$(http_code -X POST -H "Content-Type: application/xml" -d '<?xml version="1.0"?><!DOCTYPE r SYSTEM "r.dtd"><r>x</r>' "$PROXY/")
+[ "$CODE" != "000" ] && [ "$CODE" != "403" ] && pass "XML DOCTYPE stripped (HTTP $CODE)" || fail "XML DOCTYPE: HTTP $CODE"
+
+CODE=$(http_code -X POST -H "Content-Type: application/xml" -d '<!DOCTYPE r [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><r>&xxe;</r>' "$PROXY/")
+[ "$CODE" = "403" ] && pass "XML external entity rejected with 403" || fail "XML external entity: expected 403, got $CODE"
+
+# server.maxBodyBytes 1 MB: larger bodies are refused, chunked or not
+BIG=$(python3 -c "print('text=' + 'A'*1100000)")
+CODE=$(printf '%s' "$BIG" | http_code -X POST -H "Content-Type: application/x-www-form-urlencoded" --data-binary @- "$PROXY/")
+[ "$CODE" = "413" ] && pass "body over maxBodyBytes rejected with 413" || fail "body over maxBodyBytes: expected 413, got $CODE"
+
+CODE=$(printf '%s' "$BIG" | http_code -X POST -H "Transfer-Encoding: chunked" -H "Content-Type: application/x-www-form-urlencoded" --data-binary @- "$PROXY/")
+[ "$CODE" = "413" ] && pass "chunked body over maxBodyBytes rejected with 413" || fail "chunked body over maxBodyBytes: expected 413, got $CODE"
+
 # ---------------------------------------------------------------------------
 # Summary
 # ---------------------------------------------------------------------------
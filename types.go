@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+// decimalSyntax is the form a decimal value must have: no exponent, no
+// thousands separators, no NaN or Inf.
+var decimalSyntax = regexp.MustCompile(`^[+-]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)$`)
+
+// validateTyped validates a value against a regex, enum, integer, decimal or
+// boolean rule at p and returns the value to forward. A valid value is
+// forwarded unchanged, so the caller sees no violation; an invalid one is
+// handled by the rule's on_invalid:
+//
+//   - blank (default), drop, reject: the value is blanked; drop and reject
+//     are completed by the caller (see invalidAction)
+//   - default: the value becomes the rule's default
+//   - clamp: an integer or decimal outside min/max becomes the nearest bound;
+//     one that is not a number is blanked
+func validateTyped(k *koanf.Koanf, p, t, value string) string {
+	fixed, ok := checkTyped(k, p, t, value)
+	if ok {
+		return fixed
+	}
+	log.Printf("not valid %s: %v", t, value)
+	switch k.String(p + ".on_invalid") {
+	case "default":
+		return k.String(p + ".default")
+	case "clamp":
+		if fixed != "" {
+			return fixed
+		}
+	}
+	return ""
+}
+
+// checkTyped reports whether value is valid for the rule at p of type t and
+// returns the value. An integer or decimal outside min/max is reported invalid
+// and returned as the nearest bound.
+func checkTyped(k *koanf.Koanf, p, t, value string) (string, bool) {
+	switch t {
+	case "regex":
+		pattern := k.String(p + ".pattern")
+		re, err := cachedRegexp(`^(?:` + pattern + `)$`)
+		if err != nil {
+			log.Printf("form_params: invalid pattern %q: %v", pattern, err)
+			return "", false
+		}
+		return value, re.MatchString(value)
+	case "enum":
+		fold := k.Bool(p + ".case_insensitive")
+		for _, v := range k.Strings(p + ".values") {
+			if v == value || fold && strings.EqualFold(v, value) {
+				return value, true
+			}
+		}
+		return "", false
+	case "integer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", false
+		}
+		if k.Exists(p+".min") && n < k.Int64(p+".min") {
+			return strconv.FormatInt(k.Int64(p+".min"), 10), false
+		}
+		if k.Exists(p+".max") && n > k.Int64(p+".max") {
+			return strconv.FormatInt(k.Int64(p+".max"), 10), false
+		}
+		return value, true
+	case "decimal":
+		if !decimalSyntax.MatchString(value) {
+			return "", false
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", false
+		}
+		if k.Exists(p+".min") && f < k.Float64(p+".min") {
+			return strconv.FormatFloat(k.Float64(p+".min"), 'f', -1, 64), false
+		}
+		if k.Exists(p+".max") && f > k.Float64(p+".max") {
+			return strconv.FormatFloat(k.Float64(p+".max"), 'f', -1, 64), false
+		}
+		return value, true
+	case "boolean":
+		trueValues, falseValues := []string{"true", "1"}, []string{"false", "0"}
+		if k.Exists(p + ".true_values") {
+			trueValues = k.Strings(p + ".true_values")
+		}
+		if k.Exists(p + ".false_values") {
+			falseValues = k.Strings(p + ".false_values")
+		}
+		for _, v := range append(trueValues, falseValues...) {
+			if strings.EqualFold(v, value) {
+				return value, true
+			}
+		}
+		return "", false
+	}
+	return value, true
+}
+
+// invalidAction completes on_invalid: drop and reject for a value the rule at
+// p changed. It rejects the request for reject and reports whether the caller
+// should drop the parameter for drop.
+func invalidAction(k *koanf.Koanf, p, field, location string, flag *blockFlag) bool {
+	switch k.String(p + ".on_invalid") {
+	case "drop":
+		return true
+	case "reject":
+		if flag != nil {
+			flag.reject(fmt.Sprintf("%s field %q is not a valid %s", location, field, k.String(p+".type")))
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestValidateTyped(t *testing.T) {
+	c := testConfig(t, `
+form_params:
+  id:
+    type: regex
+    pattern: "[a-z]{3}[0-9]+"
+  sort:
+    type: enum
+    values: [asc, desc]
+    case_insensitive: true
+    on_invalid: default
+    default: asc
+  state:
+    type: enum
+    values: [open, closed]
+  page:
+    type: integer
+    min: 1
+    max: 100
+    on_invalid: clamp
+  count:
+    type: integer
+  price:
+    type: decimal
+    min: 0
+    max: 9.99
+    on_invalid: clamp
+  flag:
+    type: boolean
+    true_values: ["yes"]
+    false_values: ["no"]
+`)
+	tests := []struct {
+		name, value, want string
+	}{
+		{"id", "abc123", "abc123"},
+		{"id", "abc123x", ""},
+		{"id", "xabc123", ""},
+		{"sort", "desc", "desc"},
+		{"sort", "DESC", "DESC"},
+		{"sort", "random", "asc"},
+		{"state", "OPEN", ""},
+		{"page", "42", "42"},
+		{"page", "0", "1"},
+		{"page", "1000", "100"},
+		{"page", "1e3", ""},
+		{"count", "-7", "-7"},
+		{"count", "0x10", ""},
+		{"count", "1,2", ""},
+		{"price", "1.5", "1.5"},
+		{"price", ".5", ".5"},
+		{"price", "12", "9.99"},
+		{"price", "-1", "0"},
+		{"price", "1e2", ""},
+		{"price", "NaN", ""},
+		{"flag", "YES", "YES"},
+		{"flag", "true", ""},
+	}
+	for _, tt := range tests {
+		p := "form_params." + tt.name
+		if got := validateTyped(c, p, c.String(p+".type"), tt.value); got != tt.want {
+			t.Errorf("%s=%q: got %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTypedRuleQuery(t *testing.T) {
+	c := testConfig(t, `
+block_on_detect: false
+form_params:
+  sort:
+    type: enum
+    values: [asc, desc]
+    case_insensitive: true
+  page:
+    type: integer
+    on_invalid: drop
+  id:
+    type: integer
+    on_invalid: reject
+`)
+	tests := []struct {
+		query, want string
+		audit       []string
+		rejected    bool
+	}{
+		{"sort=DESC&page=2", "sort=DESC&page=2", nil, false},
+		{"sort=up", "sort=", []string{"form_params:sort"}, false},
+		{"page=x&sort=asc", "sort=asc", []string{"form_params:page"}, false},
+		{"id=x", "id=", []string{"form_params:id"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r, flag, al := testRequest(t, c, "GET", "/?"+tt.query, "", "")
+			sanitizingGET(r, c, flag)
+			if got, _ := url.QueryUnescape(r.URL.RawQuery); got != tt.want {
+				t.Errorf("query %q, want %q", got, tt.want)
+			}
+			if got := auditFields(al); len(got) != len(tt.audit) || len(got) > 0 && got[0] != tt.audit[0] {
+				t.Errorf("audit %v, want %v", got, tt.audit)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/knadh/koanf"
+)
+
+// xmlPathStep is one step of a compiled xml_rules path.
+type xmlPathStep struct {
+	prefix  string // "" matches any namespace
+	local   string // "*" matches any name
+	attr    bool   // @name: matches an attribute of the preceding element
+	descend bool   // //name: the step may match at any depth
+}
+
+// xmlPathCache holds compiled xml_rules paths keyed by source text.
+var xmlPathCache sync.Map
+
+// compileXMLPath parses the supported path subset: /name child steps, //name
+// descendants at any depth, * wildcards and a final @attr step. Names may carry
+// a prefix (ns:name).
+func compileXMLPath(expr string) ([]xmlPathStep, error) {
+	if steps, ok := xmlPathCache.Load(expr); ok {
+		return steps.([]xmlPathStep), nil
+	}
+	if !strings.HasPrefix(expr, "/") {
+		return nil, fmt.Errorf("must start with /")
+	}
+	var steps []xmlPathStep
+	rest := expr
+	for rest != "" {
+		st := xmlPathStep{}
+		if strings.HasPrefix(rest, "//") {
+			st.descend = true
+			rest = rest[2:]
+		} else {
+			rest = rest[1:]
+		}
+		name := rest
+		if i := strings.Index(rest, "/"); i >= 0 {
+			name, rest = rest[:i], rest[i:]
+		} else {
+			rest = ""
+		}
+		if strings.HasPrefix(name, "@") {
+			if rest != "" {
+				return nil, fmt.Errorf("attribute step %q must be last", name)
+			}
+			st.attr = true
+			name = name[1:]
+		}
+		if i := strings.Index(name, ":"); i >= 0 {
+			st.prefix, name = name[:i], name[i+1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty step")
+		}
+		st.local = name
+		steps = append(steps, st)
+	}
+	xmlPathCache.Store(expr, steps)
+	return steps, nil
+}
+
+// matches reports whether the step's name test accepts n. A prefixed step
+// compares namespace URIs when xml_namespaces binds its prefix, so documents
+// may use any prefix for that namespace; otherwise the prefix must be the one
+// written in the document.
+func (st xmlPathStep) matches(k *koanf.Koanf, n xmlName) bool {
+	if st.local != "*" && st.local != n.local {
+		return false
+	}
+	if st.prefix == "" {
+		return true
+	}
+	if uri := k.String("xml_namespaces." + st.prefix); uri != "" {
+		return uri == n.space
+	}
+	return st.prefix == n.prefix
+}
+
+// matchXMLPath reports whether the compiled steps select exactly the element
+// chain elems, or attribute attr of its last element when attr is non-nil.
+func matchXMLPath(k *koanf.Koanf, steps []xmlPathStep, elems []xmlName, attr *xmlName) bool {
+	if len(steps) == 0 {
+		return len(elems) == 0 && attr == nil
+	}
+	st := steps[0]
+	if st.attr {
+		return len(steps) == 1 && attr != nil && (len(elems) == 0 || st.descend) && st.matches(k, *attr)
+	}
+	if !st.descend {
+		return len(elems) > 0 && st.matches(k, elems[0]) && matchXMLPath(k, steps[1:], elems[1:], attr)
+	}
+	for i := range elems {
+		if st.matches(k, elems[i]) && matchXMLPath(k, steps[1:], elems[i+1:], attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// xmlRule resolves the rule for an element's text (attr nil) or one of its
+// attributes. xml_rules entries take precedence over form_params: a SOAP
+// operation's list is consulted first, then the matched route's, then the
+// global one, and within a list the first matching entry wins. Otherwise the value falls back to the form_params lookup
+// by bracket name (see paramRule); attributes are named in the context of their
+// element (order[@id]) and fall back to an @id entry, never to an element rule.
+func xmlRule(k *koanf.Koanf, pol *requestPolicy, elems []xmlName, attr *xmlName) (*koanf.Koanf, string, bool) {
+	for _, src := range pol.ruleSources(k) {
+		for _, entry := range src.Slices("xml_rules") {
+			expr := entry.String("path")
+			steps, err := compileXMLPath(expr)
+			if err != nil {
+				log.Printf("xml_rules: invalid path %q: %v", expr, err)
+				continue
+			}
+			if matchXMLPath(k, steps, elems, attr) {
+				rk := koanf.New(".")
+				rk.MergeAt(entry, "xml_rule")
+				return rk, "xml_rule", true
+			}
+		}
+	}
+	return paramRule(k, pol, xmlBracketPath(elems, attr))
+}
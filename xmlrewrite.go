@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+// errXMLDiscarded reports that the body was refused by xml_limits or
+// xml_security; the violation has already been logged and recorded.
+var errXMLDiscarded = errors.New("xml body discarded")
+
+// xmlName is an element or attribute name as written (prefix and local part)
+// together with the namespace URI the prefix resolved to.
+type xmlName struct {
+	prefix string
+	local  string
+	space  string
+}
+
+// String renders the name as written, e.g. "soap:Body".
+func (n xmlName) String() string {
+	if n.prefix == "" {
+		return n.local
+	}
+	return n.prefix + ":" + n.local
+}
+
+// xmlScope is one open element during the rewrite.
+type xmlScope struct {
+	name xmlName
+	ns   map[string]string // namespace declarations on this element; "" is the default namespace
+}
+
+// xmlRewriter re-emits an XML document while sanitizing its text and attribute
+// values. Tokens are read with RawToken so prefixes are never rewritten, and
+// every token no rule touched is copied from the source bytes unchanged; only
+// text nodes and attribute values whose value changed are re-escaped.
+type xmlRewriter struct {
+	k       *koanf.Koanf
+	pol     *requestPolicy
+	flag    *blockFlag
+	al      *auditLog
+	lim     xmlLimits
+	src     []byte
+	out     bytes.Buffer
+	changed bool
+	stack   []xmlScope
+}
+
+// rewriteXML sanitizes an XML document and returns the result, which is src
+// itself when nothing changed. Malformed documents return the decoder's error;
+// documents refused by xml_limits or xml_security return errXMLDiscarded.
+func rewriteXML(k *koanf.Koanf, pol *requestPolicy, src []byte, flag *blockFlag, al *auditLog) ([]byte, error) {
+	w := &xmlRewriter{k: k, pol: pol, flag: flag, al: al, lim: loadXMLLimits(k), src: src}
+	w.out.Grow(len(src))
+	dec := xml.NewDecoder(bytes.NewReader(src))
+	var prev int64
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := dec.InputOffset()
+		raw := src[prev:end]
+		prev = end
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if err := w.start(t, raw); err != nil {
+				return nil, err
+			}
+		case xml.EndElement:
+			// RawToken does not pair tags, so check nesting here.
+			if len(w.stack) == 0 || w.stack[len(w.stack)-1].name.prefix != t.Name.Space || w.stack[len(w.stack)-1].name.local != t.Name.Local {
+				return nil, fmt.Errorf("unexpected end element </%s>", xmlName{prefix: t.Name.Space, local: t.Name.Local})
+			}
+			w.stack = w.stack[:len(w.stack)-1]
+			w.out.Write(raw)
+		case xml.CharData:
+			if w.lim.maxTextLen > 0 && len(t) > w.lim.maxTextLen {
+				return nil, w.limitExceeded("max_text_len", w.lim.maxTextLen)
+			}
+			w.text(string(t), raw)
+		case xml.Directive:
+			action, kind := xmlDirectiveAction(k, t)
+			if err := w.unsafeMarkup(action, kind, raw); err != nil {
+				return nil, err
+			}
+		case xml.ProcInst:
+			if err := w.unsafeMarkup(xmlProcInstAction(k, t), "processing_instruction", raw); err != nil {
+				return nil, err
+			}
+		default:
+			w.out.Write(raw)
+		}
+	}
+	if len(w.stack) > 0 {
+		return nil, fmt.Errorf("unexpected EOF: element <%s> not closed", w.stack[len(w.stack)-1].name)
+	}
+	if !w.changed {
+		return src, nil
+	}
+	return w.out.Bytes(), nil
+}
+
+// limitExceeded records an xml_limits violation. The body is discarded, like
+// invalid XML.
+func (w *xmlRewriter) limitExceeded(limit string, n int) error {
+	log.Printf("sanitizingXMLBody: xml_limits %s %d exceeded, discarding body", limit, n)
+	if w.flag != nil {
+		w.flag.trigger(fmt.Sprintf("XML body exceeded xml_limits %s %d", limit, n))
+	}
+	if w.al != nil {
+		w.al.add("xml_limits", limit, "body")
+	}
+	return errXMLDiscarded
+}
+
+// unsafeMarkup applies an xml_security action to a DTD, entity declaration or
+// processing instruction: allowed markup is forwarded, stripped markup is
+// dropped, and rejected markup rejects the request.
+func (w *xmlRewriter) unsafeMarkup(action, kind string, raw []byte) error {
+	if action == "allow" {
+		w.out.Write(raw)
+		return nil
+	}
+	log.Printf("sanitizingXMLBody: xml_security %s: %s", action, kind)
+	if w.al != nil {
+		w.al.add("xml_security", kind, "body")
+	}
+	if action == "reject" {
+		if w.flag != nil {
+			w.flag.reject(fmt.Sprintf("XML body contains a %s", kind))
+		}
+		return errXMLDiscarded
+	}
+	if w.flag != nil {
+		w.flag.trigger(fmt.Sprintf("XML body contained a %s", kind))
+	}
+	w.changed = true
+	return nil
+}
+
+// resolve returns the namespace URI bound to prefix at the current depth.
+func (w *xmlRewriter) resolve(prefix string) string {
+	switch prefix {
+	case "xml":
+		return "http://www.w3.org/XML/1998/namespace"
+	case "xmlns":
+		return "http://www.w3.org/2000/xmlns/"
+	}
+	for i := len(w.stack) - 1; i >= 0; i-- {
+		if uri, ok := w.stack[i].ns[prefix]; ok {
+			return uri
+		}
+	}
+	return ""
+}
+
+func (w *xmlRewriter) elements() []xmlName {
+	names := make([]xmlName, len(w.stack))
+	for i, s := range w.stack {
+		names[i] = s.name
+	}
+	return names
+}
+
+func (w *xmlRewriter) start(t xml.StartElement, raw []byte) error {
+	if w.lim.maxDepth > 0 && len(w.stack)+1 > w.lim.maxDepth {
+		return w.limitExceeded("max_depth", w.lim.maxDepth)
+	}
+	if w.lim.maxAttributes > 0 && len(t.Attr) > w.lim.maxAttributes {
+		return w.limitExceeded("max_attributes", w.lim.maxAttributes)
+	}
+
+	scope := xmlScope{ns: make(map[string]string)}
+	for _, a := range t.Attr {
+		switch {
+		case a.Name.Space == "xmlns":
+			scope.ns[a.Name.Local] = a.Value
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			scope.ns[""] = a.Value
+		}
+	}
+	w.stack = append(w.stack, scope)
+	top := &w.stack[len(w.stack)-1]
+	top.name = xmlName{prefix: t.Name.Space, local: t.Name.Local, space: w.resolve(t.Name.Space)}
+	elems := w.elements()
+	w.pol.see(t.Name.Local)
+	w.pol.see(xmlBracketPath(elems, nil))
+
+	// Sanitize attribute values; namespace declarations are left alone.
+	replaced := make(map[int]string)
+	for i, a := range t.Attr {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		attr := xmlName{prefix: a.Name.Space, local: a.Name.Local}
+		if attr.prefix != "" {
+			// Unprefixed attributes are in no namespace, not the default one.
+			attr.space = w.resolve(attr.prefix)
+		}
+		w.pol.see(a.Name.Local)
+		rk, p, _ := xmlRule(w.k, w.pol, elems, &attr)
+		if v := applyBodyRule(w.k, rk, p, xmlSlashPath(elems, &attr), a.Value, w.flag, w.al); v != a.Value {
+			replaced[i] = v
+		}
+	}
+	if len(replaced) == 0 {
+		w.out.Write(raw)
+		return nil
+	}
+
+	// Splice the new values into the tag as written, keeping quotes, spacing
+	// and the order of attributes.
+	spans := xmlAttrValueSpans(raw)
+	if len(spans) != len(t.Attr) {
+		return fmt.Errorf("cannot locate attributes of <%s>", top.name)
+	}
+	last := 0
+	for i, sp := range spans {
+		v, ok := replaced[i]
+		if !ok {
+			continue
+		}
+		w.out.Write(raw[last:sp[0]])
+		xml.EscapeText(&w.out, []byte(v))
+		last = sp[1]
+	}
+	w.out.Write(raw[last:])
+	w.changed = true
+	return nil
+}
+
+func (w *xmlRewriter) text(value string, raw []byte) {
+	if len(w.stack) == 0 || len(bytes.TrimLeft(raw, " \t\r\n")) == 0 {
+		// Whitespace around the root element or between elements.
+		w.out.Write(raw)
+		return
+	}
+	elems := w.elements()
+	rk, p, _ := xmlRule(w.k, w.pol, elems, nil)
+	sanitized := applyBodyRule(w.k, rk, p, xmlSlashPath(elems, nil), value, w.flag, w.al)
+	if sanitized == value {
+		w.out.Write(raw)
+		return
+	}
+	xml.EscapeText(&w.out, []byte(sanitized))
+	w.changed = true
+}
+
+func isXMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// xmlAttrValueSpans returns the byte ranges of the attribute values (without
+// quotes) in a raw start tag, in source order.
+func xmlAttrValueSpans(raw []byte) [][2]int {
+	i := 1 // '<'
+	for i < len(raw) && !isXMLSpace(raw[i]) && raw[i] != '>' && raw[i] != '/' {
+		i++
+	}
+	var spans [][2]int
+	for {
+		for i < len(raw) && isXMLSpace(raw[i]) {
+			i++
+		}
+		if i >= len(raw) || raw[i] == '>' || raw[i] == '/' {
+			return spans
+		}
+		for i < len(raw) && raw[i] != '=' {
+			i++
+		}
+		i++
+		for i < len(raw) && isXMLSpace(raw[i]) {
+			i++
+		}
+		if i >= len(raw) {
+			return spans
+		}
+		quote := raw[i]
+		i++
+		start := i
+		for i < len(raw) && raw[i] != quote {
+			i++
+		}
+		spans = append(spans, [2]int{start, i})
+		i++
+	}
+}
+
+// xmlSlashPath renders a value's location as written in the document, e.g.
+// /soap:Envelope/soap:Body/ns:Login/ns:password or /order/@id. It names XML
+// values in audit events.
+func xmlSlashPath(elems []xmlName, attr *xmlName) string {
+	var b strings.Builder
+	for _, e := range elems {
+		b.WriteString("/" + e.String())
+	}
+	if attr != nil {
+		b.WriteString("/@" + attr.String())
+	}
+	return b.String()
+}
+
+// xmlBracketPath renders a value's location in the bracket notation used for
+// form_params lookup, by local names: order[item][name], order[@id].
+func xmlBracketPath(elems []xmlName, attr *xmlName) string {
+	segs := make([]string, 0, len(elems)+1)
+	for _, e := range elems {
+		segs = append(segs, e.local)
+	}
+	if attr != nil {
+		segs = append(segs, "@"+attr.local)
+	}
+	switch len(segs) {
+	case 0:
+		return ""
+	case 1:
+		return segs[0]
+	}
+	return segs[0] + "[" + strings.Join(segs[1:], "][") + "]"
+}
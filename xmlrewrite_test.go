@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRewriteXML(t *testing.T) {
+	const rules = `
+sanitize_xml_body: true
+xml_namespaces:
+  auth: urn:example:auth
+xml_rules:
+  - path: //auth:Login/auth:password
+    type: text
+    maxlen: 4
+  - path: //auth:Login/@mode
+    type: numeric
+  - path: /order/*/note
+    type: text
+    strip_html: true
+form_params:
+  "@id":
+    type: numeric
+  name:
+    type: text
+    strip_html: true
+`
+	tests := []struct {
+		name, src, want string
+		events          []string
+	}{
+		{"untouched",
+			"<?xml version='1.0'?>\n<order id='7'  x=\"&lt;\">\n  <name>a &amp; b<!-- c --></name>\n  <![CDATA[raw]]>\n</order>",
+			"<?xml version='1.0'?>\n<order id='7'  x=\"&lt;\">\n  <name>a &amp; b<!-- c --></name>\n  <![CDATA[raw]]>\n</order>", nil},
+		{"text", `<order><name>&lt;b&gt;x&lt;/b&gt; &amp; y</name></order>`,
+			`<order><name>x &amp; y</name></order>`, []string{"form_params:/order/name"}},
+		{"attribute spliced", `<order  id = '7a' x="1" ><name>n</name></order>`,
+			`<order  id = '7' x="1" ><name>n</name></order>`, []string{"form_params:/order/@id"}},
+		{"element named like an attribute rule", `<order><id>x</id></order>`, `<order><id>x</id></order>`, nil},
+		{"namespace by URI", `<a:Login xmlns:a="urn:example:auth" mode="x1"><a:password>secret</a:password></a:Login>`,
+			`<a:Login xmlns:a="urn:example:auth" mode="1"><a:password>secr</a:password></a:Login>`,
+			[]string{"xml_rules:/a:Login/@mode", "xml_rules:/a:Login/a:password"}},
+		{"other namespace", `<a:Login xmlns:a="urn:other"><a:password>secret</a:password></a:Login>`,
+			`<a:Login xmlns:a="urn:other"><a:password>secret</a:password></a:Login>`, nil},
+		{"default namespace", `<Login xmlns="urn:example:auth"><password>secret</password></Login>`,
+			`<Login xmlns="urn:example:auth"><password>secr</password></Login>`, []string{"xml_rules:/Login/password"}},
+		{"wildcard step", `<order><item><note>&lt;i&gt;n&lt;/i&gt;</note></item><note>&lt;i&gt;</note></order>`,
+			`<order><item><note>n</note></item><note>&lt;i&gt;</note></order>`, []string{"xml_rules:/order/item/note"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, rules)
+			flag, al := &blockFlag{}, &auditLog{}
+			out, err := rewriteXML(c, &requestPolicy{}, []byte(tt.src), flag, al)
+			if err != nil {
+				t.Fatalf("rewrite: %v", err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+		})
+	}
+
+	for _, src := range []string{`<a><b></a></b>`, `<a>`, `</a>`, `<a:b></c:b>`} {
+		if _, err := rewriteXML(testConfig(t, rules), &requestPolicy{}, []byte(src), &blockFlag{}, &auditLog{}); err == nil {
+			t.Errorf("%s: accepted", src)
+		}
+	}
+}
+
+func TestMatchXMLPath(t *testing.T) {
+	c := testConfig(t, "xml_namespaces:\n  s: urn:s\n")
+	e := func(prefix, local, space string) xmlName { return xmlName{prefix, local, space} }
+	env := []xmlName{e("soap", "Envelope", "urn:env"), e("soap", "Body", "urn:env"), e("x", "Op", "urn:s")}
+	tests := []struct {
+		expr  string
+		elems []xmlName
+		attr  *xmlName
+		match bool
+	}{
+		{"/Envelope/Body/Op", env, nil, true},
+		{"/soap:Envelope/soap:Body/s:Op", env, nil, true},
+		{"/soap:Envelope/soap:Body/x:Op", env, nil, true},
+		{"/Envelope/Body", env, nil, false},
+		{"//Op", env, nil, true},
+		{"//s:Op", env, nil, true},
+		{"//Body/*", env, nil, true},
+		{"/*/*/*", env, nil, true},
+		{"//Op/@id", env, &xmlName{local: "id"}, true},
+		{"//Op", env, &xmlName{local: "id"}, false},
+		{"//@id", env, &xmlName{local: "id"}, true},
+		{"/Envelope//Op", env, nil, true},
+		{"/Body//Op", env, nil, false},
+	}
+	for _, tt := range tests {
+		steps, err := compileXMLPath(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := matchXMLPath(c, steps, tt.elems, tt.attr); got != tt.match {
+			t.Errorf("%s: %v, want %v", tt.expr, got, tt.match)
+		}
+	}
+	for _, expr := range []string{"a", "/a/@b/c", "/a//", "/a/"} {
+		if _, err := compileXMLPath(expr); err == nil {
+			t.Errorf("%s: compiled, want error", expr)
+		}
+	}
+}
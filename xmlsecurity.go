@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"regexp"
+
+	"github.com/knadh/koanf"
+)
+
+// xmlLimits holds the xml_limits settings. Zero values mean "no limit".
+type xmlLimits struct {
+	maxDepth      int
+	maxAttributes int
+	maxTextLen    int
+}
+
+func loadXMLLimits(k *koanf.Koanf) xmlLimits {
+	return xmlLimits{
+		maxDepth:      k.Int("xml_limits.max_depth"),
+		maxAttributes: k.Int("xml_limits.max_attributes"),
+		maxTextLen:    k.Int("xml_limits.max_text_len"),
+	}
+}
+
+// xmlSecurityDefaults are the xml_security actions used for keys the config
+// does not set. Markup that makes the backend parser fetch or expand content
+// never passes by default.
+var xmlSecurityDefaults = map[string]string{
+	"doctype":                 "strip",
+	"entities":                "reject",
+	"processing_instructions": "reject",
+}
+
+// xmlActionRank orders xml_security actions from most to least permissive.
+var xmlActionRank = map[string]int{"allow": 0, "strip": 1, "reject": 2}
+
+// xmlSecurityAction returns the configured action (allow, strip or reject) for
+// an xml_security key. Unknown values fall back to the default.
+func xmlSecurityAction(k *koanf.Koanf, key string) string {
+	action := k.String("xml_security." + key)
+	if _, ok := xmlActionRank[action]; !ok {
+		return xmlSecurityDefaults[key]
+	}
+	return action
+}
+
+var xmlEntityDecl = regexp.MustCompile(`<!ENTITY\b`)
+
+// xmlDirectiveAction decides what to do with a <!...> directive. A DOCTYPE
+// follows the doctype setting; one whose internal subset declares entities
+// (the vehicle for XXE and entity expansion attacks) follows whichever of
+// doctype and entities is stricter. It returns the action and the audit field,
+// "doctype" or "entity".
+func xmlDirectiveAction(k *koanf.Koanf, d xml.Directive) (string, string) {
+	action := xmlSecurityAction(k, "doctype")
+	if !xmlEntityDecl.Match(d) && !bytes.HasPrefix(bytes.TrimSpace(d), []byte("ENTITY")) {
+		return action, "doctype"
+	}
+	if e := xmlSecurityAction(k, "entities"); xmlActionRank[e] > xmlActionRank[action] {
+		action = e
+	}
+	return action, "entity"
+}
+
+// xmlProcInstAction decides what to do with a processing instruction. The XML
+// declaration (<?xml version="1.0"?>) is always kept.
+func xmlProcInstAction(k *koanf.Koanf, pi xml.ProcInst) string {
+	if pi.Target == "xml" {
+		return "allow"
+	}
+	return xmlSecurityAction(k, "processing_instructions")
+}
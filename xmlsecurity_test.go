@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestXMLSecurity(t *testing.T) {
+	const xxe = `<?xml version="1.0"?><!DOCTYPE r [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><r>&xxe;</r>`
+	const dtd = `<?xml version="1.0"?><!DOCTYPE r SYSTEM "r.dtd"><r>x</r>`
+	const pi = `<?xml version="1.0"?><?xml-stylesheet href="a.xsl"?><r>x</r>`
+	tests := []struct {
+		name, cfg, src, want string
+		events               []string
+		rejected, discarded  bool
+	}{
+		{"plain", "", `<?xml version="1.0"?><r a="1">x</r>`, `<?xml version="1.0"?><r a="1">x</r>`, nil, false, false},
+		{"doctype stripped", "", dtd, `<?xml version="1.0"?><r>x</r>`, []string{"xml_security:doctype"}, false, false},
+		{"doctype allowed", "xml_security:\n  doctype: allow\n", dtd, dtd, nil, false, false},
+		{"doctype rejected", "xml_security:\n  doctype: reject\n", dtd, "", []string{"xml_security:doctype"}, true, true},
+		{"entity rejected", "", xxe, "", []string{"xml_security:entity"}, true, true},
+		{"entity rejected with doctype allowed", "xml_security:\n  doctype: allow\n", xxe, "", []string{"xml_security:entity"}, true, true},
+		{"entity stripped", "xml_security:\n  entities: strip\n", `<!DOCTYPE r [<!ENTITY a "b">]><r>x</r>`, `<r>x</r>`, []string{"xml_security:entity"}, false, false},
+		{"processing instruction", "", pi, "", []string{"xml_security:processing_instruction"}, true, true},
+		{"processing instruction stripped", "xml_security:\n  processing_instructions: strip\n", pi, `<?xml version="1.0"?><r>x</r>`,
+			[]string{"xml_security:processing_instruction"}, false, false},
+		{"unknown action", "xml_security:\n  entities: off\n", xxe, "", []string{"xml_security:entity"}, true, true},
+		{"too deep", "xml_limits:\n  max_depth: 2\n", `<a><b><c/></b></a>`, "", []string{"xml_limits:max_depth"}, false, true},
+		{"deep enough", "xml_limits:\n  max_depth: 3\n", `<a><b><c/></b></a>`, `<a><b><c/></b></a>`, nil, false, false},
+		{"too many attributes", "xml_limits:\n  max_attributes: 2\n", `<a x="1" y="2" xmlns:n="u"/>`, "", []string{"xml_limits:max_attributes"}, false, true},
+		{"text too long", "xml_limits:\n  max_text_len: 4\n", `<a>12345</a>`, "", []string{"xml_limits:max_text_len"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, "sanitize_xml_body: true\n"+tt.cfg)
+			flag, al := &blockFlag{}, &auditLog{}
+			out, err := rewriteXML(c, &requestPolicy{}, []byte(tt.src), flag, al)
+			if (err == errXMLDiscarded) != tt.discarded {
+				t.Fatalf("error %v, want discarded %v", err, tt.discarded)
+			}
+			if err == nil && string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+			if flag.triggered != tt.rejected {
+				t.Errorf("rejected %v (%s), want %v", flag.triggered, flag.reason, tt.rejected)
+			}
+			if got := auditFields(al); !reflect.DeepEqual(got, tt.events) {
+				t.Errorf("audit %v, want %v", got, tt.events)
+			}
+		})
+	}
+}
+
+func TestXMLBillionLaughs(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE lolz [<!ENTITY lol "lol">`)
+	for i := 1; i < 10; i++ {
+		b.WriteString(`<!ENTITY lol` + string(rune('0'+i)) + ` "` + strings.Repeat("&lol;", 10) + `">`)
+	}
+	b.WriteString(`]><lolz>&lol9;</lolz>`)
+	c := testConfig(t, "sanitize_xml_body: true\nxml_security:\n  doctype: strip\n  entities: strip\n")
+	out, err := rewriteXML(c, &requestPolicy{}, []byte(b.String()), &blockFlag{}, &auditLog{})
+	// With the declarations stripped the reference is undefined, so the
+	// document must not survive either as it was or expanded.
+	if err == nil {
+		t.Errorf("accepted as %.100s", out)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// xpathiPatterns are the pattern IDs detectXPathi reports and their
+// confidence.
+var xpathiPatterns = map[string]int{
+	"xpathi-breakout":  90, // ' or '1'='1, closing the string and adding a condition
+	"xpathi-union":     85, // '] | //user/*, a second location path
+	"xpathi-axis":      80, // child::, descendant::, ancestor::, @*
+	"xpathi-predicate": 80, // '], closing the string and the predicate around it
+	"xpathi-function":  70, // count(, name(, string-length(, text()
+	"xpathi-comment":   60, // (: ... :)
+}
+
+var (
+	xpathBreakout = regexp.MustCompile(`(?i)['"]\s*(?:or|and)\s+(?:[^=]*=|\S*\s*(?:true|not)\s*\()`)
+	xpathUnion    = regexp.MustCompile(`\|\s*/`)
+	xpathAxis     = regexp.MustCompile(`(?i)\b(?:child|descendant|descendant-or-self|ancestor|ancestor-or-self|parent|self|following|following-sibling|preceding|preceding-sibling|attribute|namespace)::|@\*`)
+	xpathFunction = regexp.MustCompile(`(?i)\b(?:count|name|local-name|string-length|substring|substring-before|substring-after|contains|starts-with|string|text|node|position|last|doc|document|concat|translate|normalize-space|boolean|number)\(`)
+)
+
+// detectXPathi reports XPath injection: a value that, placed in a string
+// literal or a predicate of a query such as //user[name='VALUE'], changes
+// what the query selects. Function calls must have no space before the
+// parenthesis, so prose like "name (nick)" is not one.
+func detectXPathi(value string) (detection, bool) {
+	found := make(map[string]bool)
+	if xpathBreakout.MatchString(value) {
+		found["xpathi-breakout"] = true
+	}
+	if xpathUnion.MatchString(value) {
+		found["xpathi-union"] = true
+	}
+	if xpathAxis.MatchString(value) {
+		found["xpathi-axis"] = true
+	}
+	if strings.Contains(value, "']") || strings.Contains(value, `"]`) {
+		found["xpathi-predicate"] = true
+	}
+	if xpathFunction.MatchString(value) {
+		found["xpathi-function"] = true
+	}
+	if i := strings.Index(value, "(:"); i >= 0 && strings.Contains(value[i:], ":)") {
+		found["xpathi-comment"] = true
+	}
+	return patternDetection(found, xpathiPatterns)
+}
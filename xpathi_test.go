@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestDetectXPathi(t *testing.T) {
+	runDetectorCases(t, detectXPathi, []detectorCase{
+		{"' or '1'='1", "xpathi-breakout", 90},
+		{`" or true() or "`, "xpathi-breakout", 90},
+		{"'] | //user/*", "xpathi-union,xpathi-predicate", 85},
+		{"x'] | //*[contains(name(),'a')", "xpathi-union,xpathi-predicate,xpathi-function", 85},
+		{"child::node()", "xpathi-axis,xpathi-function", 80},
+		{"@*", "xpathi-axis", 80},
+		{"count(//user)", "xpathi-function", 70},
+		{"(: c :)", "xpathi-comment", 60},
+		{"O'Brien", "", 0},
+		{"name (nick)", "", 0},
+		{"a][b", "", 0},
+		{"/*", "", 0},
+		{"I like math: 2+2", "", 0},
+	})
+}
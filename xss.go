@@ -0,0 +1,409 @@
+package main
+
+import (
+	"html"
+	"strings"
+
+	"github.com/knadh/koanf"
+)
+
+// xssDefaultContexts are the output contexts checked when a rule sets no
+// xss_context. JavaScript string contexts are opt-in: quotes followed by
+// punctuation are too common in prose.
+var xssDefaultContexts = []string{"html", "attribute", "url"}
+
+// xssMaxScanLength is how much of a value detectXSSValue inspects. Markup
+// that runs script fits in far less; the bound keeps each scan cheap.
+const xssMaxScanLength = 64 << 10
+
+// xssDangerousTags run script or load active content by themselves.
+var xssDangerousTags = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true, "object": true,
+	"embed": true, "applet": true, "svg": true, "math": true, "style": true,
+	"link": true, "meta": true, "base": true, "template": true, "xml": true,
+	"import": true, "portal": true, "isindex": true, "xmp": true, "noembed": true,
+}
+
+// xssURLAttributes take a URL the browser may navigate to or load.
+var xssURLAttributes = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "xlink:href": true,
+	"data": true, "background": true, "poster": true, "codebase": true, "lowsrc": true,
+	"dynsrc": true, "to": true, "from": true, "values": true, "ping": true,
+}
+
+// detectXSS runs detectXSSValue with the contexts configured on the rule at p.
+func detectXSS(rk *koanf.Koanf, p, value string) (detection, bool) {
+	contexts := xssDefaultContexts
+	if rk.Exists(p + ".xss_context") {
+		// A single context may be given as a string.
+		if contexts = rk.Strings(p + ".xss_context"); len(contexts) == 0 {
+			contexts = []string{rk.String(p + ".xss_context")}
+		}
+	}
+	return detectXSSValue(value, contexts)
+}
+
+// detectXSSValue reports whether a value would run script when written into
+// any of the given output contexts:
+//
+//   - html: element content; tags that run script or carry event handlers or
+//     script URLs, and template expressions ({{constructor...}})
+//   - attribute: a quoted or unquoted attribute value; a quote that closes it
+//     followed by an event handler, a script URL or a new tag
+//   - url: an href or src; javascript:, vbscript: and data: URLs other than
+//     images
+//   - js: a JavaScript string literal; a quote followed by code, or </script>
+//
+// The value is checked after HTML entity and percent decoding (repeatedly, for
+// double encoding), so &#x3C;script and %3Csvg are seen as markup. Only the
+// first xssMaxScanLength bytes are checked.
+func detectXSSValue(value string, contexts []string) (detection, bool) {
+	if len(value) > xssMaxScanLength {
+		value = value[:xssMaxScanLength]
+	}
+	var best detection
+	raise := func(fp string, conf int) {
+		if conf > best.confidence {
+			best = detection{fingerprint: fp, confidence: conf}
+		}
+	}
+	for _, v := range xssDecodings(value) {
+		for _, ctx := range contexts {
+			switch ctx {
+			case "html":
+				xssScanHTML(v, raise)
+				xssScanTemplate(v, raise)
+			case "attribute":
+				xssScanAttribute(v, raise)
+			case "url":
+				if fp, conf := xssScanURL(v); conf > 0 {
+					raise(fp, conf)
+				}
+			case "js":
+				xssScanJS(v, raise)
+			}
+		}
+	}
+	return best, best.confidence > 0
+}
+
+// xssDecodings returns the value and its successive entity- and
+// percent-decoded forms, up to three levels deep.
+func xssDecodings(value string) []string {
+	out := []string{value}
+	v := value
+	for i := 0; i < 3; i++ {
+		d := percentDecode(html.UnescapeString(v))
+		if d == v {
+			break
+		}
+		out = append(out, d)
+		v = d
+	}
+	return out
+}
+
+// percentDecode decodes %XX escapes and leaves malformed ones as they are.
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHexDigit(s[i+1]) && isHexDigit(s[i+2]) {
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+func isXSSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '/'
+}
+
+// xssAttr is one attribute of a scanned tag.
+type xssAttr struct {
+	name, value string
+}
+
+// xssScanAttrs parses an attribute list the way a browser's tokenizer does,
+// from s[i] up to '>' or the end of s: names end at whitespace, '/', '=' or
+// '>', and values may be quoted or bare. It returns the attributes and the
+// index after '>' (or len(s)).
+func xssScanAttrs(s string, i int) ([]xssAttr, int) {
+	var attrs []xssAttr
+	for i < len(s) {
+		for i < len(s) && isXSSSpace(s[i]) {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+		if s[i] == '>' {
+			return attrs, i + 1
+		}
+		start := i
+		for i < len(s) && !isXSSSpace(s[i]) && s[i] != '=' && s[i] != '>' {
+			i++
+		}
+		a := xssAttr{name: strings.ToLower(s[start:i])}
+		j := i
+		for j < len(s) && isXSSSpace(s[j]) && s[j] != '/' {
+			j++
+		}
+		if j < len(s) && s[j] == '=' {
+			i = j + 1
+			for i < len(s) && isXSSSpace(s[i]) && s[i] != '/' {
+				i++
+			}
+			if i < len(s) && (s[i] == '"' || s[i] == '\'' || s[i] == '`') {
+				q := s[i]
+				end := strings.IndexByte(s[i+1:], q)
+				if end < 0 {
+					a.value = s[i+1:]
+					i = len(s)
+				} else {
+					a.value = s[i+1 : i+1+end]
+					i += end + 2
+				}
+			} else {
+				start := i
+				for i < len(s) && !(s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '\f' || s[i] == '>') {
+					i++
+				}
+				a.value = s[start:i]
+			}
+		}
+		if a.name != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs, len(s)
+}
+
+// xssCheckAttrs scores an attribute list: event handlers, script URLs in URL
+// attributes, srcdoc and script in style. base is the confidence of an event
+// handler; the caller lowers it when the list was reached less certainly.
+func xssCheckAttrs(attrs []xssAttr, base int, raise func(string, int)) {
+	for _, a := range attrs {
+		switch {
+		case len(a.name) > 2 && strings.HasPrefix(a.name, "on") && isASCIILetters(a.name[2:]):
+			raise(a.name+"=", base)
+		case xssURLAttributes[a.name]:
+			if fp, conf := xssScanURL(a.value); conf > 0 {
+				raise(a.name+"="+fp, conf)
+			}
+		case a.name == "srcdoc":
+			raise("srcdoc=", base-10)
+		case a.name == "style":
+			v := strings.ToLower(xssCompact(a.value))
+			if strings.Contains(v, "expression(") || strings.Contains(v, "javascript:") || strings.Contains(v, "-moz-binding") {
+				raise("style=", base-10)
+			}
+		}
+	}
+}
+
+func isASCIILetters(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i] | 0x20; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// xssScanHTML looks for markup in element content. Tags are scanned in one
+// forward pass: a '<' inside a tag's attributes is part of the tag, as it is
+// for a browser, and is not scanned again.
+func xssScanHTML(s string, raise func(string, int)) {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '<' || i+1 >= len(s) {
+			continue
+		}
+		j := i + 1
+		if s[j] == '/' {
+			j++
+		}
+		if j >= len(s) {
+			break
+		}
+		if s[j] == '!' {
+			if strings.HasPrefix(s[j:], "![CDATA[") || strings.HasPrefix(s[j:], "!--") {
+				raise("<!", 40)
+			}
+			continue
+		}
+		start := j
+		for j < len(s) && (isASCIILetters(s[j:j+1]) || (j > start && (s[j] == '-' || s[j] == ':' || (s[j] >= '0' && s[j] <= '9')))) {
+			j++
+		}
+		if j == start {
+			continue
+		}
+		tag := strings.ToLower(s[start:j])
+		if i := strings.IndexByte(tag, ':'); i >= 0 {
+			tag = tag[i+1:]
+		}
+		if xssDangerousTags[tag] {
+			raise("<"+tag, 90)
+		} else {
+			raise("<"+tag, 30)
+		}
+		attrs, end := xssScanAttrs(s, j)
+		xssCheckAttrs(attrs, 90, func(fp string, conf int) { raise("<"+tag+" "+fp, conf) })
+		i = end - 1
+	}
+}
+
+// xssScanTemplate looks for client-side template expressions that reach the
+// JavaScript runtime: {{constructor.constructor('alert(1)')()}}, {{$on...}}.
+// Each expression runs from a {{ to the next }}; a {{ inside it starts no
+// expression of its own, as what follows it is part of the outer one.
+func xssScanTemplate(s string, raise func(string, int)) {
+	for i := strings.Index(s, "{{"); i >= 0; {
+		end := strings.Index(s[i+2:], "}}")
+		expr := s[i+2:]
+		if end >= 0 {
+			expr = s[i+2 : i+2+end]
+		}
+		lower := strings.ToLower(expr)
+		switch {
+		case strings.Contains(lower, "constructor"), strings.Contains(lower, "$eval"), strings.Contains(lower, "$on"),
+			strings.Contains(lower, "__proto__"), strings.Contains(lower, "$emit"), strings.Contains(lower, "_c.constructor"):
+			raise("{{constructor", 85)
+		case strings.ContainsAny(expr, "()[]=") && end >= 0:
+			raise("{{(", 65)
+		case end >= 0:
+			raise("{{", 35)
+		}
+		if end < 0 {
+			break
+		}
+		i += 2 + end + 2
+		next := strings.Index(s[i:], "{{")
+		if next < 0 {
+			break
+		}
+		i += next
+	}
+}
+
+// xssScanAttribute looks for a break-out from an attribute value: a quote
+// closing a quoted value, or whitespace ending a bare one, followed by new
+// attributes; or a '>' closing the tag, followed by markup.
+func xssScanAttribute(s string, raise func(string, int)) {
+	for _, q := range []byte{'"', '\'', '`'} {
+		i := strings.IndexByte(s, q)
+		if i < 0 {
+			continue
+		}
+		attrs, end := xssScanAttrs(s, i+1)
+		xssCheckAttrs(attrs, 90, func(fp string, conf int) { raise(string(q)+" "+fp, conf) })
+		if end < len(s) || strings.HasSuffix(s[:end], ">") {
+			xssScanHTML(s[end:], func(fp string, conf int) { raise(string(q)+">"+fp, conf) })
+		}
+	}
+	// Unquoted value: whitespace starts the next attribute. Only event
+	// handlers count; bare words and URLs are common in prose.
+	if i := strings.IndexAny(s, " \t\n\r\f"); i >= 0 {
+		attrs, _ := xssScanAttrs(s, i)
+		for _, a := range attrs {
+			if len(a.name) > 2 && strings.HasPrefix(a.name, "on") && isASCIILetters(a.name[2:]) && a.value != "" {
+				raise(" "+a.name+"=", 75)
+			}
+		}
+	}
+}
+
+// xssCompact removes what browsers ignore inside a URL scheme: whitespace and
+// control characters (java\tscript:).
+func xssCompact(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// xssScanURL reports a URL that runs script when navigated to or loaded.
+func xssScanURL(s string) (string, int) {
+	v := strings.ToLower(xssCompact(s))
+	switch {
+	case strings.HasPrefix(v, "javascript:"):
+		return "javascript:", 95
+	case strings.HasPrefix(v, "vbscript:"), strings.HasPrefix(v, "livescript:"):
+		return "vbscript:", 95
+	case strings.HasPrefix(v, "data:"):
+		for _, safe := range []string{"data:image/png", "data:image/gif", "data:image/jpeg", "data:image/webp"} {
+			if strings.HasPrefix(v, safe) {
+				return "", 0
+			}
+		}
+		return "data:", 85
+	}
+	return "", 0
+}
+
+// xssScanJS looks for a break-out from a JavaScript string literal: a quote
+// followed by an operator or statement separator and more code, a template
+// literal substitution, or a </script> that ends the script element.
+func xssScanJS(s string, raise func(string, int)) {
+	lower := strings.ToLower(s)
+	if strings.Contains(lower, "</script") {
+		raise("</script", 95)
+	}
+	if strings.Contains(s, "${") {
+		raise("${", 70)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\'' && c != '"' && c != '`' {
+			continue
+		}
+		j := i + 1
+		for j < len(s) && (s[j] == ' ' || s[j] == '\t') {
+			j++
+		}
+		if j >= len(s) || strings.IndexByte(";+-*/,)|&?:", s[j]) < 0 {
+			continue
+		}
+		op := s[j]
+		j++
+		for j < len(s) && (s[j] == ' ' || s[j] == '\t' || s[j] == '|' || s[j] == '&' || s[j] == '/') {
+			j++
+		}
+		// The code after the operator must start an identifier or call.
+		k := j
+		for k < len(s) && (isASCIILetters(s[k:k+1]) || s[k] == '_' || s[k] == '$' || s[k] == '.' || (k > j && s[k] >= '0' && s[k] <= '9')) {
+			k++
+		}
+		if k > j && k < len(s) && (s[k] == '(' || s[k] == '`' || s[k] == '=') {
+			raise(string(c)+string(op)+s[j:k]+"(", 85)
+		}
+	}
+}
+
+// encodeHTML entity-encodes the characters that end text, attribute values
+// and JavaScript strings, so the value displays as typed.
+func encodeHTML(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&#34;", "'", "&#39;", "`", "&#96;").Replace(s)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectXSS(t *testing.T) {
+	tests := []struct {
+		name     string
+		contexts []string
+		value    string
+		fp       string // "" for no detection
+		conf     int
+	}{
+		{"script tag", nil, `<script>alert(1)</script>`, "<script", 90},
+		{"svg onload", nil, `<svg/onload=alert(1)>`, "<svg", 90},
+		{"event handler", nil, `<img src=x onerror=alert(1)>`, "<img onerror=", 90},
+		{"script URL", nil, `<a href="javascript:alert(1)">x</a>`, "<a href=javascript:", 95},
+		{"entity encoded", nil, `&#x3C;script&#x3E;alert(1)`, "<script", 90},
+		{"percent encoded twice", nil, `%253Csvg%2Fonload%3Dalert(1)%253E`, "<svg", 90},
+		{"template", nil, `{{constructor.constructor('alert(1)')()}}`, "{{constructor", 85},
+		{"attribute breakout", nil, `" onmouseover=alert(1) x="`, `" onmouseover=`, 90},
+		{"attribute then tag", []string{"attribute"}, `"><img src=x onerror=alert(1)>`, `"><img onerror=`, 90},
+		{"bare attribute", nil, `x onfocus=alert(1) autofocus`, " onfocus=", 75},
+		{"tab in scheme", []string{"url"}, "java\tscript:alert(1)", "javascript:", 95},
+		{"data URL", []string{"url"}, `data:text/html;base64,PHNjcmlwdD4=`, "data:", 85},
+		{"data image", []string{"url"}, `data:image/png;base64,iVBORw0KGgo=`, "", 0},
+		{"js breakout", []string{"js"}, `';alert(1)//`, "';alert(", 85},
+		{"js end of script", []string{"js"}, `</script><script>alert(1)`, "</script", 95},
+		{"js not checked by default", nil, `';alert(1)//`, "", 0},
+		{"bold", nil, `<b>bold</b>`, "<b", 30},
+		{"heart", nil, `I <3 this`, "", 0},
+		{"plain text", nil, `Fish & chips, "quoted" and 'single'`, "", 0},
+		{"less than", nil, `a < b and c > d`, "", 0},
+		{"URL", nil, `https://example.com/?q=1&r=2`, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contexts := tt.contexts
+			if contexts == nil {
+				contexts = xssDefaultContexts
+			}
+			d, ok := detectXSSValue(tt.value, contexts)
+			if ok != (tt.fp != "") || d.fingerprint != tt.fp || d.confidence != tt.conf {
+				t.Errorf("got %q %d (%v), want %q %d", d.fingerprint, d.confidence, ok, tt.fp, tt.conf)
+			}
+		})
+	}
+}
+
+// TestDetectXSSLinear checks that inputs built to make the scans revisit the
+// rest of the value for every tag or template opener finish quickly.
+func TestDetectXSSLinear(t *testing.T) {
+	contexts := []string{"html", "attribute", "url", "js"}
+	for name, value := range map[string]string{
+		"unclosed tags":      strings.Repeat("<a ", 40000),
+		"unclosed quotes":    strings.Repeat(`<a x="`, 20000),
+		"unclosed templates": strings.Repeat("{{", 60000),
+		"nested templates":   strings.Repeat("{{a", 40000) + "}}",
+		"quotes":             strings.Repeat(`'; `, 40000),
+	} {
+		start := time.Now()
+		detectXSSValue(value, contexts)
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: %v", name, d)
+		}
+	}
+}
+
+func TestDetectXSSScanLength(t *testing.T) {
+	padding := strings.Repeat("x", xssMaxScanLength)
+	if _, ok := detectXSSValue("<script>"+padding, xssDefaultContexts); !ok {
+		t.Error("markup at the start not detected")
+	}
+	if _, ok := detectXSSValue(padding+"<script>", xssDefaultContexts); ok {
+		t.Error("markup past xssMaxScanLength detected")
+	}
+}
+
+func TestXSSContextConfig(t *testing.T) {
+	rk := testConfig(t, `
+form_params:
+  list:
+    xss_context: [js]
+  single:
+    xss_context: url
+`)
+	if _, ok := detectXSS(rk, "form_params.list", `';alert(1)//`); !ok {
+		t.Error("list: js context not used")
+	}
+	if _, ok := detectXSS(rk, "form_params.single", `<script>`); ok {
+		t.Error("single: html context used")
+	}
+	if _, ok := detectXSS(rk, "form_params.single", `javascript:alert(1)`); !ok {
+		t.Error("single: url context not used")
+	}
+}
+
+func TestEncodeHTML(t *testing.T) {
+	got := encodeHTML("<a href=\"x\" title='y'>&`")
+	want := "&lt;a href=&#34;x&#34; title=&#39;y&#39;&gt;&amp;&#96;"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}